@@ -1,29 +1,205 @@
 package connections
 
 import (
+	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// CloseTokenExpired is the close code sent when a connection's token lapses without re-authentication
+	CloseTokenExpired = 4001
+	// CloseCredentialsRevoked is the close code sent when the user's credentials were revoked, such as by a password change
+	CloseCredentialsRevoked = 4003
+	// expiryWarning is how long before the token expires the client is asked to re-authenticate
+	expiryWarning = time.Minute
+)
+
+// Connection wraps a WebSocket connection with a priority ordered outbound queue.
+// A single writer goroutine drains the queue so writes are never concurrent.
+type Connection struct {
+	UserID   string
+	DeviceID string // Device of the token the connection was opened with
+	Conn     *websocket.Conn
+	queue    *outboundQueue
+	mu       sync.Mutex
+
+	expiryMu     sync.Mutex
+	expiresAt    time.Time
+	warningTimer *time.Timer
+	expiryTimer  *time.Timer
+}
+
+// SetExpiry closes the connection with CloseTokenExpired once expiresAt passes, replacing any
+// earlier expiry. onWarning, if not nil, is called shortly before so the client can re-authenticate.
+func (c *Connection) SetExpiry(expiresAt time.Time, onWarning func()) {
+	c.expiryMu.Lock()
+	defer c.expiryMu.Unlock()
+	c.stopExpiryTimers()
+
+	c.expiresAt = expiresAt
+	if delay := time.Until(expiresAt) - expiryWarning; delay > 0 && onWarning != nil {
+		c.warningTimer = time.AfterFunc(delay, onWarning)
+	}
+	c.expiryTimer = time.AfterFunc(time.Until(expiresAt), c.closeExpired)
+}
+
+// ExpiresAt returns when the connection's token expires
+func (c *Connection) ExpiresAt() time.Time {
+	c.expiryMu.Lock()
+	defer c.expiryMu.Unlock()
+	return c.expiresAt
+}
+
+// stopExpiryTimers stops the pending expiry timers, the caller holds expiryMu
+func (c *Connection) stopExpiryTimers() {
+	if c.warningTimer != nil {
+		c.warningTimer.Stop()
+	}
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+	}
+}
+
+// closeExpired closes the connection because its token expired
+func (c *Connection) closeExpired() {
+	log.Printf("Token of user %s expired, closing connection\n", c.UserID)
+	c.Close(CloseTokenExpired, "token expired")
+}
+
+// Close sends a close frame with the given code and closes the socket. Closing the socket ends
+// the handler's read loop, which removes the connection.
+func (c *Connection) Close(code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+// WriteMessage writes a frame immediately, bypassing the queue. It is meant for control
+// frames that must not wait behind queued traffic.
+func (c *Connection) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// Send queues a text frame with the given priority. onSent, if not nil, is called once the
+// frame has been written to the socket.
+func (c *Connection) Send(priority int, data []byte, onSent func()) error {
+	return c.queue.push(priority, &outboundFrame{data: data, queuedAt: time.Now(), onSent: onSent})
+}
+
+// SendUnique queues a text frame like Send unless a frame with the same key is still waiting to
+// be written, so a message queued both live and from the backlog is only sent once.
+func (c *Connection) SendUnique(key string, priority int, data []byte, onSent func()) error {
+	return c.queue.push(priority, &outboundFrame{data: data, queuedAt: time.Now(), onSent: onSent, key: key})
+}
+
+// Start starts writing queued frames. Until then frames are only queued, which lets the caller
+// write a replay directly ahead of live traffic.
+func (c *Connection) Start() {
+	go c.writeLoop()
+}
+
+// writeLoop writes queued frames until the queue is closed or a write fails
+func (c *Connection) writeLoop() {
+	for range c.queue.ready {
+		for frame := c.queue.pop(); frame != nil; frame = c.queue.pop() {
+			if err := c.WriteMessage(websocket.TextMessage, frame.data); err != nil {
+				log.Printf("Write error for user %s: %v\n", c.UserID, err)
+				c.queue.close()
+				c.Conn.Close()
+				return
+			}
+			if frame.onSent != nil {
+				frame.onSent()
+			}
+		}
+	}
+}
+
 // connectionMap stores user ID -> WebSocket connection
 var connectionMap = sync.Map{}
 
-// AddConnection adds a WebSocket connection for a user
-func AddConnection(userID string, token string, conn *websocket.Conn) {
-	connectionMap.Store(userID, conn)
+var (
+	// openConnections holds every open connection of each user by device, including connections
+	// a newer one replaced in connectionMap, until their handler removes them
+	openConnections   = map[string]map[*Connection]bool{}
+	openConnectionsMu sync.Mutex
+)
+
+// AddConnection adds a WebSocket connection for a user, opened from one of their devices. Frames
+// sent to it are queued until Start is called.
+func AddConnection(userID string, deviceID string, conn *websocket.Conn) *Connection {
+	connection := &Connection{UserID: userID, DeviceID: deviceID, Conn: conn, queue: newOutboundQueue()}
+	openConnectionsMu.Lock()
+	if openConnections[userID] == nil {
+		openConnections[userID] = map[*Connection]bool{}
+	}
+	openConnections[userID][connection] = true
+	openConnectionsMu.Unlock()
+	connectionMap.Store(userID, connection)
+	return connection
+}
+
+// RemoveConnection removes a WebSocket connection for a user and stops its writer. A newer
+// connection of the same user is left in place.
+func RemoveConnection(userID string, connection *Connection) {
+	connection.expiryMu.Lock()
+	connection.stopExpiryTimers()
+	connection.expiryMu.Unlock()
+
+	connection.queue.close()
+	connectionMap.CompareAndDelete(userID, connection)
+
+	openConnectionsMu.Lock()
+	delete(openConnections[userID], connection)
+	if len(openConnections[userID]) == 0 {
+		delete(openConnections, userID)
+	}
+	openConnectionsMu.Unlock()
 }
 
-// RemoveConnection removes a WebSocket connection for a user
-func RemoveConnection(userID string, token string) {
-	connectionMap.Delete(userID)
+// ForEach calls fn for every connection
+func ForEach(fn func(connection *Connection)) {
+	connectionMap.Range(func(_, value interface{}) bool {
+		fn(value.(*Connection))
+		return true
+	})
 }
 
 // GetConnection retrieves the WebSocket connection for a user
-func GetConnection(userID string, token string) (*websocket.Conn, bool) {
+func GetConnection(userID string, token string) (*Connection, bool) {
 	conn, ok := connectionMap.Load(userID)
 	if !ok {
 		return nil, false
 	}
-	return conn.(*websocket.Conn), true
+	return conn.(*Connection), true
+}
+
+// OpenConnections returns every open connection of a user, or of one of their devices unless
+// deviceID is empty. Unlike GetConnection, it includes connections replaced by a newer one, which
+// stay open until the client closes them.
+func OpenConnections(userID, deviceID string) []*Connection {
+	openConnectionsMu.Lock()
+	defer openConnectionsMu.Unlock()
+	var open []*Connection
+	for connection := range openConnections[userID] {
+		if deviceID == "" || connection.DeviceID == deviceID {
+			open = append(open, connection)
+		}
+	}
+	return open
+}
+
+// CloseConnections closes every open connection of a user, or of one of their devices unless
+// deviceID is empty, and returns how many were closed
+func CloseConnections(userID, deviceID string, code int, reason string) int {
+	open := OpenConnections(userID, deviceID)
+	for _, connection := range open {
+		connection.Close(code, reason)
+	}
+	return len(open)
 }
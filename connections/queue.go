@@ -0,0 +1,129 @@
+package connections
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"websocket-server/models"
+)
+
+const (
+	// maxQueuedFrames bounds the outbound queue of a single connection
+	maxQueuedFrames = 1024
+	// starvationAge is how long a lower priority frame may wait before it is sent ahead of higher priorities
+	starvationAge = 2 * time.Second
+
+	priorityLevels = models.PriorityUrgent - models.PriorityLow + 1
+)
+
+var (
+	ErrQueueFull        = errors.New("outbound queue full")
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// outboundFrame is a frame waiting to be written to a connection
+type outboundFrame struct {
+	data     []byte
+	queuedAt time.Time
+	onSent   func()
+	key      string // Identifies the frame while it is queued, empty if the frame may be queued twice
+}
+
+// outboundQueue orders frames by priority, FIFO within a priority. Frames that waited longer than
+// starvationAge are sent first so that bulk traffic is delayed but never starved.
+type outboundQueue struct {
+	mu      sync.Mutex
+	buckets [priorityLevels][]*outboundFrame
+	size    int
+	keys    map[string]bool
+	closed  bool
+	ready   chan struct{}
+}
+
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{keys: map[string]bool{}, ready: make(chan struct{}, 1)}
+}
+
+// bucketIndex clamps a priority to the supported range and maps it to a bucket
+func bucketIndex(priority int) int {
+	return min(max(priority, models.PriorityLow), models.PriorityUrgent) - models.PriorityLow
+}
+
+// push adds a frame to the queue and wakes up the writer. A frame whose key is already queued is
+// dropped.
+func (q *outboundQueue) push(priority int, frame *outboundFrame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrConnectionClosed
+	}
+	if frame.key != "" && q.keys[frame.key] {
+		return nil
+	}
+	if q.size >= maxQueuedFrames {
+		return ErrQueueFull
+	}
+	if frame.key != "" {
+		q.keys[frame.key] = true
+	}
+
+	index := bucketIndex(priority)
+	q.buckets[index] = append(q.buckets[index], frame)
+	q.size++
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop removes the next frame to send, or returns nil if the queue is empty
+func (q *outboundQueue) pop() *outboundFrame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	selected := -1
+	for index := priorityLevels - 1; index >= 0; index-- {
+		if len(q.buckets[index]) > 0 {
+			selected = index
+			break
+		}
+	}
+	if selected < 0 {
+		return nil
+	}
+
+	// A starving lower priority frame goes first, the longest waiting one wins
+	now := time.Now()
+	for index := selected - 1; index >= 0; index-- {
+		if len(q.buckets[index]) == 0 {
+			continue
+		}
+		head := q.buckets[index][0]
+		if now.Sub(head.queuedAt) >= starvationAge && head.queuedAt.Before(q.buckets[selected][0].queuedAt) {
+			selected = index
+		}
+	}
+
+	frame := q.buckets[selected][0]
+	q.buckets[selected][0] = nil
+	q.buckets[selected] = q.buckets[selected][1:]
+	q.size--
+	delete(q.keys, frame.key)
+	return frame
+}
+
+// close stops accepting frames and drops the queued ones
+func (q *outboundQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.buckets = [priorityLevels][]*outboundFrame{}
+	q.size = 0
+	clear(q.keys)
+	close(q.ready)
+}
@@ -0,0 +1,338 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// SaveAttachment stores the metadata of an uploaded attachment.
+func SaveAttachment(attachment *models.Attachment) error {
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`INSERT INTO data.attachments (attachment_id, owner_id, file_name, content_type, attachment_type, size, sha256,
+			storage_key, width, height, media_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING created_at`,
+		attachment.ID, attachment.OwnerID, attachment.FileName, attachment.ContentType, attachment.AttachmentType,
+		attachment.Size, attachment.SHA256, attachment.StorageKey, attachment.Width, attachment.Height, attachment.MediaStatus,
+	).Scan(&createdAt)
+	if err != nil {
+		return fmt.Errorf("could not save attachment: %v", err)
+	}
+	attachment.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// GetAttachment loads an attachment by its ID. It returns sql.ErrNoRows if the attachment does not exist.
+func GetAttachment(attachmentID string) (*models.Attachment, error) {
+	var attachment models.Attachment
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`SELECT attachment_id, owner_id, file_name, content_type, attachment_type, size, sha256, storage_key,
+			width, height, media_status, created_at
+		FROM data.attachments WHERE attachment_id=$1`, attachmentID,
+	).Scan(&attachment.ID, &attachment.OwnerID, &attachment.FileName, &attachment.ContentType,
+		&attachment.AttachmentType, &attachment.Size, &attachment.SHA256, &attachment.StorageKey,
+		&attachment.Width, &attachment.Height, &attachment.MediaStatus, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	attachment.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return &attachment, nil
+}
+
+// CreateUpload records the start of a resumable upload.
+func CreateUpload(upload *models.Upload) error {
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		"INSERT INTO data.attachment_uploads (upload_id, owner_id, file_name, size) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		upload.ID, upload.OwnerID, upload.FileName, upload.Size,
+	).Scan(&createdAt)
+	if err != nil {
+		return fmt.Errorf("could not create upload: %v", err)
+	}
+	upload.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// GetUpload loads a resumable upload owned by the given user. It returns sql.ErrNoRows if there is none.
+func GetUpload(uploadID, ownerID string) (*models.Upload, error) {
+	var upload models.Upload
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`SELECT upload_id, owner_id, file_name, size, received, created_at
+		FROM data.attachment_uploads WHERE upload_id=$1 AND owner_id=$2`, uploadID, ownerID,
+	).Scan(&upload.ID, &upload.OwnerID, &upload.FileName, &upload.Size, &upload.Received, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	upload.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return &upload, nil
+}
+
+// ClaimUploadChunk reserves an upload for writing the chunk at offset. It reports false if the
+// offset is not the number of bytes received so far or another chunk is being written, unless that
+// chunk's claim is older than staleAfter.
+func ClaimUploadChunk(uploadID string, offset int64, staleAfter time.Duration) (bool, error) {
+	result, err := PostgresDB.Exec(
+		`UPDATE data.attachment_uploads SET writing_since=now(), updated_at=now()
+		WHERE upload_id=$1 AND received=$2 AND (writing_since IS NULL OR writing_since < now() - $3 * interval '1 second')`,
+		uploadID, offset, int64(staleAfter.Seconds()),
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not claim upload: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// AdvanceUpload moves the received offset of an upload forward if it still equals from and
+// releases the chunk's claim. It reports whether the offset was updated.
+func AdvanceUpload(uploadID string, from, to int64) (bool, error) {
+	result, err := PostgresDB.Exec(
+		"UPDATE data.attachment_uploads SET received=$3, writing_since=NULL, updated_at=now() WHERE upload_id=$1 AND received=$2",
+		uploadID, from, to,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not update upload: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// ReleaseUpload drops the claim of a chunk that failed, so the chunk can be sent again
+func ReleaseUpload(uploadID string) error {
+	_, err := PostgresDB.Exec("UPDATE data.attachment_uploads SET writing_since=NULL WHERE upload_id=$1", uploadID)
+	if err != nil {
+		return fmt.Errorf("could not release upload: %v", err)
+	}
+	return nil
+}
+
+// DeleteStaleUploads removes uploads that saw no chunk since before and returns their IDs
+func DeleteStaleUploads(before time.Time) ([]string, error) {
+	rows, err := PostgresDB.Query("DELETE FROM data.attachment_uploads WHERE updated_at < $1 RETURNING upload_id", before)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete stale uploads: %v", err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("could not read stale upload: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteUpload removes a resumable upload record.
+func DeleteUpload(uploadID string) error {
+	_, err := PostgresDB.Exec("DELETE FROM data.attachment_uploads WHERE upload_id=$1", uploadID)
+	if err != nil {
+		return fmt.Errorf("could not delete upload: %v", err)
+	}
+	return nil
+}
+
+// SetAttachmentMediaStatus records the background processing state of an attachment.
+func SetAttachmentMediaStatus(attachmentID, status string) error {
+	_, err := PostgresDB.Exec("UPDATE data.attachments SET media_status=$2 WHERE attachment_id=$1", attachmentID, status)
+	if err != nil {
+		return fmt.Errorf("could not update attachment status: %v", err)
+	}
+	return nil
+}
+
+// ListPendingMediaAttachments returns the IDs of attachments still waiting for media processing.
+func ListPendingMediaAttachments() ([]string, error) {
+	rows, err := PostgresDB.Query("SELECT attachment_id FROM data.attachments WHERE media_status='pending' ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("could not list pending attachments: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("could not read pending attachment: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SaveThumbnail records a thumbnail generated for a blob.
+func SaveThumbnail(sha256 string, thumbnail *models.Thumbnail) error {
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.attachment_thumbnails (sha256, max_side, width, height, content_type, storage_key)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sha256, max_side) DO UPDATE SET width=$3, height=$4, content_type=$5, storage_key=$6`,
+		sha256, thumbnail.MaxSide, thumbnail.Width, thumbnail.Height, thumbnail.ContentType, thumbnail.StorageKey,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save thumbnail: %v", err)
+	}
+	return nil
+}
+
+// ListThumbnails returns the thumbnails of a blob, smallest first.
+func ListThumbnails(sha256 string) ([]*models.Thumbnail, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT max_side, width, height, content_type, storage_key FROM data.attachment_thumbnails
+		WHERE sha256=$1 ORDER BY max_side`, sha256,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list thumbnails: %v", err)
+	}
+	defer rows.Close()
+
+	thumbnails := []*models.Thumbnail{}
+	for rows.Next() {
+		var thumbnail models.Thumbnail
+		if err := rows.Scan(&thumbnail.MaxSide, &thumbnail.Width, &thumbnail.Height, &thumbnail.ContentType, &thumbnail.StorageKey); err != nil {
+			return nil, fmt.Errorf("could not read thumbnail: %v", err)
+		}
+		thumbnails = append(thumbnails, &thumbnail)
+	}
+	return thumbnails, rows.Err()
+}
+
+// ListMediaInfo returns the dimensions and thumbnails of the image attachments among attachmentIDs
+// whose dimensions are known, keyed by attachment ID
+func ListMediaInfo(attachmentIDs []string) (map[string]*models.MediaInfo, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT a.attachment_id, a.width, a.height, t.max_side, t.width, t.height, t.content_type, t.storage_key
+		FROM data.attachments a
+		LEFT JOIN data.attachment_thumbnails t ON t.sha256 = a.sha256
+		WHERE a.attachment_id = ANY($1) AND a.width > 0
+		ORDER BY a.attachment_id, t.max_side`, pq.Array(attachmentIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list attachment media: %v", err)
+	}
+	defer rows.Close()
+
+	media := map[string]*models.MediaInfo{}
+	for rows.Next() {
+		var attachmentID string
+		var width, height int
+		var maxSide, thumbnailWidth, thumbnailHeight sql.NullInt64
+		var contentType, storageKey sql.NullString
+		if err := rows.Scan(&attachmentID, &width, &height, &maxSide, &thumbnailWidth, &thumbnailHeight, &contentType, &storageKey); err != nil {
+			return nil, fmt.Errorf("could not read attachment media: %v", err)
+		}
+		info, ok := media[attachmentID]
+		if !ok {
+			info = &models.MediaInfo{Width: width, Height: height, Thumbnails: []*models.Thumbnail{}}
+			media[attachmentID] = info
+		}
+		if maxSide.Valid {
+			info.Thumbnails = append(info.Thumbnails, &models.Thumbnail{
+				MaxSide:     int(maxSide.Int64),
+				Width:       int(thumbnailWidth.Int64),
+				Height:      int(thumbnailHeight.Int64),
+				ContentType: contentType.String,
+				StorageKey:  storageKey.String,
+			})
+		}
+	}
+	return media, rows.Err()
+}
+
+// ListMessagesWithAttachment returns the messages referencing an attachment.
+func ListMessagesWithAttachment(attachmentID string) ([]*models.Message, error) {
+	rows, err := PostgresDB.Query("SELECT "+messageColumns+" FROM data.messages WHERE attachment_id=$1", attachmentID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list messages for attachment: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read message: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// lockBlob takes a lock on a blob digest that is held until tx ends
+func lockBlob(tx *sql.Tx, digest string) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('blob:' || $1))", digest); err != nil {
+		return fmt.Errorf("could not lock blob: %v", err)
+	}
+	return nil
+}
+
+// WithBlobLock runs fn while holding the lock ReleaseBlob takes on a blob digest. An upload that
+// reuses a stored blob saves its attachment within fn, so that the blob is not released between
+// finding it and referencing it.
+func WithBlobLock(digest string, fn func() error) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, digest); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReleaseBlob deletes the thumbnails of a blob no attachment references and calls remove with the
+// storage keys of the blob and its thumbnails, all under the blob's lock. A blob an upload
+// referenced again in the meantime is kept.
+func ReleaseBlob(digest, storageKey string, remove func(keys []string) error) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, digest); err != nil {
+		return err
+	}
+	var referenced bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM data.attachments WHERE sha256=$1)", digest).Scan(&referenced); err != nil {
+		return fmt.Errorf("could not check blob references: %v", err)
+	}
+	if referenced {
+		return tx.Commit()
+	}
+
+	rows, err := tx.Query("DELETE FROM data.attachment_thumbnails WHERE sha256=$1 RETURNING storage_key", digest)
+	if err != nil {
+		return fmt.Errorf("could not delete thumbnails: %v", err)
+	}
+	keys := []string{storageKey}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not read thumbnail: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := remove(keys); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// apiKeyColumns is the column list understood by scanAPIKey, selected from apiKeyTables
+	apiKeyColumns = "k.key_id, k.bot_id, b.uid, k.name, k.scopes, k.created_at, k.last_used_at, k.expires_at, k.revoked_at"
+	apiKeyTables  = "data.api_keys k JOIN data.bots b ON b.bot_id = k.bot_id"
+)
+
+// CreateBot stores a bot account. It returns false if the name is taken by a user or another bot.
+func CreateBot(bot *models.Bot) (bool, error) {
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`INSERT INTO data.bots (bot_id, display_name, created_by)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM data.users WHERE username=$1)
+		ON CONFLICT (bot_id) DO NOTHING RETURNING uid, created_at`,
+		bot.ID, bot.DisplayName, bot.CreatedBy,
+	).Scan(&bot.UserID, &createdAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not create bot: %v", err)
+	}
+	bot.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return true, nil
+}
+
+// ListBots returns every bot account
+func ListBots() ([]*models.Bot, error) {
+	rows, err := PostgresDB.Query("SELECT bot_id, uid, display_name, created_by, created_at FROM data.bots ORDER BY bot_id")
+	if err != nil {
+		return nil, fmt.Errorf("could not list bots: %v", err)
+	}
+	defer rows.Close()
+
+	bots := []*models.Bot{}
+	for rows.Next() {
+		var bot models.Bot
+		var createdAt time.Time
+		if err := rows.Scan(&bot.ID, &bot.UserID, &bot.DisplayName, &bot.CreatedBy, &createdAt); err != nil {
+			return nil, fmt.Errorf("could not read bot: %v", err)
+		}
+		bot.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		bots = append(bots, &bot)
+	}
+	return bots, rows.Err()
+}
+
+// BotExists reports whether a bot account exists
+func BotExists(botID string) (bool, error) {
+	var exists bool
+	err := PostgresDB.QueryRow("SELECT EXISTS (SELECT 1 FROM data.bots WHERE bot_id=$1)", botID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check bot: %v", err)
+	}
+	return exists, nil
+}
+
+// scanAPIKey reads a row selected with apiKeyColumns into an APIKey. Columns selected after
+// those are scanned into extra.
+func scanAPIKey(row rowScanner, extra ...interface{}) (*models.APIKey, error) {
+	var key models.APIKey
+	var createdAt time.Time
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	dest := []interface{}{&key.ID, &key.BotID, &key.BotUserID, &key.Name, pq.Array(&key.Scopes), &createdAt, &lastUsedAt, &expiresAt, &revokedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	key.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if lastUsedAt.Valid {
+		key.LastUsedAt = lastUsedAt.Time.UTC().Format(time.RFC3339)
+	}
+	if expiresAt.Valid {
+		key.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = revokedAt.Time.UTC().Format(time.RFC3339)
+	}
+	return &key, nil
+}
+
+// CreateAPIKey stores an API key with the hash of its secret
+func CreateAPIKey(key *models.APIKey, secretHash string, expiresAt sql.NullTime) error {
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`INSERT INTO data.api_keys (key_id, bot_id, name, secret_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, (SELECT uid FROM data.bots WHERE bot_id=$2)`,
+		key.ID, key.BotID, key.Name, secretHash, pq.Array(key.Scopes), expiresAt,
+	).Scan(&createdAt, &key.BotUserID)
+	if err != nil {
+		return fmt.Errorf("could not save API key: %v", err)
+	}
+	key.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if expiresAt.Valid {
+		key.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// GetAPIKey returns an API key and the hash of its secret. It returns sql.ErrNoRows if there is none.
+func GetAPIKey(keyID string) (*models.APIKey, string, error) {
+	var secretHash string
+	row := PostgresDB.QueryRow("SELECT "+apiKeyColumns+", k.secret_hash FROM "+apiKeyTables+" WHERE k.key_id=$1", keyID)
+	key, err := scanAPIKey(row, &secretHash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", fmt.Errorf("could not load API key: %v", err)
+	}
+	return key, secretHash, err
+}
+
+// ListAPIKeys returns the API keys of a bot, newest first
+func ListAPIKeys(botID string) ([]*models.APIKey, error) {
+	rows, err := PostgresDB.Query("SELECT "+apiKeyColumns+" FROM "+apiKeyTables+" WHERE k.bot_id=$1 ORDER BY k.created_at DESC", botID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list API keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []*models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read API key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records that an API key was used, at most once a minute
+func TouchAPIKey(keyID string) error {
+	_, err := PostgresDB.Exec(
+		`UPDATE data.api_keys SET last_used_at=now()
+		WHERE key_id=$1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')`,
+		keyID,
+	)
+	if err != nil {
+		return fmt.Errorf("could not record API key use: %v", err)
+	}
+	return nil
+}
+
+// ExpireAPIKey shortens the validity of an unrevoked API key to expiresAt unless it expires
+// earlier already. It returns false if the key is unknown or revoked.
+func ExpireAPIKey(keyID string, expiresAt time.Time) (bool, error) {
+	result, err := PostgresDB.Exec(
+		`UPDATE data.api_keys SET expires_at=least(coalesce(expires_at, $2), $2)
+		WHERE key_id=$1 AND revoked_at IS NULL`,
+		keyID, expiresAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not expire API key: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// RevokeAPIKey revokes an API key immediately and returns the user ID of its bot. It returns
+// sql.ErrNoRows if the key is unknown or already revoked.
+func RevokeAPIKey(keyID string) (string, error) {
+	var botUserID string
+	err := PostgresDB.QueryRow(
+		`UPDATE data.api_keys k SET revoked_at=now() FROM data.bots b
+		WHERE b.bot_id = k.bot_id AND k.key_id=$1 AND k.revoked_at IS NULL RETURNING b.uid`, keyID,
+	).Scan(&botUserID)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("could not revoke API key: %v", err)
+	}
+	return botUserID, err
+}
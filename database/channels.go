@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Defaults for channels without a data.channels row
+const (
+	DefaultPinRole  = "member"
+	DefaultPinLimit = 50
+)
+
+// IsChannelMember reports whether a user belongs to a channel.
+func IsChannelMember(channelID, userID string) (bool, error) {
+	var exists bool
+	err := PostgresDB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM data.channel_members WHERE channel_id=$1 AND user_id=$2)",
+		channelID, userID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check channel membership: %v", err)
+	}
+	return exists, nil
+}
+
+// GetChannelRole returns a user's role in a channel, or an empty string if they are not a member.
+func GetChannelRole(channelID, userID string) (string, error) {
+	var role string
+	err := PostgresDB.QueryRow(
+		"SELECT role FROM data.channel_members WHERE channel_id=$1 AND user_id=$2",
+		channelID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not load channel role: %v", err)
+	}
+	return role, nil
+}
+
+// ListChannelMembers returns the user IDs of every member of a channel.
+func ListChannelMembers(channelID string) ([]string, error) {
+	rows, err := PostgresDB.Query("SELECT user_id FROM data.channel_members WHERE channel_id=$1", channelID)
+	if err != nil {
+		return nil, fmt.Errorf("could not list channel members: %v", err)
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("could not read channel member: %v", err)
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+// GetChannelPinPolicy returns the minimum role allowed to pin and the pin limit of a channel.
+func GetChannelPinPolicy(channelID string) (string, int, error) {
+	role, limit := DefaultPinRole, DefaultPinLimit
+	err := PostgresDB.QueryRow(
+		"SELECT pin_role, pin_limit FROM data.channels WHERE channel_id=$1", channelID,
+	).Scan(&role, &limit)
+	if err != nil && err != sql.ErrNoRows {
+		return "", 0, fmt.Errorf("could not load channel settings: %v", err)
+	}
+	return role, limit, nil
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	"websocket-server/models"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects PostgresDB to the database in TEST_DATABASE_URL, which must hold the base
+// schema of the app, and brings it up to date. Tests that need it are skipped without one.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("could not open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	PostgresDB = db
+	if err := MigrateSchema(); err != nil {
+		t.Fatalf("could not migrate test database: %v", err)
+	}
+}
+
+func TestChannelDeliveryOutOfOrder(t *testing.T) {
+	openTestDB(t)
+
+	channelID := fmt.Sprintf("delivery-test-%d", time.Now().UnixNano())
+	member, sender := channelID+"-member", channelID+"-sender"
+	if _, err := PostgresDB.Exec(
+		"INSERT INTO data.channel_members (channel_id, user_id, delivered_seq) VALUES ($1, $2, 0)", channelID, member,
+	); err != nil {
+		t.Fatalf("could not add channel member: %v", err)
+	}
+	t.Cleanup(func() {
+		PostgresDB.Exec("DELETE FROM data.messages WHERE conversation_id=$1", "channel:"+channelID)
+		PostgresDB.Exec("DELETE FROM data.channel_members WHERE channel_id=$1", channelID)
+		PostgresDB.Exec("DELETE FROM data.channel_deliveries WHERE channel_id=$1", channelID)
+		PostgresDB.Exec("DELETE FROM data.conversation_sequences WHERE conversation_id=$1", "channel:"+channelID)
+	})
+
+	send := func(content string, priority int) *models.Message {
+		msg := &models.Message{
+			ConversationID: "channel:" + channelID,
+			ChannelID:      channelID,
+			SenderID:       sender,
+			Content:        content,
+			MessageType:    "text",
+			Priority:       priority,
+		}
+		if _, err := SaveMessage(msg); err != nil {
+			t.Fatalf("could not save message: %v", err)
+		}
+		return msg
+	}
+	backlog := func() []string {
+		messages, err := ListUndeliveredMessages(member, 10)
+		if err != nil {
+			t.Fatalf("could not list undelivered messages: %v", err)
+		}
+		var contents []string
+		for _, msg := range messages {
+			if msg.ConversationID == "channel:"+channelID {
+				contents = append(contents, msg.Content)
+			}
+		}
+		return contents
+	}
+	deliver := func(msg *models.Message) {
+		if err := MarkMessageDelivered(msg.ID, member); err != nil {
+			t.Fatalf("could not mark message delivered: %v", err)
+		}
+	}
+	expect := func(step string, got []string, want ...string) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: backlog is %v, want %v", step, got, want)
+		}
+	}
+
+	first := send("first", models.PriorityNormal)
+	second := send("second", models.PriorityNormal)
+	urgent := send("urgent", models.PriorityUrgent)
+	expect("before delivery", backlog(), "urgent", "first", "second")
+
+	// The connection drops after the urgent message overtook the older ones
+	deliver(urgent)
+	expect("after reconnecting", backlog(), "first", "second")
+
+	deliver(second)
+	expect("after a gap", backlog(), "first")
+
+	deliver(first)
+	expect("after delivering everything", backlog())
+
+	var deliveredSeq int64
+	var pending int
+	if err := PostgresDB.QueryRow(
+		`SELECT delivered_seq, (SELECT count(*) FROM data.channel_deliveries WHERE channel_id=$1)
+		FROM data.channel_members WHERE channel_id=$1 AND user_id=$2`,
+		channelID, member,
+	).Scan(&deliveredSeq, &pending); err != nil {
+		t.Fatalf("could not load delivery state: %v", err)
+	}
+	if deliveredSeq != urgent.Seq || pending != 0 {
+		t.Fatalf("delivered_seq is %d with %d pending deliveries, want %d with none", deliveredSeq, pending, urgent.Seq)
+	}
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"websocket-server/models"
+)
+
+// deviceDetailColumns are the columns of data.devices with the details a client reports at login,
+// in the order of deviceDetails
+var deviceDetailColumns = []string{
+	"name", "type", "manufacturer", "model", "serial_number", "firmware", "hardware_version",
+	"software_version", "operating_system", "processor", "memory", "storage_capacity", "screen_size",
+	"resolution", "camera", "sensors", "ports", "dimensions", "weight", "color", "material", "power_source",
+	"battery_level", "signal_strength", "connectivity_type", "ip_address", "mac_address", "network_provider",
+	"plan_type", "subscription_end", "status", "last_seen", "location", "owner", "created_at", "updated_at",
+	"usage_time", "notes",
+}
+
+// deviceDetails returns the values of deviceDetailColumns
+func deviceDetails(device *models.Device) []interface{} {
+	return []interface{}{
+		device.Name, device.Type, device.Manufacturer, device.Model, device.SerialNumber,
+		device.Firmware, device.HardwareVersion, device.SoftwareVersion, device.OperatingSystem,
+		device.Processor, device.Memory, device.StorageCapacity, device.ScreenSize, device.Resolution,
+		device.Camera, device.Sensors, device.Ports, device.Dimensions, device.Weight, device.Color,
+		device.Material, device.PowerSource, device.BatteryLevel, device.SignalStrength,
+		device.ConnectivityType, device.IPAddress, device.MACAddress, device.NetworkProvider,
+		device.PlanType, device.SubscriptionEnd, device.Status, device.LastSeen, device.Location,
+		device.Owner, device.CreatedAt, device.UpdatedAt, device.UsageTime, device.Notes,
+	}
+}
+
+// UpsertDevice records a login of a user from a device and the address it came from. A device the
+// user signed in from before keeps its row, whose details are replaced unless the login reported
+// none besides the device ID, as sign-ins through an identity provider do.
+func UpsertDevice(userID int, device *models.Device, ipAddress string) error {
+	reported := *device != models.Device{DeviceID: device.DeviceID}
+	placeholders := make([]string, len(deviceDetailColumns))
+	updates := []string{"last_ip=EXCLUDED.last_ip", "last_login_at=now()", "last_seen_at=now()"}
+	for i, column := range deviceDetailColumns {
+		placeholders[i] = fmt.Sprintf("$%d", i+4)
+		if reported && column != "created_at" {
+			updates = append(updates, column+"=EXCLUDED."+column)
+		}
+	}
+
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.devices (user_id, device_id, last_ip, last_login_at, last_seen_at, `+strings.Join(deviceDetailColumns, ", ")+`)
+		VALUES ($1, $2, $3, now(), now(), `+strings.Join(placeholders, ", ")+`)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET `+strings.Join(updates, ", "),
+		append([]interface{}{userID, device.DeviceID, ipAddress}, deviceDetails(device)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save device: %v", err)
+	}
+	return nil
+}
+
+// TouchDevice records that a user's device was seen, and from which address unless ipAddress is empty
+func TouchDevice(userID, deviceID, ipAddress string) error {
+	_, err := PostgresDB.Exec(
+		`UPDATE data.devices d SET last_seen_at=now(), last_ip=coalesce(nullif($3, ''), d.last_ip)
+		FROM data.users u WHERE u.user_id = d.user_id AND u.uid=$1 AND d.device_id=$2`,
+		userID, deviceID, ipAddress,
+	)
+	if err != nil {
+		return fmt.Errorf("could not record device activity: %v", err)
+	}
+	return nil
+}
+
+// ListDevices returns the devices a user signed in from, most recently seen first
+func ListDevices(userID string) ([]*models.DeviceSession, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT d.device_id, coalesce(d.display_name, d.name, ''), coalesce(d.type, ''), coalesce(d.model, ''),
+			coalesce(d.operating_system, ''), coalesce(d.last_ip, ''), d.last_login_at, d.last_seen_at,
+			d.revoked_before IS NULL OR d.last_login_at > d.revoked_before
+		FROM data.devices d JOIN data.users u ON u.user_id = d.user_id
+		WHERE u.uid=$1 AND d.device_id IS NOT NULL
+		ORDER BY d.last_seen_at DESC NULLS LAST, d.device_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list devices: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []*models.DeviceSession{}
+	for rows.Next() {
+		var device models.DeviceSession
+		var lastLoginAt, lastSeenAt sql.NullTime
+		err := rows.Scan(&device.DeviceID, &device.Name, &device.Type, &device.Model, &device.OperatingSystem,
+			&device.LastIP, &lastLoginAt, &lastSeenAt, &device.SignedIn)
+		if err != nil {
+			return nil, fmt.Errorf("could not read device: %v", err)
+		}
+		if lastLoginAt.Valid {
+			device.LastLoginAt = lastLoginAt.Time.UTC().Format(time.RFC3339)
+		}
+		if lastSeenAt.Valid {
+			device.LastSeenAt = lastSeenAt.Time.UTC().Format(time.RFC3339)
+		}
+		devices = append(devices, &device)
+	}
+	return devices, rows.Err()
+}
+
+// RenameDevice sets the name a user's device is shown with. It returns false if the user has no
+// such device.
+func RenameDevice(userID, deviceID, name string) (bool, error) {
+	result, err := PostgresDB.Exec(
+		`UPDATE data.devices d SET display_name=$3
+		FROM data.users u WHERE u.user_id = d.user_id AND u.uid=$1 AND d.device_id=$2`,
+		userID, deviceID, name,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not rename device: %v", err)
+	}
+	renamed, _ := result.RowsAffected()
+	return renamed > 0, nil
+}
+
+// SignOutDevice revokes the access tokens a user was issued on a device up to now and deletes its
+// refresh tokens, connection tickets and telemetry. It returns false if the user has no such device.
+func SignOutDevice(userID, deviceID string) (bool, error) {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(
+		`UPDATE data.devices d SET revoked_before=date_trunc('second', now())
+		FROM data.users u WHERE u.user_id = d.user_id AND u.uid=$1 AND d.device_id=$2
+		RETURNING d.user_id`,
+		userID, deviceID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not sign out device: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.refresh_tokens WHERE user_id=$1 AND device_id=$2", id, deviceID); err != nil {
+		return false, fmt.Errorf("could not revoke refresh tokens: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.connection_tickets WHERE user_id=$1 AND device_id=$2", userID, deviceID); err != nil {
+		return false, fmt.Errorf("could not delete connection tickets: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.device_state WHERE user_id=$1 AND device_id=$2", userID, deviceID); err != nil {
+		return false, fmt.Errorf("could not delete device state: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.device_telemetry WHERE user_id=$1 AND device_id=$2", userID, deviceID); err != nil {
+		return false, fmt.Errorf("could not delete device telemetry: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("could not sign out device: %v", err)
+	}
+	return true, nil
+}
+
+// StoreRefreshToken saves a refresh token issued on a device, replacing those the device held before
+func StoreRefreshToken(userID int, deviceID, refreshToken string, expiresAt time.Time) error {
+	_, err := PostgresDB.Exec(
+		`WITH replaced AS (DELETE FROM data.refresh_tokens WHERE user_id=$1 AND device_id=$2)
+		INSERT INTO data.refresh_tokens (user_id, device_id, token, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, deviceID, refreshToken, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save refresh token: %v", err)
+	}
+	return nil
+}
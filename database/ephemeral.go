@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// GetConversationTTL returns the default lifetime of new messages in a conversation.
+// Conversations without settings keep their messages forever.
+func GetConversationTTL(conversationID string) (int, bool, error) {
+	var ttlSeconds int
+	var expireAfterRead bool
+	err := PostgresDB.QueryRow(
+		"SELECT message_ttl_seconds, expire_after_read FROM data.conversation_settings WHERE conversation_id=$1",
+		conversationID,
+	).Scan(&ttlSeconds, &expireAfterRead)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, fmt.Errorf("could not load conversation settings: %v", err)
+	}
+	return ttlSeconds, expireAfterRead, nil
+}
+
+// SetConversationTTL stores the default lifetime of new messages in a conversation.
+func SetConversationTTL(conversationID string, ttlSeconds int, expireAfterRead bool, userID string) error {
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.conversation_settings (conversation_id, message_ttl_seconds, expire_after_read, updated_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (conversation_id) DO UPDATE
+		SET message_ttl_seconds=$2, expire_after_read=$3, updated_by=$4, updated_at=now()`,
+		conversationID, ttlSeconds, expireAfterRead, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save conversation settings: %v", err)
+	}
+	return nil
+}
+
+// MarkMessageRead records that the recipient read a message and starts the lifetime of messages
+// that expire after being read. It returns sql.ErrNoRows if the user is not the recipient.
+func MarkMessageRead(messageID, userID string) (*models.Message, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	row := PostgresDB.QueryRow(
+		`UPDATE data.messages SET read_at = coalesce(read_at, now()),
+			expires_at = CASE WHEN expire_after_read AND expires_at IS NULL
+				THEN now() + ttl_seconds * interval '1 second' ELSE expires_at END
+		WHERE message_id=$1 AND receiver_id=$2
+		RETURNING `+messageColumns,
+		id, userID,
+	)
+	return scanMessage(row)
+}
+
+// DeleteExpiredMessages hard-deletes up to limit expired messages like DeleteMessage does. It
+// returns what was deleted and the storage keys by digest of the blobs no attachment references
+// anymore, to be released with ReleaseBlob. Concurrent callers never receive the same message twice.
+func DeleteExpiredMessages(limit int) ([]*models.Message, map[string]string, error) {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	deleted, blobs, err := purgeMessages(tx,
+		`SELECT message_id FROM data.messages WHERE expires_at <= now()
+		ORDER BY expires_at LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		limit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("could not commit expired message deletion: %v", err)
+	}
+	return deleted, blobs, nil
+}
+
+// purgeMessages hard-deletes the messages whose IDs the selection query returns together with their
+// pins, stars and the attachments no other message references, redacts them in the update log, and
+// takes the replies out of the reply counts of their threads. It returns what was deleted, stamped
+// with their expiry or else the current time, and the storage keys by digest of the blobs no
+// attachment references anymore.
+func purgeMessages(tx *sql.Tx, selection string, args ...interface{}) ([]*models.Message, map[string]string, error) {
+	rows, err := tx.Query(
+		`WITH deleted AS (
+			DELETE FROM data.messages WHERE message_id IN (`+selection+`)
+			RETURNING message_id, conversation_id, sender_id, receiver_id, expires_at, thread_id, attachment_id
+		), threads AS (
+			UPDATE data.messages m SET reply_count = greatest(m.reply_count - t.replies, 0)
+			FROM (SELECT thread_id, count(*) AS replies FROM deleted WHERE thread_id IS NOT NULL GROUP BY thread_id) t
+			WHERE m.message_id = t.thread_id AND m.message_id NOT IN (SELECT message_id FROM deleted)
+		)
+		SELECT message_id, conversation_id, sender_id, receiver_id, coalesce(expires_at, now()), attachment_id
+		FROM deleted`,
+		args...,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not delete messages: %v", err)
+	}
+
+	var deleted []*models.Message
+	var ids []int64
+	var messageIDs, conversationIDs []string
+	var attachmentIDs []string
+	for rows.Next() {
+		var msg models.Message
+		var id int64
+		var conversationID, receiverID, attachmentID sql.NullString
+		var deletedAt time.Time
+		if err := rows.Scan(&id, &conversationID, &msg.SenderID, &receiverID, &deletedAt, &attachmentID); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("could not read deleted message: %v", err)
+		}
+		msg.ID = strconv.FormatInt(id, 10)
+		msg.ConversationID = conversationID.String
+		msg.RecipientID = receiverID.String
+		msg.Deleted = true
+		msg.DeleteTimestamp = deletedAt.UTC().Format(time.RFC3339)
+		deleted = append(deleted, &msg)
+		ids = append(ids, id)
+		messageIDs = append(messageIDs, msg.ID)
+		conversationIDs = append(conversationIDs, msg.ConversationID)
+		if attachmentID.Valid {
+			attachmentIDs = append(attachmentIDs, attachmentID.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(ids) > 0 {
+		for _, table := range []string{"data.message_pins", "data.message_stars"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE message_id = ANY($1)", pq.Array(ids)); err != nil {
+				return nil, nil, fmt.Errorf("could not delete references to deleted messages: %v", err)
+			}
+		}
+		if err := redactMessageUpdates(tx, conversationIDs, messageIDs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var blobs map[string]string
+	if len(attachmentIDs) > 0 {
+		blobs, err = deleteUnreferencedAttachments(tx, attachmentIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return deleted, blobs, nil
+}
+
+// deleteUnreferencedAttachments deletes the attachments among attachmentIDs that no message
+// references anymore. It returns the storage keys by digest of the blobs no other attachment
+// references.
+func deleteUnreferencedAttachments(tx *sql.Tx, attachmentIDs []string) (map[string]string, error) {
+	rows, err := tx.Query(
+		`WITH attachments AS (
+			DELETE FROM data.attachments a WHERE a.attachment_id = ANY($1)
+				AND NOT EXISTS (SELECT 1 FROM data.messages m WHERE m.attachment_id = a.attachment_id)
+			RETURNING a.attachment_id, a.sha256, a.storage_key
+		)
+		SELECT DISTINCT d.sha256, d.storage_key FROM attachments d
+		WHERE NOT EXISTS (
+			SELECT 1 FROM data.attachments a
+			WHERE a.sha256 = d.sha256 AND a.attachment_id NOT IN (SELECT attachment_id FROM attachments)
+		)`,
+		pq.Array(attachmentIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete attachments of deleted messages: %v", err)
+	}
+	defer rows.Close()
+
+	blobs := map[string]string{}
+	for rows.Next() {
+		var digest, key string
+		if err := rows.Scan(&digest, &key); err != nil {
+			return nil, fmt.Errorf("could not read attachment of deleted message: %v", err)
+		}
+		blobs[digest] = key
+	}
+	return blobs, rows.Err()
+}
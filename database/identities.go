@@ -0,0 +1,104 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+)
+
+// CreateOIDCState stores an OpenID Connect login in progress under the hash of its state
+// parameter, and drops expired ones.
+func CreateOIDCState(stateHash string, state *models.OIDCLoginState, expiresAt time.Time) error {
+	if _, err := PostgresDB.Exec("DELETE FROM data.oidc_login_states WHERE expires_at <= now()"); err != nil {
+		return fmt.Errorf("could not delete expired login states: %v", err)
+	}
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.oidc_login_states (state_hash, provider, code_verifier, nonce, device_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		stateHash, state.Provider, state.CodeVerifier, state.Nonce, state.DeviceID, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save login state: %v", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCState deletes an unexpired login state and returns it. It returns sql.ErrNoRows if
+// the state is unknown, expired or already used.
+func ConsumeOIDCState(stateHash string) (*models.OIDCLoginState, error) {
+	var state models.OIDCLoginState
+	err := PostgresDB.QueryRow(
+		`DELETE FROM data.oidc_login_states WHERE state_hash=$1 AND expires_at > now()
+		RETURNING provider, code_verifier, nonce, device_id`,
+		stateHash,
+	).Scan(&state.Provider, &state.CodeVerifier, &state.Nonce, &state.DeviceID)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load login state: %v", err)
+	}
+	return &state, nil
+}
+
+// GetIdentityUser returns the user linked to a provider account and records the login. It
+// returns sql.ErrNoRows if the account is not linked.
+func GetIdentityUser(provider, subject string) (int, error) {
+	var userID int
+	err := PostgresDB.QueryRow(
+		`UPDATE data.user_identities SET last_login_at=now() WHERE provider=$1 AND subject=$2
+		RETURNING user_id`,
+		provider, subject,
+	).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("could not load linked identity: %v", err)
+	}
+	return userID, err
+}
+
+// LinkIdentity links a provider account to a user
+func LinkIdentity(provider, subject string, userID int, email string) error {
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.user_identities (provider, subject, user_id, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now()) ON CONFLICT (provider, subject) DO NOTHING`,
+		provider, subject, userID, email,
+	)
+	if err != nil {
+		return fmt.Errorf("could not link identity: %v", err)
+	}
+	return nil
+}
+
+// CreateOIDCPendingLink stores a provider account waiting for the password of the user it would
+// be linked to under the hash of its link token, and drops expired ones.
+func CreateOIDCPendingLink(linkHash string, link *models.OIDCPendingLink, expiresAt time.Time) error {
+	if _, err := PostgresDB.Exec("DELETE FROM data.oidc_pending_links WHERE expires_at <= now()"); err != nil {
+		return fmt.Errorf("could not delete expired pending links: %v", err)
+	}
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.oidc_pending_links (link_hash, provider, subject, user_id, email, device_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		linkHash, link.Provider, link.Subject, link.UserID, link.Email, link.DeviceID, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save pending link: %v", err)
+	}
+	return nil
+}
+
+// ConsumeOIDCPendingLink deletes an unexpired pending link and returns it. It returns
+// sql.ErrNoRows if the link token is unknown, expired or already used.
+func ConsumeOIDCPendingLink(linkHash string) (*models.OIDCPendingLink, error) {
+	var link models.OIDCPendingLink
+	err := PostgresDB.QueryRow(
+		`DELETE FROM data.oidc_pending_links WHERE link_hash=$1 AND expires_at > now()
+		RETURNING provider, subject, user_id, email, device_id`,
+		linkHash,
+	).Scan(&link.Provider, &link.Subject, &link.UserID, &link.Email, &link.DeviceID)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load pending link: %v", err)
+	}
+	return &link, nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+)
+
+// RecordLoginAttempt stores the outcome of a login attempt.
+func RecordLoginAttempt(attempt *models.LoginAttempt) error {
+	var createdAt time.Time
+	err := PostgresDB.QueryRow(
+		`INSERT INTO data.login_attempts (username, user_id, ip_address, device_id, succeeded, new_device, new_ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`,
+		attempt.Username, sql.NullInt64{Int64: int64(attempt.UserID), Valid: attempt.UserID != 0},
+		attempt.IPAddress, attempt.DeviceID, attempt.Succeeded, attempt.NewDevice, attempt.NewIP,
+	).Scan(&createdAt)
+	if err != nil {
+		return fmt.Errorf("could not record login attempt: %v", err)
+	}
+	attempt.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// GetLoginHistory reports whether a user has logged in successfully before at all, from a device
+// and from an IP address.
+func GetLoginHistory(userID int, deviceID, ipAddress string) (bool, bool, bool, error) {
+	var hasHistory, knownDevice, knownIP bool
+	err := PostgresDB.QueryRow(
+		`SELECT count(*) > 0, coalesce(bool_or(device_id=$2), false), coalesce(bool_or(ip_address=$3), false)
+		FROM data.login_attempts WHERE user_id=$1 AND succeeded`,
+		userID, deviceID, ipAddress,
+	).Scan(&hasHistory, &knownDevice, &knownIP)
+	if err != nil {
+		return false, false, false, fmt.Errorf("could not check login history: %v", err)
+	}
+	return hasHistory, knownDevice, knownIP, nil
+}
+
+// ListLoginAttempts returns the latest login attempts on a user's account, newest first. Attempts
+// are listed under the username they were made with, which may have changed since.
+func ListLoginAttempts(userID int, limit int) ([]*models.LoginAttempt, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT username, ip_address, device_id, succeeded, new_device, new_ip, created_at
+		FROM data.login_attempts WHERE user_id=$1 ORDER BY attempt_id DESC LIMIT $2`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list login attempts: %v", err)
+	}
+	defer rows.Close()
+
+	attempts := []*models.LoginAttempt{}
+	for rows.Next() {
+		var attempt models.LoginAttempt
+		var createdAt time.Time
+		err := rows.Scan(&attempt.Username, &attempt.IPAddress, &attempt.DeviceID, &attempt.Succeeded,
+			&attempt.NewDevice, &attempt.NewIP, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not read login attempt: %v", err)
+		}
+		attempt.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		attempts = append(attempts, &attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// ClaimLoginAttempt counts a login attempt on a username, unless logins for it are refused. The
+// attempt counts as a failure until ResetLoginFailures clears them, which makes checking the block
+// and counting one step that concurrent attempts cannot slip between. Failures are forgotten once
+// none was counted for window. It returns the failures including this attempt, or zero and until
+// when logins are refused.
+func ClaimLoginAttempt(username string, window time.Duration) (int, time.Time, error) {
+	var failures sql.NullInt64
+	var blockedUntil sql.NullTime
+	err := PostgresDB.QueryRow(
+		`WITH claimed AS (
+			INSERT INTO data.login_failures AS f (username, failed_count) VALUES ($1, 1)
+			ON CONFLICT (username) DO UPDATE SET
+				failed_count = CASE WHEN f.updated_at < now() - $2 * interval '1 second' THEN 1 ELSE f.failed_count + 1 END,
+				updated_at = now()
+			WHERE f.blocked_until IS NULL OR f.blocked_until <= now()
+			RETURNING failed_count
+		)
+		SELECT (SELECT failed_count FROM claimed), (SELECT blocked_until FROM data.login_failures WHERE username=$1)`,
+		username, int64(window.Seconds()),
+	).Scan(&failures, &blockedUntil)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("could not count login attempt: %v", err)
+	}
+	if failures.Valid {
+		return int(failures.Int64), time.Time{}, nil
+	}
+	return 0, blockedUntil.Time, nil
+}
+
+// BlockLogin refuses logins for a username until the given time.
+func BlockLogin(username string, until time.Time) error {
+	_, err := PostgresDB.Exec(
+		"UPDATE data.login_failures SET blocked_until=$2, updated_at=now() WHERE username=$1", username, until,
+	)
+	if err != nil {
+		return fmt.Errorf("could not block login: %v", err)
+	}
+	return nil
+}
+
+// ResetLoginFailures clears the failed logins of a username after a successful login.
+func ResetLoginFailures(username string) error {
+	if _, err := PostgresDB.Exec("DELETE FROM data.login_failures WHERE username=$1", username); err != nil {
+		return fmt.Errorf("could not reset login failures: %v", err)
+	}
+	return nil
+}
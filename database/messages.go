@@ -0,0 +1,474 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// messageColumnNames are the columns understood by scanMessage, in scan order
+var messageColumnNames = []string{
+	"message_id", "conversation_id", "sender_id", "receiver_id", "content", "created_at",
+	"message_type", "channel_id", "reply_to_id", "thread_id", "reply_count", "last_reply_at",
+	"attachment_url", "attachment_type", "forwarded", "forwarded_from", "attachment_id", "language", "tags",
+	"ttl_seconds", "expire_after_read", "expires_at", "priority", "seq", "from_bot",
+}
+
+// messageColumns is the column list understood by scanMessage
+var messageColumns = strings.Join(messageColumnNames, ", ")
+
+// prefixedMessageColumns qualifies messageColumns with a table alias for use in joins
+func prefixedMessageColumns(alias string) string {
+	columns := make([]string, len(messageColumnNames))
+	for i, name := range messageColumnNames {
+		columns[i] = alias + "." + name
+	}
+	return strings.Join(columns, ", ")
+}
+
+// liveMessageCondition excludes the messages of a table alias whose lifetime ended but that the
+// reaper has not deleted yet
+func liveMessageCondition(alias string) string {
+	return "(" + alias + ".expires_at IS NULL OR " + alias + ".expires_at > now())"
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a row selected with messageColumns into a Message. Any extra
+// destinations are scanned from the columns following the message columns.
+func scanMessage(row rowScanner, extra ...interface{}) (*models.Message, error) {
+	var (
+		msg                                 models.Message
+		id                                  int64
+		conversationID, receiverID, content sql.NullString
+		messageType, channelID              sql.NullString
+		createdAt                           time.Time
+		seq                                 sql.NullInt64
+		replyToID, threadID                 sql.NullInt64
+		lastReplyAt                         sql.NullTime
+		attachmentURL, attachmentType       sql.NullString
+		forwardedFrom, attachmentID         sql.NullString
+		language                            sql.NullString
+		ttlSeconds                          sql.NullInt64
+		expiresAt                           sql.NullTime
+	)
+	dest := []interface{}{&id, &conversationID, &msg.SenderID, &receiverID, &content, &createdAt,
+		&messageType, &channelID, &replyToID, &threadID, &msg.ReplyCount, &lastReplyAt,
+		&attachmentURL, &attachmentType, &msg.Forwarded, &forwardedFrom, &attachmentID, &language, pq.Array(&msg.Tags),
+		&ttlSeconds, &msg.ExpireAfterRead, &expiresAt, &msg.Priority, &seq, &msg.FromBot}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	msg.ID = strconv.FormatInt(id, 10)
+	msg.ConversationID = conversationID.String
+	msg.RecipientID = receiverID.String
+	msg.Content = content.String
+	msg.Seq = seq.Int64
+	msg.Timestamp = createdAt.UTC().Format(models.TimestampFormat)
+	msg.MessageType = messageType.String
+	msg.ChannelID = channelID.String
+	msg.AttachmentURL = attachmentURL.String
+	msg.AttachmentType = attachmentType.String
+	msg.ForwardedFrom = forwardedFrom.String
+	msg.AttachmentID = attachmentID.String
+	msg.Language = language.String
+	msg.TTLSeconds = int(ttlSeconds.Int64)
+	if expiresAt.Valid {
+		msg.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+	}
+	if replyToID.Valid {
+		msg.ReplyToID = strconv.FormatInt(replyToID.Int64, 10)
+	}
+	if threadID.Valid {
+		msg.ThreadID = strconv.FormatInt(threadID.Int64, 10)
+	}
+	if lastReplyAt.Valid {
+		msg.LastReplyAt = lastReplyAt.Time.UTC().Format(time.RFC3339)
+	}
+	return &msg, nil
+}
+
+// nullableID converts a string message ID into a value suitable for a BIGINT column
+func nullableID(id string) (sql.NullInt64, error) {
+	if id == "" {
+		return sql.NullInt64{}, nil
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, fmt.Errorf("invalid message ID %q", id)
+	}
+	return sql.NullInt64{Int64: n, Valid: true}, nil
+}
+
+// nullableTTL stores a zero lifetime as NULL
+func nullableTTL(seconds int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(seconds), Valid: seconds > 0}
+}
+
+// nextConversationSeq assigns the next sequence number of a conversation. The conversation's
+// sequence row stays locked until tx ends.
+func nextConversationSeq(tx *sql.Tx, conversationID string) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(
+		`INSERT INTO data.conversation_sequences (conversation_id, last_seq) VALUES ($1, 1)
+		ON CONFLICT (conversation_id) DO UPDATE SET last_seq = data.conversation_sequences.last_seq + 1
+		RETURNING last_seq`,
+		conversationID,
+	).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("could not assign sequence number: %v", err)
+	}
+	return seq, nil
+}
+
+// SaveMessage saves a new message to the database and sets its server-assigned ID, sequence number
+// and timestamp. Messages of a conversation are numbered and timestamped in the same order.
+func SaveMessage(message *models.Message) (string, error) {
+	if err := SaveMessages([]*models.Message{message}); err != nil {
+		return "", err
+	}
+	return message.ID, nil
+}
+
+// SaveMessages saves several new messages like SaveMessage in one transaction, so that either all
+// of them are stored or none. Sequence rows are locked in the order of their conversation IDs, so
+// that concurrent batches cannot deadlock.
+func SaveMessages(messages []*models.Message) error {
+	ordered := slices.Clone(messages)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].ConversationID < ordered[j].ConversationID })
+
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, message := range ordered {
+		if err := insertMessage(tx, message); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit message: %v", err)
+	}
+	return nil
+}
+
+// insertMessage stores a message within tx and sets its server-assigned fields
+func insertMessage(tx *sql.Tx, message *models.Message) error {
+	replyToID, err := nullableID(message.ReplyToID)
+	if err != nil {
+		return err
+	}
+	threadID, err := nullableID(message.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	seq, err := nextConversationSeq(tx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	// The client's timestamp is kept for reference only, created_at is authoritative
+	var id int64
+	var expiresAt sql.NullTime
+	var createdAt time.Time
+	err = tx.QueryRow(
+		`INSERT INTO data.messages (conversation_id, sender_id, receiver_id, content, timestamp, message_type, channel_id,
+			reply_to_id, thread_id, attachment_url, attachment_type, forwarded, forwarded_from, attachment_id,
+			language, tags, search_config, ttl_seconds, expire_after_read, expires_at, priority, seq, created_at, from_bot)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17::regconfig, $18, $19,
+			CASE WHEN $18 > 0 AND NOT $19 THEN now() + $18 * interval '1 second' END, $20, $21, clock_timestamp(),
+			EXISTS (SELECT 1 FROM data.bots WHERE uid = $2))
+		RETURNING message_id, expires_at, created_at, from_bot`,
+		message.ConversationID, message.SenderID, message.RecipientID, message.Content, message.Timestamp,
+		message.MessageType, message.ChannelID, replyToID, threadID, message.AttachmentURL, message.AttachmentType,
+		message.Forwarded, message.ForwardedFrom, message.AttachmentID,
+		message.Language, pq.Array(message.Tags), TextSearchConfig(message.Language),
+		nullableTTL(message.TTLSeconds), message.ExpireAfterRead, message.Priority, seq,
+	).Scan(&id, &expiresAt, &createdAt, &message.FromBot)
+	if err != nil {
+		return fmt.Errorf("could not save message: %v", err)
+	}
+
+	message.ID = strconv.FormatInt(id, 10)
+	message.Seq = seq
+	message.Timestamp = createdAt.UTC().Format(models.TimestampFormat)
+	if expiresAt.Valid {
+		message.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// GetMessage loads a single message by its ID. It returns sql.ErrNoRows if the message does not exist.
+func GetMessage(messageID string) (*models.Message, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return nil, err
+	}
+	row := PostgresDB.QueryRow("SELECT "+messageColumns+" FROM data.messages m WHERE message_id=$1 AND "+liveMessageCondition("m"), id)
+	return scanMessage(row)
+}
+
+// IncrementThreadReplies bumps the reply count and last reply time of a thread's root message
+// and returns the updated summary.
+func IncrementThreadReplies(threadID string) (int, string, error) {
+	id, err := nullableID(threadID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var count int
+	var lastReplyAt time.Time
+	err = PostgresDB.QueryRow(
+		`UPDATE data.messages SET reply_count = reply_count + 1, last_reply_at = now()
+		WHERE message_id=$1 RETURNING reply_count, last_reply_at`, id,
+	).Scan(&count, &lastReplyAt)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not update thread summary: %v", err)
+	}
+	return count, lastReplyAt.UTC().Format(time.RFC3339), nil
+}
+
+// ListThreadReplies returns up to limit replies of a thread with an ID greater than afterID, oldest first.
+func ListThreadReplies(threadID, afterID string, limit int) ([]*models.Message, error) {
+	id, err := nullableID(threadID)
+	if err != nil {
+		return nil, err
+	}
+	after, err := nullableID(afterID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := PostgresDB.Query(
+		"SELECT "+messageColumns+` FROM data.messages m
+		WHERE thread_id=$1 AND message_id > $2 AND `+liveMessageCondition("m")+`
+		ORDER BY message_id ASC LIMIT $3`,
+		id, after.Int64, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list thread replies: %v", err)
+	}
+	defer rows.Close()
+
+	replies := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read thread reply: %v", err)
+		}
+		replies = append(replies, msg)
+	}
+	return replies, rows.Err()
+}
+
+// ListThreadParticipants returns the distinct senders of a thread, including the author of the root message.
+func ListThreadParticipants(threadID string) ([]string, error) {
+	id, err := nullableID(threadID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := PostgresDB.Query(
+		"SELECT DISTINCT sender_id FROM data.messages WHERE message_id=$1 OR thread_id=$1", id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list thread participants: %v", err)
+	}
+	defer rows.Close()
+
+	var participants []string
+	for rows.Next() {
+		var sender string
+		if err := rows.Scan(&sender); err != nil {
+			return nil, fmt.Errorf("could not read thread participant: %v", err)
+		}
+		participants = append(participants, sender)
+	}
+	return participants, rows.Err()
+}
+
+// MarkMessageDelivered records that a message was written to the connection of one of its
+// recipients. Direct messages are marked delivered. In channels the message is recorded for the
+// member, and the member's delivered sequence number moves up to the first message still
+// undelivered, so that messages delivered out of order never hide older ones.
+func MarkMessageDelivered(messageID, recipientID string) error {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var conversationID string
+	var seq int64
+	err = tx.QueryRow("SELECT conversation_id, seq FROM data.messages WHERE message_id=$1", id).Scan(&conversationID, &seq)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load delivered message: %v", err)
+	}
+
+	channelID, isChannel := strings.CutPrefix(conversationID, "channel:")
+	if !isChannel {
+		_, err = tx.Exec(
+			"UPDATE data.messages SET delivered_at=now() WHERE message_id=$1 AND receiver_id=$2 AND delivered_at IS NULL",
+			id, recipientID,
+		)
+		if err != nil {
+			return fmt.Errorf("could not mark message delivered: %v", err)
+		}
+		return tx.Commit()
+	}
+
+	// Waiting for the messages still being saved to the channel keeps delivered_seq from moving
+	// over one that is not visible yet
+	var lastSeq int64
+	err = tx.QueryRow(
+		"SELECT last_seq FROM data.conversation_sequences WHERE conversation_id=$1 FOR SHARE", conversationID,
+	).Scan(&lastSeq)
+	if err != nil {
+		return fmt.Errorf("could not load conversation sequence: %v", err)
+	}
+	var deliveredSeq sql.NullInt64
+	err = tx.QueryRow(
+		"SELECT delivered_seq FROM data.channel_members WHERE channel_id=$1 AND user_id=$2 FOR UPDATE",
+		channelID, recipientID,
+	).Scan(&deliveredSeq)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load channel membership: %v", err)
+	}
+	if deliveredSeq.Valid && seq <= deliveredSeq.Int64 {
+		return nil
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO data.channel_deliveries (user_id, channel_id, seq) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		recipientID, channelID, seq,
+	)
+	if err != nil {
+		return fmt.Errorf("could not mark message delivered: %v", err)
+	}
+	err = tx.QueryRow(
+		`UPDATE data.channel_members cm SET delivered_seq = coalesce((
+			SELECT min(c.seq) - 1 FROM data.messages c
+			WHERE c.conversation_id = $3 AND c.seq > coalesce(cm.delivered_seq, 0) AND c.seq <= $4
+				AND c.sender_id <> cm.user_id AND `+liveMessageCondition("c")+`
+				AND (cm.delivered_seq IS NOT NULL OR c.created_at >= cm.joined_at)
+				AND NOT EXISTS (SELECT 1 FROM data.channel_deliveries d
+					WHERE d.user_id = cm.user_id AND d.channel_id = cm.channel_id AND d.seq = c.seq)
+		), $4)
+		WHERE cm.channel_id=$1 AND cm.user_id=$2
+		RETURNING delivered_seq`,
+		channelID, recipientID, conversationID, lastSeq,
+	).Scan(&deliveredSeq)
+	if err != nil {
+		return fmt.Errorf("could not advance delivered sequence: %v", err)
+	}
+	_, err = tx.Exec(
+		"DELETE FROM data.channel_deliveries WHERE user_id=$1 AND channel_id=$2 AND seq <= $3",
+		recipientID, channelID, deliveredSeq.Int64,
+	)
+	if err != nil {
+		return fmt.Errorf("could not prune channel deliveries: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not mark message delivered: %v", err)
+	}
+	return nil
+}
+
+// ListUndeliveredMessages returns up to limit messages never delivered to a recipient, highest
+// priority first and oldest first within a priority: direct messages not marked delivered and
+// messages of the recipient's channels after their delivered sequence number that were not
+// delivered out of order.
+func ListUndeliveredMessages(recipientID string, limit int) ([]*models.Message, error) {
+	rows, err := PostgresDB.Query(
+		"SELECT "+messageColumns+` FROM data.messages m
+		WHERE `+liveMessageCondition("m")+` AND (
+			(receiver_id=$1 AND delivered_at IS NULL AND conversation_id NOT LIKE 'channel:%')
+			OR message_id IN (
+				SELECT c.message_id FROM data.channel_members cm
+				JOIN data.messages c ON c.conversation_id = 'channel:' || cm.channel_id
+				WHERE cm.user_id=$1 AND c.sender_id <> $1
+					AND (c.seq > cm.delivered_seq OR (cm.delivered_seq IS NULL AND c.created_at >= cm.joined_at))
+					AND NOT EXISTS (SELECT 1 FROM data.channel_deliveries d
+						WHERE d.user_id = cm.user_id AND d.channel_id = cm.channel_id AND d.seq = c.seq)
+			)
+		)
+		ORDER BY priority DESC, message_id ASC LIMIT $2`,
+		recipientID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list undelivered messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read undelivered message: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// GetConversationSeq returns the sequence number of the latest message of a conversation, 0 if it has none.
+func GetConversationSeq(conversationID string) (int64, error) {
+	var seq int64
+	err := PostgresDB.QueryRow(
+		"SELECT last_seq FROM data.conversation_sequences WHERE conversation_id=$1", conversationID,
+	).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("could not load conversation sequence: %v", err)
+	}
+	return seq, nil
+}
+
+// ListConversationMessages returns up to limit messages of a conversation with a sequence number
+// greater than afterSeq, in sequence order.
+func ListConversationMessages(conversationID string, afterSeq int64, limit int) ([]*models.Message, error) {
+	rows, err := PostgresDB.Query(
+		"SELECT "+messageColumns+` FROM data.messages m
+		WHERE conversation_id=$1 AND seq > $2 AND `+liveMessageCondition("m")+`
+		ORDER BY seq ASC LIMIT $3`,
+		conversationID, afterSeq, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list conversation messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read conversation message: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
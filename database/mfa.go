@@ -0,0 +1,192 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// GetTOTP returns a user's encrypted TOTP secret and whether it is enabled. It returns
+// sql.ErrNoRows if the user never started enrollment.
+func GetTOTP(userID int) (string, bool, error) {
+	var secret string
+	var enabled bool
+	err := PostgresDB.QueryRow(
+		"SELECT secret, enabled_at IS NOT NULL FROM data.user_totp WHERE user_id=$1", userID,
+	).Scan(&secret, &enabled)
+	return secret, enabled, err
+}
+
+// IsTOTPEnabled reports whether a user has a confirmed TOTP second factor
+func IsTOTPEnabled(userID int) (bool, error) {
+	_, enabled, err := GetTOTP(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not load second factor: %v", err)
+	}
+	return enabled, nil
+}
+
+// SaveTOTPEnrollment stores a new encrypted TOTP secret waiting for confirmation, replacing an
+// earlier unconfirmed one. It does nothing once TOTP is enabled.
+func SaveTOTPEnrollment(userID int, secret string) error {
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret=$2, last_used_step=0, created_at=now()
+		WHERE data.user_totp.enabled_at IS NULL`,
+		userID, secret,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save TOTP enrollment: %v", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false if that step or a
+// later one was used already, so that every code is accepted only once.
+func UseTOTPStep(userID int, step int64) (bool, error) {
+	result, err := PostgresDB.Exec(
+		"UPDATE data.user_totp SET last_used_step=$2 WHERE user_id=$1 AND last_used_step < $2",
+		userID, step,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not record TOTP use: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// EnableTOTP confirms a user's TOTP enrollment and replaces their recovery codes
+func EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE data.user_totp SET enabled_at=now() WHERE user_id=$1", userID); err != nil {
+		return fmt.Errorf("could not enable TOTP: %v", err)
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new ones
+func ReplaceRecoveryCodes(userID int, recoveryCodeHashes []string) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes swaps a user's recovery codes within a transaction
+func replaceRecoveryCodes(tx *sql.Tx, userID int, recoveryCodeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM data.mfa_recovery_codes WHERE user_id=$1", userID); err != nil {
+		return fmt.Errorf("could not delete recovery codes: %v", err)
+	}
+	_, err := tx.Exec(
+		"INSERT INTO data.mfa_recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])",
+		userID, pq.Array(recoveryCodeHashes),
+	)
+	if err != nil {
+		return fmt.Errorf("could not save recovery codes: %v", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code of a user used. It returns false if the user has
+// no such unused code.
+func UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := PostgresDB.Exec(
+		"UPDATE data.mfa_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL",
+		userID, codeHash,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not use recovery code: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// DeleteTOTP removes a user's TOTP second factor and recovery codes
+func DeleteTOTP(userID int) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM data.user_totp WHERE user_id=$1", userID); err != nil {
+		return fmt.Errorf("could not delete TOTP: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.mfa_recovery_codes WHERE user_id=$1", userID); err != nil {
+		return fmt.Errorf("could not delete recovery codes: %v", err)
+	}
+	return tx.Commit()
+}
+
+// CreateMFAChallenge stores a login waiting for its second factor under the hash of its challenge
+// token. Expired challenges are cleaned up on the way.
+func CreateMFAChallenge(challengeHash string, challenge *models.MFAChallenge, expiresAt time.Time) error {
+	if _, err := PostgresDB.Exec("DELETE FROM data.mfa_challenges WHERE expires_at <= now()"); err != nil {
+		return fmt.Errorf("could not delete expired MFA challenges: %v", err)
+	}
+	device, err := json.Marshal(challenge.Device)
+	if err != nil {
+		return fmt.Errorf("could not encode device: %v", err)
+	}
+	_, err = PostgresDB.Exec(
+		`INSERT INTO data.mfa_challenges (challenge_hash, user_id, username, email, ip_address, device, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		challengeHash, challenge.UserID, challenge.Username, challenge.Email, challenge.IPAddress, device, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save MFA challenge: %v", err)
+	}
+	return nil
+}
+
+// AttemptMFAChallenge counts an attempt on an unexpired challenge and returns it with the attempt
+// included. It returns sql.ErrNoRows if the challenge is unknown or expired.
+func AttemptMFAChallenge(challengeHash string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	var device []byte
+	err := PostgresDB.QueryRow(
+		`UPDATE data.mfa_challenges SET attempts=attempts+1 WHERE challenge_hash=$1 AND expires_at > now()
+		RETURNING user_id, username, email, ip_address, device, attempts`,
+		challengeHash,
+	).Scan(&challenge.UserID, &challenge.Username, &challenge.Email, &challenge.IPAddress, &device, &challenge.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load MFA challenge: %v", err)
+	}
+	if err := json.Unmarshal(device, &challenge.Device); err != nil {
+		return nil, fmt.Errorf("could not decode device: %v", err)
+	}
+	return &challenge, nil
+}
+
+// DeleteMFAChallenge removes a challenge once it is completed or has no attempts left. It returns
+// false if the challenge was already removed, so that a challenge completes only once.
+func DeleteMFAChallenge(challengeHash string) (bool, error) {
+	result, err := PostgresDB.Exec("DELETE FROM data.mfa_challenges WHERE challenge_hash=$1", challengeHash)
+	if err != nil {
+		return false, fmt.Errorf("could not delete MFA challenge: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
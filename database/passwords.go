@@ -0,0 +1,123 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// GetUserByEmail returns the ID and username of the user with an email address. It returns
+// sql.ErrNoRows if there is none.
+func GetUserByEmail(email string) (int, string, error) {
+	var userID int
+	var username string
+	err := PostgresDB.QueryRow(
+		"SELECT user_id, username FROM data.users WHERE lower(email)=lower($1)", email,
+	).Scan(&userID, &username)
+	return userID, username, err
+}
+
+// GetPasswordHash returns the password hash of a user. It returns sql.ErrNoRows if the user has
+// no password.
+func GetPasswordHash(userID int) (string, error) {
+	var passwordHash string
+	err := PostgresDB.QueryRow("SELECT password_hash FROM data.user_auth WHERE user_id=$1", userID).Scan(&passwordHash)
+	return passwordHash, err
+}
+
+// CreatePasswordReset stores the hash of a password reset token for a user
+func CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := PostgresDB.Exec(
+		"INSERT INTO data.password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		tokenHash, userID, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save password reset token: %v", err)
+	}
+	return nil
+}
+
+// ConsumePasswordReset deletes an unexpired password reset token and returns the user it was
+// issued to. It returns sql.ErrNoRows if the token is unknown, expired or already used.
+func ConsumePasswordReset(tokenHash string) (int, error) {
+	var userID int
+	err := PostgresDB.QueryRow(
+		"DELETE FROM data.password_reset_tokens WHERE token_hash=$1 AND expires_at > now() RETURNING user_id",
+		tokenHash,
+	).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("could not redeem password reset token: %v", err)
+	}
+	return userID, err
+}
+
+// UpdatePassword replaces a user's password hash and revokes everything issued for the old
+// password: reset tokens, refresh tokens and access tokens issued up to now. It returns the
+// stable user ID of the user.
+func UpdatePassword(userID int, passwordHash string) (string, error) {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE data.user_auth SET password_hash=$2 WHERE user_id=$1", userID, passwordHash); err != nil {
+		return "", fmt.Errorf("could not update password: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.password_reset_tokens WHERE user_id=$1", userID); err != nil {
+		return "", fmt.Errorf("could not delete password reset tokens: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM data.refresh_tokens WHERE user_id=$1", userID); err != nil {
+		return "", fmt.Errorf("could not revoke refresh tokens: %v", err)
+	}
+
+	uid, err := revokeAccessTokens(tx, userID)
+	if err != nil {
+		return "", err
+	}
+	return uid, tx.Commit()
+}
+
+// RevokeAccessTokens revokes every access token issued to a user up to now, such as after their
+// roles changed. It returns the stable user ID of the user.
+func RevokeAccessTokens(userID int) (string, error) {
+	return revokeAccessTokens(PostgresDB, userID)
+}
+
+// revokeAccessTokens records the revocation on a database or within a transaction. The time is
+// truncated to the seconds resolution of token issue times.
+func revokeAccessTokens(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, userID int) (string, error) {
+	var uid string
+	err := db.QueryRow(
+		`INSERT INTO data.credential_revocations (user_id, revoked_before)
+		SELECT uid, date_trunc('second', now()) FROM data.users WHERE user_id=$1
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before=EXCLUDED.revoked_before
+		RETURNING user_id`,
+		userID,
+	).Scan(&uid)
+	if err != nil {
+		return "", fmt.Errorf("could not revoke access tokens: %v", err)
+	}
+	return uid, nil
+}
+
+// GetCredentialsRevokedBefore returns the time before which the access tokens a user was issued on
+// a device are revoked, either for all of the user's devices or for that device alone, or the zero
+// time if none are
+func GetCredentialsRevokedBefore(userID, deviceID string) (time.Time, error) {
+	var revokedBefore sql.NullTime
+	err := PostgresDB.QueryRow(
+		`SELECT greatest(
+			(SELECT revoked_before FROM data.credential_revocations WHERE user_id=$1),
+			(SELECT d.revoked_before FROM data.devices d JOIN data.users u ON u.user_id = d.user_id
+			WHERE u.uid=$1 AND d.device_id=$2)
+		)`,
+		userID, deviceID,
+	).Scan(&revokedBefore)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not load credential revocation: %v", err)
+	}
+	return revokedBefore.Time, nil
+}
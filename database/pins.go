@@ -0,0 +1,172 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+)
+
+// PinMessage pins a message in a conversation unless the conversation already holds limit pins.
+// It returns sql.ErrNoRows if nothing was pinned, either because of the limit or because the
+// message is already pinned. Pins of a conversation are serialized with an advisory lock, so
+// concurrent pins cannot both pass the limit.
+func PinMessage(conversationID, messageID, userID string, limit int) (string, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('message_pins:' || $1))", conversationID); err != nil {
+		return "", fmt.Errorf("could not lock pins: %v", err)
+	}
+
+	var pinnedAt time.Time
+	err = tx.QueryRow(
+		`INSERT INTO data.message_pins (conversation_id, message_id, pinned_by)
+		SELECT $1, $2, $3 WHERE (SELECT count(*) FROM data.message_pins WHERE conversation_id=$1) < $4
+		ON CONFLICT DO NOTHING RETURNING pinned_at`,
+		conversationID, id, userID, limit,
+	).Scan(&pinnedAt)
+	if err == sql.ErrNoRows {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("could not pin message: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("could not pin message: %v", err)
+	}
+	return pinnedAt.UTC().Format(time.RFC3339), nil
+}
+
+// IsPinned reports whether a message is pinned in a conversation.
+func IsPinned(conversationID, messageID string) (bool, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = PostgresDB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM data.message_pins WHERE conversation_id=$1 AND message_id=$2)",
+		conversationID, id,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check pin: %v", err)
+	}
+	return exists, nil
+}
+
+// UnpinMessage removes a pin and reports whether the message was pinned.
+func UnpinMessage(conversationID, messageID string) (bool, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := PostgresDB.Exec(
+		"DELETE FROM data.message_pins WHERE conversation_id=$1 AND message_id=$2", conversationID, id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not unpin message: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ListPinnedMessages returns the messages pinned in a conversation, most recently pinned first.
+func ListPinnedMessages(conversationID string) ([]*models.Message, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT `+prefixedMessageColumns("m")+`, p.pinned_at FROM data.message_pins p
+		JOIN data.messages m ON m.message_id = p.message_id
+		WHERE p.conversation_id=$1 AND `+liveMessageCondition("m")+` ORDER BY p.pinned_at DESC`,
+		conversationID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pinned messages: %v", err)
+	}
+	defer rows.Close()
+
+	pins := []*models.Message{}
+	for rows.Next() {
+		var pinnedAt time.Time
+		msg, err := scanMessage(rows, &pinnedAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not read pinned message: %v", err)
+		}
+		msg.Pinned = true
+		msg.PinTimestamp = pinnedAt.UTC().Format(time.RFC3339)
+		pins = append(pins, msg)
+	}
+	return pins, rows.Err()
+}
+
+// StarMessage stars a message for a single user. Starring twice is a no-op.
+func StarMessage(userID, messageID string) error {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = PostgresDB.Exec(
+		"INSERT INTO data.message_stars (user_id, message_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, id,
+	)
+	if err != nil {
+		return fmt.Errorf("could not star message: %v", err)
+	}
+	return nil
+}
+
+// UnstarMessage removes a user's star from a message.
+func UnstarMessage(userID, messageID string) error {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = PostgresDB.Exec("DELETE FROM data.message_stars WHERE user_id=$1 AND message_id=$2", userID, id)
+	if err != nil {
+		return fmt.Errorf("could not unstar message: %v", err)
+	}
+	return nil
+}
+
+// ListStarredMessages returns up to limit messages starred by a user, most recently starred first,
+// starting after the given cursor (the message ID of the last item of the previous page).
+func ListStarredMessages(userID, cursor string, limit int) ([]*models.Message, error) {
+	after, err := nullableID(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := PostgresDB.Query(
+		`SELECT `+prefixedMessageColumns("m")+` FROM data.message_stars s
+		JOIN data.messages m ON m.message_id = s.message_id
+		WHERE s.user_id=$1 AND `+liveMessageCondition("m")+` AND ($2::bigint IS NULL OR (s.starred_at, s.message_id) <
+			(SELECT starred_at, message_id FROM data.message_stars WHERE user_id=$1 AND message_id=$2))
+		ORDER BY s.starred_at DESC, s.message_id DESC LIMIT $3`,
+		userID, after, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list starred messages: %v", err)
+	}
+	defer rows.Close()
+
+	starred := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read starred message: %v", err)
+		}
+		msg.Starred = true
+		starred = append(starred, msg)
+	}
+	return starred, rows.Err()
+}
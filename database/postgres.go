@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"websocket-server/models"
 
 	_ "github.com/lib/pq"
 )
@@ -46,16 +45,8 @@ func InitializePostgresDB() {
 	}
 
 	log.Println("Database connection established.")
-}
 
-// SaveMessage saves a new message to the database.
-func SaveMessage(message *models.Message) (string, error) {
-	_, err := PostgresDB.Exec(
-		"INSERT INTO data.messages (sender_id, receiver_id, content, timestamp) VALUES ($1, $2, $3, $4)",
-		message.SenderID, message.RecipientID, message.Content, message.Timestamp,
-	)
-	if err != nil {
-		return "", fmt.Errorf("could not save message: %v", err)
+	if err := MigrateSchema(); err != nil {
+		log.Fatalf("Could not migrate database schema: %v", err)
 	}
-	return "Message saved successfully", nil
 }
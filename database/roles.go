@@ -0,0 +1,86 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// ListUserRoles returns the roles granted to a user
+func ListUserRoles(userID int) ([]string, error) {
+	var roles []string
+	err := PostgresDB.QueryRow(
+		"SELECT coalesce(array_agg(role ORDER BY role), '{}') FROM data.user_roles WHERE user_id=$1", userID,
+	).Scan(pq.Array(&roles))
+	if err != nil {
+		return nil, fmt.Errorf("could not load roles: %v", err)
+	}
+	return roles, nil
+}
+
+// GrantRole grants a role to a user, granting it twice has no effect
+func GrantRole(userID int, role, grantedBy string) error {
+	_, err := PostgresDB.Exec(
+		"INSERT INTO data.user_roles (user_id, role, granted_by) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		userID, role, grantedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("could not grant role: %v", err)
+	}
+	return nil
+}
+
+// RevokeRole takes a role away from a user. It returns false if the user did not hold it.
+func RevokeRole(userID int, role string) (bool, error) {
+	result, err := PostgresDB.Exec("DELETE FROM data.user_roles WHERE user_id=$1 AND role=$2", userID, role)
+	if err != nil {
+		return false, fmt.Errorf("could not revoke role: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// RecordModerationAction appends an entry to the moderation log
+func RecordModerationAction(moderator, action, target string) error {
+	_, err := PostgresDB.Exec(
+		"INSERT INTO data.moderation_log (moderator, action, target) VALUES ($1, $2, $3)",
+		moderator, action, target,
+	)
+	if err != nil {
+		return fmt.Errorf("could not record moderation action: %v", err)
+	}
+	return nil
+}
+
+// DeleteMessage hard-deletes a message together with its pins, stars and the attachment no other
+// message references, redacts it in the update log and takes it out of the reply count of its
+// thread. It returns what was deleted and the storage keys by digest of the blobs no attachment
+// references anymore, to be released with ReleaseBlob. It returns sql.ErrNoRows if there is no
+// such message.
+func DeleteMessage(messageID string) (*models.Message, map[string]string, error) {
+	id, err := nullableID(messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	deleted, blobs, err := purgeMessages(tx, "SELECT $1::bigint", id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(deleted) == 0 {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("could not commit message deletion: %v", err)
+	}
+	return deleted[0], blobs, nil
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"websocket-server/models"
+)
+
+// Statuses of a scheduled message
+const (
+	ScheduleStatusPending   = "pending"
+	ScheduleStatusSending   = "sending"
+	ScheduleStatusSent      = "sent"
+	ScheduleStatusCancelled = "cancelled"
+	ScheduleStatusFailed    = "failed"
+)
+
+const scheduledColumns = "schedule_id, sender_id, payload, send_at, status, attempts, last_error, created_at, updated_at"
+
+// scanScheduledMessage reads a row selected with scheduledColumns
+func scanScheduledMessage(row rowScanner) (*models.ScheduledMessage, error) {
+	var scheduled models.ScheduledMessage
+	var id int64
+	var payload []byte
+	var lastError sql.NullString
+	var sendAt, createdAt, updatedAt time.Time
+	err := row.Scan(&id, &scheduled.SenderID, &payload, &sendAt, &scheduled.Status, &scheduled.Attempts,
+		&lastError, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &scheduled.Message); err != nil {
+		return nil, fmt.Errorf("could not decode scheduled message: %v", err)
+	}
+
+	scheduled.ID = strconv.FormatInt(id, 10)
+	scheduled.SendAt = sendAt.UTC().Format(time.RFC3339)
+	scheduled.LastError = lastError.String
+	scheduled.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	scheduled.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+	return &scheduled, nil
+}
+
+// CreateScheduledMessage stores a message to be sent later and sets its ID.
+func CreateScheduledMessage(scheduled *models.ScheduledMessage) error {
+	payload, err := json.Marshal(scheduled.Message)
+	if err != nil {
+		return fmt.Errorf("could not encode scheduled message: %v", err)
+	}
+
+	row := PostgresDB.QueryRow(
+		`INSERT INTO data.scheduled_messages (sender_id, payload, send_at) VALUES ($1, $2, $3)
+		RETURNING `+scheduledColumns,
+		scheduled.SenderID, payload, scheduled.SendAt,
+	)
+	created, err := scanScheduledMessage(row)
+	if err != nil {
+		return fmt.Errorf("could not save scheduled message: %v", err)
+	}
+	*scheduled = *created
+	return nil
+}
+
+// CountPendingScheduledMessages returns how many messages a user has waiting to be sent.
+func CountPendingScheduledMessages(senderID string) (int, error) {
+	var count int
+	err := PostgresDB.QueryRow(
+		"SELECT count(*) FROM data.scheduled_messages WHERE sender_id=$1 AND status=$2",
+		senderID, ScheduleStatusPending,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("could not count scheduled messages: %v", err)
+	}
+	return count, nil
+}
+
+// ListScheduledMessages returns a user's pending and failed scheduled messages, soonest first.
+func ListScheduledMessages(senderID string) ([]*models.ScheduledMessage, error) {
+	rows, err := PostgresDB.Query(
+		"SELECT "+scheduledColumns+` FROM data.scheduled_messages
+		WHERE sender_id=$1 AND status IN ($2, $3) ORDER BY send_at`,
+		senderID, ScheduleStatusPending, ScheduleStatusFailed,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list scheduled messages: %v", err)
+	}
+	defer rows.Close()
+
+	scheduled := []*models.ScheduledMessage{}
+	for rows.Next() {
+		item, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read scheduled message: %v", err)
+		}
+		scheduled = append(scheduled, item)
+	}
+	return scheduled, rows.Err()
+}
+
+// UpdateScheduledMessage replaces the content and due time of a pending scheduled message that is
+// not due yet. It returns sql.ErrNoRows if there is no such message.
+func UpdateScheduledMessage(scheduled *models.ScheduledMessage) error {
+	payload, err := json.Marshal(scheduled.Message)
+	if err != nil {
+		return fmt.Errorf("could not encode scheduled message: %v", err)
+	}
+
+	row := PostgresDB.QueryRow(
+		`UPDATE data.scheduled_messages SET payload=$3, send_at=$4, updated_at=now()
+		WHERE schedule_id=$1 AND sender_id=$2 AND status=$5 AND send_at > now()
+		RETURNING `+scheduledColumns,
+		scheduled.ID, scheduled.SenderID, payload, scheduled.SendAt, ScheduleStatusPending,
+	)
+	updated, err := scanScheduledMessage(row)
+	if err != nil {
+		return err
+	}
+	*scheduled = *updated
+	return nil
+}
+
+// CancelScheduledMessage cancels a pending scheduled message that is not due yet.
+// It reports whether a message was cancelled.
+func CancelScheduledMessage(scheduleID, senderID string) (bool, error) {
+	result, err := PostgresDB.Exec(
+		`UPDATE data.scheduled_messages SET status=$3, updated_at=now()
+		WHERE schedule_id=$1 AND sender_id=$2 AND status=$4 AND send_at > now()`,
+		scheduleID, senderID, ScheduleStatusCancelled, ScheduleStatusPending,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not cancel scheduled message: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// ProcessDueScheduledMessages claims up to limit due messages and hands each to send, which
+// returns the new status and an error description. Claimed rows are marked as sending before any
+// is sent, so no two replicas ever send the same message and a message is never sent again after
+// a crash; such messages are failed by FailInterruptedScheduledMessages instead.
+func ProcessDueScheduledMessages(limit int, send func(*models.ScheduledMessage) (string, string)) (int, error) {
+	rows, err := PostgresDB.Query(
+		`UPDATE data.scheduled_messages SET status=$2, updated_at=now()
+		WHERE schedule_id IN (
+			SELECT schedule_id FROM data.scheduled_messages
+			WHERE status=$1 AND send_at <= now() ORDER BY send_at LIMIT $3 FOR UPDATE SKIP LOCKED
+		) RETURNING `+scheduledColumns,
+		ScheduleStatusPending, ScheduleStatusSending, limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not claim scheduled messages: %v", err)
+	}
+	due, err := scanScheduledMessages(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, scheduled := range due {
+		status, lastError := send(scheduled)
+		_, err := PostgresDB.Exec(
+			`UPDATE data.scheduled_messages SET status=$3, attempts=attempts+1, last_error=NULLIF($4, ''), updated_at=now()
+			WHERE schedule_id=$1 AND status=$2`,
+			scheduled.ID, ScheduleStatusSending, status, lastError,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("could not update scheduled message: %v", err)
+		}
+	}
+	return len(due), nil
+}
+
+// FailInterruptedScheduledMessages marks the messages claimed for sending before staleAfter ago
+// as failed, since it is unknown whether they were sent, and returns them.
+func FailInterruptedScheduledMessages(staleAfter time.Duration, lastError string) ([]*models.ScheduledMessage, error) {
+	rows, err := PostgresDB.Query(
+		`UPDATE data.scheduled_messages SET status=$2, attempts=attempts+1, last_error=$3, updated_at=now()
+		WHERE status=$1 AND updated_at < now() - $4 * interval '1 second'
+		RETURNING `+scheduledColumns,
+		ScheduleStatusSending, ScheduleStatusFailed, lastError, int64(staleAfter.Seconds()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not fail interrupted scheduled messages: %v", err)
+	}
+	return scanScheduledMessages(rows)
+}
+
+// scanScheduledMessages reads and closes rows selected with scheduledColumns
+func scanScheduledMessages(rows *sql.Rows) ([]*models.ScheduledMessage, error) {
+	defer rows.Close()
+
+	var scheduled []*models.ScheduledMessage
+	for rows.Next() {
+		message, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read scheduled message: %v", err)
+		}
+		scheduled = append(scheduled, message)
+	}
+	return scheduled, rows.Err()
+}
@@ -0,0 +1,542 @@
+package database
+
+import (
+	"fmt"
+	"log"
+)
+
+// schemaStatements are applied in order on startup. Every statement must be
+// idempotent so that restarts against an existing database are safe.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS data.messages (
+		message_id BIGSERIAL PRIMARY KEY,
+		sender_id TEXT NOT NULL,
+		receiver_id TEXT,
+		content TEXT,
+		timestamp TEXT
+	)`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS message_id BIGSERIAL`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS conversation_id TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS message_type TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS channel_id TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS reply_to_id BIGINT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS thread_id BIGINT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS reply_count INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS last_reply_at TIMESTAMPTZ`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS attachment_url TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS attachment_type TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS forwarded BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS forwarded_from TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS attachment_id TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS language TEXT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS tags TEXT[]`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS ttl_seconds INT`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS expire_after_read BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS read_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS messages_expires_idx ON data.messages (expires_at) WHERE expires_at IS NOT NULL`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS from_bot BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE INDEX IF NOT EXISTS messages_undelivered_idx ON data.messages (receiver_id, priority DESC, message_id)
+		WHERE delivered_at IS NULL`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS seq BIGINT`,
+	`CREATE INDEX IF NOT EXISTS messages_thread_idx ON data.messages (thread_id, message_id)`,
+
+	// Full-text search, the text search configuration follows the message language
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS search_config regconfig NOT NULL DEFAULT 'simple'`,
+	`ALTER TABLE data.messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector(search_config, coalesce(content, ''))) STORED`,
+	`CREATE INDEX IF NOT EXISTS messages_search_idx ON data.messages USING GIN (search_vector)`,
+	`CREATE INDEX IF NOT EXISTS messages_tags_idx ON data.messages USING GIN (tags)`,
+	`CREATE INDEX IF NOT EXISTS messages_conversation_idx ON data.messages (conversation_id, message_id)`,
+
+	// Per-conversation sequence numbers, messages stored before sequencing existed are numbered by
+	// the messages_seq migration
+	`CREATE TABLE IF NOT EXISTS data.conversation_sequences (
+		conversation_id TEXT PRIMARY KEY,
+		last_seq BIGINT NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_conversation_seq_idx ON data.messages (conversation_id, seq)`,
+	`ALTER TABLE data.conversation_sequences ADD COLUMN IF NOT EXISTS pruned_seq BIGINT NOT NULL DEFAULT 0`,
+
+	// Changes to existing messages and conversations, numbered in the same sequence as the messages
+	// so that reconnecting clients can replay them. Entries older than the sync retention are pruned.
+	`CREATE TABLE IF NOT EXISTS data.conversation_updates (
+		conversation_id TEXT NOT NULL,
+		seq BIGINT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (conversation_id, seq)
+	)`,
+	`CREATE INDEX IF NOT EXISTS conversation_updates_created_idx ON data.conversation_updates (created_at)`,
+
+	// Channel membership decides who may read a channel conversation
+	`CREATE TABLE IF NOT EXISTS data.channel_members (
+		channel_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (channel_id, user_id)
+	)`,
+	// The sequence number of the channel up to which every message was delivered to the member.
+	// The backlog of members added without one starts when they joined.
+	`ALTER TABLE data.channel_members ADD COLUMN IF NOT EXISTS delivered_seq BIGINT`,
+	// Channel messages delivered to a member beyond their delivered_seq, such as urgent messages
+	// sent ahead of older ones. delivered_seq only moves over messages that were all delivered.
+	`CREATE TABLE IF NOT EXISTS data.channel_deliveries (
+		user_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL,
+		seq BIGINT NOT NULL,
+		PRIMARY KEY (user_id, channel_id, seq)
+	)`,
+
+	// Per-channel settings, channels without a row use the defaults
+	`CREATE TABLE IF NOT EXISTS data.channels (
+		channel_id TEXT PRIMARY KEY,
+		pin_role TEXT NOT NULL DEFAULT 'member',
+		pin_limit INT NOT NULL DEFAULT 50,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Pins are shared by everyone in a conversation
+	`CREATE TABLE IF NOT EXISTS data.message_pins (
+		conversation_id TEXT NOT NULL,
+		message_id BIGINT NOT NULL,
+		pinned_by TEXT NOT NULL,
+		pinned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (conversation_id, message_id)
+	)`,
+
+	// Stars are private to the user who starred the message
+	`CREATE TABLE IF NOT EXISTS data.message_stars (
+		user_id TEXT NOT NULL,
+		message_id BIGINT NOT NULL,
+		starred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, message_id)
+	)`,
+
+	// Messages waiting to be sent, claimed by one replica at a time with row locks
+	`CREATE TABLE IF NOT EXISTS data.scheduled_messages (
+		schedule_id BIGSERIAL PRIMARY KEY,
+		sender_id TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		send_at TIMESTAMPTZ NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_messages_due_idx ON data.scheduled_messages (send_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS scheduled_messages_sender_idx ON data.scheduled_messages (sender_id, status)`,
+
+	// Per-conversation defaults for ephemeral messages
+	`CREATE TABLE IF NOT EXISTS data.conversation_settings (
+		conversation_id TEXT PRIMARY KEY,
+		message_ttl_seconds INT NOT NULL DEFAULT 0,
+		expire_after_read BOOLEAN NOT NULL DEFAULT false,
+		updated_by TEXT,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Uploaded attachments, blobs are shared between rows with the same sha256
+	`CREATE TABLE IF NOT EXISTS data.attachments (
+		attachment_id TEXT PRIMARY KEY,
+		owner_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		attachment_type TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		sha256 TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE data.attachments ADD COLUMN IF NOT EXISTS width INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE data.attachments ADD COLUMN IF NOT EXISTS height INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE data.attachments ADD COLUMN IF NOT EXISTS media_status TEXT NOT NULL DEFAULT 'none'`,
+	`CREATE INDEX IF NOT EXISTS attachments_sha256_idx ON data.attachments (sha256)`,
+
+	// Thumbnails belong to the content, so attachments sharing a blob share thumbnails
+	`CREATE TABLE IF NOT EXISTS data.attachment_thumbnails (
+		sha256 TEXT NOT NULL,
+		max_side INT NOT NULL,
+		width INT NOT NULL,
+		height INT NOT NULL,
+		content_type TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		PRIMARY KEY (sha256, max_side)
+	)`,
+
+	// Every login attempt, used for the login history and to spot new devices and addresses
+	`CREATE TABLE IF NOT EXISTS data.login_attempts (
+		attempt_id BIGSERIAL PRIMARY KEY,
+		username TEXT NOT NULL,
+		user_id INT,
+		ip_address TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		succeeded BOOLEAN NOT NULL,
+		new_device BOOLEAN NOT NULL DEFAULT false,
+		new_ip BOOLEAN NOT NULL DEFAULT false,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON data.login_attempts (username, attempt_id)`,
+	`CREATE INDEX IF NOT EXISTS login_attempts_user_idx ON data.login_attempts (user_id) WHERE succeeded`,
+
+	// Consecutive failed logins per username, whether or not the account exists
+	`CREATE TABLE IF NOT EXISTS data.login_failures (
+		username TEXT PRIMARY KEY,
+		failed_count INT NOT NULL DEFAULT 0,
+		blocked_until TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Email verification, accounts without a status row predate verification and count as verified
+	`CREATE TABLE IF NOT EXISTS data.email_verification_status (
+		user_id INT PRIMARY KEY,
+		email TEXT NOT NULL,
+		verified_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS data.email_verification_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL,
+		email TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_verification_tokens_user_idx ON data.email_verification_tokens (user_id)`,
+
+	// Single-use password reset tokens, only their hash is stored
+	`CREATE TABLE IF NOT EXISTS data.password_reset_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// Access tokens issued before revoked_before are rejected, such as after a password change
+	`CREATE TABLE IF NOT EXISTS data.credential_revocations (
+		user_id TEXT PRIMARY KEY,
+		revoked_before TIMESTAMPTZ NOT NULL
+	)`,
+
+	// TOTP second factors, the secret is encrypted and enabled_at is set once enrollment is confirmed
+	`CREATE TABLE IF NOT EXISTS data.user_totp (
+		user_id INT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at TIMESTAMPTZ,
+		last_used_step BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS data.mfa_recovery_codes (
+		user_id INT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMPTZ,
+		PRIMARY KEY (user_id, code_hash)
+	)`,
+	// Logins waiting for their second factor, only the hash of the challenge token is stored
+	`CREATE TABLE IF NOT EXISTS data.mfa_challenges (
+		challenge_hash TEXT PRIMARY KEY,
+		user_id INT NOT NULL,
+		username TEXT NOT NULL,
+		email TEXT NOT NULL,
+		ip_address TEXT NOT NULL,
+		device JSONB NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	// Accounts of OpenID Connect providers linked to users, keyed by the provider's subject
+	`CREATE TABLE IF NOT EXISTS data.user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INT NOT NULL,
+		email TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_login_at TIMESTAMPTZ,
+		PRIMARY KEY (provider, subject)
+	)`,
+	// OpenID Connect logins in progress, keyed by the hash of their state parameter
+	`CREATE TABLE IF NOT EXISTS data.oidc_login_states (
+		state_hash TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	// Provider accounts waiting for the password of the unverified user they would be linked to
+	`CREATE TABLE IF NOT EXISTS data.oidc_pending_links (
+		link_hash TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INT NOT NULL,
+		email TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	// Single-use WebSocket connection tickets, only their hash is stored
+	`CREATE TABLE IF NOT EXISTS data.connection_tickets (
+		ticket_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE data.connection_tickets ADD COLUMN IF NOT EXISTS token_expires_at TIMESTAMPTZ`,
+	`ALTER TABLE data.connection_tickets ADD COLUMN IF NOT EXISTS scopes TEXT[]`,
+
+	// Roles granted on top of the user role every account holds. The first admin is granted with
+	// INSERT INTO data.user_roles (user_id, role, granted_by) VALUES (<user_id>, 'admin', 'setup')
+	`CREATE TABLE IF NOT EXISTS data.user_roles (
+		user_id INT NOT NULL,
+		role TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, role)
+	)`,
+	// Bot accounts and their API keys, only the hash of a key's secret is stored
+	`CREATE TABLE IF NOT EXISTS data.bots (
+		bot_id TEXT PRIMARY KEY,
+		display_name TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS data.api_keys (
+		key_id TEXT PRIMARY KEY,
+		bot_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_keys_bot_idx ON data.api_keys (bot_id)`,
+	`CREATE TABLE IF NOT EXISTS data.moderation_log (
+		id BIGSERIAL PRIMARY KEY,
+		moderator TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+
+	// Resumable uploads in progress, the chunks are staged on local disk
+	`CREATE TABLE IF NOT EXISTS data.attachment_uploads (
+		upload_id TEXT PRIMARY KEY,
+		owner_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		received BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// A chunk claims the upload while it is written, uploads idle since updated_at are reaped
+	`ALTER TABLE data.attachment_uploads ADD COLUMN IF NOT EXISTS writing_since TIMESTAMPTZ`,
+	`ALTER TABLE data.attachment_uploads ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+
+	// Stable user IDs. Users and bots are identified by a UUID in tokens, connections and stored
+	// data, usernames and email addresses are profile attributes that can change.
+	`ALTER TABLE data.users ADD COLUMN IF NOT EXISTS uid TEXT NOT NULL DEFAULT gen_random_uuid()::text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_uid_idx ON data.users (uid)`,
+	`CREATE INDEX IF NOT EXISTS users_username_idx ON data.users (username)`,
+	`ALTER TABLE data.bots ADD COLUMN IF NOT EXISTS uid TEXT NOT NULL DEFAULT gen_random_uuid()::text`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS bots_uid_idx ON data.bots (uid)`,
+	`CREATE INDEX IF NOT EXISTS login_attempts_user_all_idx ON data.login_attempts (user_id, attempt_id)`,
+
+	// Rows stored before stable user IDs existed refer to users by username. The user_ids
+	// migration rewrites them to user IDs, leaving IDs and names of deleted users as they are.
+	// A value that is a user ID already is kept even if some username equals it.
+	`CREATE OR REPLACE FUNCTION data.migrated_user_id(legacy_id TEXT) RETURNS TEXT AS $$
+		SELECT coalesce(
+			(SELECT uid FROM data.users WHERE uid = legacy_id),
+			(SELECT uid FROM data.users WHERE username = legacy_id LIMIT 1),
+			(SELECT uid FROM data.bots WHERE bot_id = legacy_id),
+			legacy_id)
+	$$ LANGUAGE sql STABLE`,
+	// Direct conversation IDs hold both user IDs in byte order, like ConversationID sorts them
+	`CREATE OR REPLACE FUNCTION data.migrated_conversation_id(legacy_id TEXT) RETURNS TEXT AS $$
+		SELECT CASE WHEN legacy_id LIKE 'dm:%' THEN 'dm:' || least(a, b) || ':' || greatest(a, b)
+			ELSE legacy_id END
+		FROM (SELECT data.migrated_user_id(split_part(legacy_id, ':', 2)) COLLATE "C" AS a,
+			data.migrated_user_id(split_part(legacy_id, ':', 3)) COLLATE "C" AS b) pair
+	$$ LANGUAGE sql STABLE`,
+	`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = 'data' AND table_name = 'channel_members' AND column_name = 'username') THEN
+			ALTER TABLE data.channel_members RENAME COLUMN username TO user_id;
+		END IF;
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_schema = 'data' AND table_name = 'message_stars' AND column_name = 'username') THEN
+			ALTER TABLE data.message_stars RENAME COLUMN username TO user_id;
+		END IF;
+	END $$`,
+
+	// Devices are upserted per user and device ID at login. Rows from before device IDs were
+	// stored keep a NULL device_id and are not listed. Access tokens of a device issued before
+	// its revoked_before are rejected, refresh tokens and connection tickets are bound to it.
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS device_id TEXT`,
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS display_name TEXT`,
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS last_ip TEXT`,
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ`,
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ`,
+	`ALTER TABLE data.devices ADD COLUMN IF NOT EXISTS revoked_before TIMESTAMPTZ`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS devices_user_device_idx ON data.devices (user_id, device_id)`,
+	`ALTER TABLE data.refresh_tokens ADD COLUMN IF NOT EXISTS device_id TEXT`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_device_idx ON data.refresh_tokens (user_id, device_id)`,
+	`ALTER TABLE data.connection_tickets ADD COLUMN IF NOT EXISTS device_id TEXT`,
+	// Redeeming a ticket checks that its token was not revoked since: API keys by their ID, access
+	// tokens by their issue time
+	`ALTER TABLE data.connection_tickets ADD COLUMN IF NOT EXISTS token_id TEXT`,
+	`ALTER TABLE data.connection_tickets ADD COLUMN IF NOT EXISTS token_issued_at TIMESTAMPTZ`,
+
+	// Telemetry reported by connected devices: the latest value of each attribute, and the
+	// snapshots after each report, of which the newest are kept
+	`CREATE TABLE IF NOT EXISTS data.device_state (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		battery_level INT,
+		signal_strength INT,
+		connectivity_type TEXT,
+		location TEXT,
+		status TEXT,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, device_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS data.device_telemetry (
+		telemetry_id BIGSERIAL PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		battery_level INT,
+		signal_strength INT,
+		connectivity_type TEXT,
+		location TEXT,
+		status TEXT,
+		reported_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS device_telemetry_device_idx ON data.device_telemetry (user_id, device_id, telemetry_id)`,
+	// Locations are cleared once older than the retention, the state tracks when its own was reported
+	`ALTER TABLE data.device_state ADD COLUMN IF NOT EXISTS location_reported_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS device_telemetry_reported_idx ON data.device_telemetry (reported_at) WHERE location IS NOT NULL`,
+
+	// Data migrations that already ran, see schemaMigrations
+	`CREATE TABLE IF NOT EXISTS data.schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+// schemaMigration is a data migration that must run only once, such as a rewrite that would give
+// a different result on rows stored after it ran
+type schemaMigration struct {
+	name       string
+	statements []string
+}
+
+// schemaMigrations run in order after schemaStatements, each in a transaction that records its name
+var schemaMigrations = []schemaMigration{
+	{
+		// Rows stored before stable user IDs existed are rewritten once, rows stored later hold
+		// user IDs already and a username must never be mapped over them
+		name: "user_ids",
+		statements: []string{
+			`UPDATE data.messages SET sender_id = data.migrated_user_id(sender_id),
+				receiver_id = data.migrated_user_id(receiver_id),
+				forwarded_from = data.migrated_user_id(forwarded_from),
+				conversation_id = data.migrated_conversation_id(conversation_id)
+			WHERE sender_id IN (SELECT username FROM data.users UNION ALL SELECT bot_id FROM data.bots)
+				OR receiver_id IN (SELECT username FROM data.users UNION ALL SELECT bot_id FROM data.bots)`,
+			`UPDATE data.conversation_sequences SET conversation_id = data.migrated_conversation_id(conversation_id)
+			WHERE conversation_id LIKE 'dm:%' AND conversation_id <> data.migrated_conversation_id(conversation_id)`,
+			`UPDATE data.conversation_updates SET conversation_id = data.migrated_conversation_id(conversation_id)
+			WHERE conversation_id LIKE 'dm:%' AND conversation_id <> data.migrated_conversation_id(conversation_id)`,
+			`UPDATE data.conversation_settings SET conversation_id = data.migrated_conversation_id(conversation_id),
+				updated_by = data.migrated_user_id(updated_by)
+			WHERE conversation_id <> data.migrated_conversation_id(conversation_id) OR updated_by <> data.migrated_user_id(updated_by)`,
+			`UPDATE data.message_pins SET conversation_id = data.migrated_conversation_id(conversation_id),
+				pinned_by = data.migrated_user_id(pinned_by)
+			WHERE conversation_id <> data.migrated_conversation_id(conversation_id) OR pinned_by <> data.migrated_user_id(pinned_by)`,
+			`UPDATE data.channel_members SET user_id = data.migrated_user_id(user_id) WHERE user_id <> data.migrated_user_id(user_id)`,
+			`UPDATE data.message_stars SET user_id = data.migrated_user_id(user_id) WHERE user_id <> data.migrated_user_id(user_id)`,
+			`UPDATE data.scheduled_messages SET sender_id = data.migrated_user_id(sender_id),
+				payload = jsonb_set(jsonb_set(payload, '{sender_id}', to_jsonb(data.migrated_user_id(sender_id))),
+					'{recipient_id}', to_jsonb(data.migrated_user_id(coalesce(payload->>'recipient_id', ''))))
+			WHERE status = 'pending' AND sender_id <> data.migrated_user_id(sender_id)`,
+			`UPDATE data.attachments SET owner_id = data.migrated_user_id(owner_id) WHERE owner_id <> data.migrated_user_id(owner_id)`,
+			`UPDATE data.attachment_uploads SET owner_id = data.migrated_user_id(owner_id) WHERE owner_id <> data.migrated_user_id(owner_id)`,
+			`UPDATE data.credential_revocations SET user_id = data.migrated_user_id(user_id) WHERE user_id <> data.migrated_user_id(user_id)`,
+			`DELETE FROM data.connection_tickets WHERE user_id <> data.migrated_user_id(user_id)`,
+		},
+	},
+	{
+		// Messages stored before sequencing existed are numbered after any already sequenced ones
+		name: "messages_seq",
+		statements: []string{
+			`WITH numbered AS (
+				SELECT message_id, seq IS NULL AS missing,
+					coalesce(max(seq) OVER (PARTITION BY conversation_id), 0)
+						+ row_number() OVER (PARTITION BY conversation_id, seq IS NULL ORDER BY message_id) AS next_seq
+				FROM data.messages WHERE conversation_id IS NOT NULL
+			)
+			UPDATE data.messages m SET seq = numbered.next_seq
+			FROM numbered WHERE m.message_id = numbered.message_id AND numbered.missing`,
+			`INSERT INTO data.conversation_sequences (conversation_id, last_seq)
+			SELECT conversation_id, max(seq) FROM data.messages WHERE seq IS NOT NULL GROUP BY conversation_id
+			ON CONFLICT (conversation_id) DO UPDATE
+			SET last_seq = GREATEST(data.conversation_sequences.last_seq, EXCLUDED.last_seq)`,
+		},
+	},
+	{
+		// Members of channels before deliveries were tracked have seen the messages stored so far
+		name: "channel_members_delivered_seq",
+		statements: []string{
+			`UPDATE data.channel_members cm SET delivered_seq = coalesce((SELECT last_seq FROM data.conversation_sequences
+				WHERE conversation_id = 'channel:' || cm.channel_id), 0)
+			WHERE delivered_seq IS NULL`,
+		},
+	},
+}
+
+// MigrateSchema creates or updates the tables the server depends on.
+func MigrateSchema() error {
+	for _, statement := range schemaStatements {
+		if _, err := PostgresDB.Exec(statement); err != nil {
+			return fmt.Errorf("could not apply schema statement: %v", err)
+		}
+	}
+	for _, migration := range schemaMigrations {
+		if err := applyMigration(migration); err != nil {
+			return err
+		}
+	}
+	log.Println("Database schema is up to date.")
+	return nil
+}
+
+// applyMigration runs a data migration unless it already ran. Replicas starting at the same time
+// wait for each other on the recorded name.
+func applyMigration(migration schemaMigration) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO data.schema_migrations (name) VALUES ($1) ON CONFLICT DO NOTHING", migration.name)
+	if err != nil {
+		return fmt.Errorf("could not record migration %s: %v", migration.name, err)
+	}
+	if applied, err := result.RowsAffected(); err != nil || applied == 0 {
+		return err
+	}
+
+	for _, statement := range migration.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("could not apply migration %s: %v", migration.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit migration %s: %v", migration.name, err)
+	}
+	log.Printf("Applied migration %s\n", migration.name)
+	return nil
+}
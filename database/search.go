@@ -0,0 +1,116 @@
+package database
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// highlightStart and highlightStop delimit the hits in headlines. They are private use
+	// characters removed from the content, so the content can be escaped before the hits are
+	// wrapped in <mark> tags.
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+// highlightMarkup turns the delimiters of a headline into <mark> tags
+var highlightMarkup = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// textSearchConfigs maps message languages to the Postgres text search configuration used to index them
+var textSearchConfigs = map[string]string{
+	"ar": "arabic", "da": "danish", "de": "german", "el": "greek", "en": "english",
+	"es": "spanish", "fi": "finnish", "fr": "french", "hu": "hungarian", "id": "indonesian",
+	"it": "italian", "nl": "dutch", "no": "norwegian", "pt": "portuguese", "ro": "romanian",
+	"ru": "russian", "sv": "swedish", "tr": "turkish",
+}
+
+// TextSearchConfig returns the text search configuration for a language given as an ISO 639-1
+// code, a locale such as "en-US" or a configuration name. Unknown languages are not stemmed.
+func TextSearchConfig(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if code, _, ok := strings.Cut(strings.ReplaceAll(language, "_", "-"), "-"); ok {
+		language = code
+	}
+	if config, ok := textSearchConfigs[language]; ok {
+		return config
+	}
+	for _, config := range textSearchConfigs {
+		if config == language {
+			return config
+		}
+	}
+	return "simple"
+}
+
+// SearchMessages runs a full-text search limited to the conversations the caller belongs to.
+func SearchMessages(query *models.SearchQuery) ([]*models.SearchResult, error) {
+	args := []interface{}{
+		query.Text, TextSearchConfig(query.Language), query.UserID,
+		"StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", MaxFragments=2", highlightStart + highlightStop,
+	}
+	conditions := []string{
+		// Match with the requested configuration and without stemming so that messages indexed in
+		// another language are still found by their exact words
+		"(m.search_vector @@ websearch_to_tsquery($2::regconfig, $1) OR m.search_vector @@ websearch_to_tsquery('simple', $1))",
+		`((m.conversation_id LIKE 'dm:%' AND (m.sender_id=$3 OR m.receiver_id=$3))
+			OR m.channel_id IN (SELECT channel_id FROM data.channel_members WHERE user_id=$3))`,
+		liveMessageCondition("m"),
+	}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, "$"+strconv.Itoa(len(args))))
+	}
+
+	if query.ConversationID != "" {
+		addCondition("m.conversation_id=%s", query.ConversationID)
+	}
+	if query.SenderID != "" {
+		addCondition("m.sender_id=%s", query.SenderID)
+	}
+	if query.From != "" {
+		addCondition("m.created_at >= %s::timestamptz", query.From)
+	}
+	if query.To != "" {
+		addCondition("m.created_at < %s::timestamptz", query.To)
+	}
+	if query.HasAttachment {
+		conditions = append(conditions, "(m.attachment_id IS NOT NULL OR coalesce(m.attachment_url, '') <> '')")
+	}
+	if len(query.Tags) > 0 {
+		addCondition("m.tags @> %s", pq.Array(query.Tags))
+	}
+
+	args = append(args, query.Limit, query.Offset)
+	statement := `SELECT ` + prefixedMessageColumns("m") + `,
+			ts_headline(m.search_config, translate(coalesce(m.content, ''), $5, ''), websearch_to_tsquery(m.search_config, $1), $4),
+			ts_rank(m.search_vector, websearch_to_tsquery(m.search_config, $1))
+		FROM data.messages m
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ts_rank(m.search_vector, websearch_to_tsquery(m.search_config, $1)) DESC, m.message_id DESC
+		LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+
+	rows, err := PostgresDB.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not search messages: %v", err)
+	}
+	defer rows.Close()
+
+	results := []*models.SearchResult{}
+	for rows.Next() {
+		var result models.SearchResult
+		msg, err := scanMessage(rows, &result.Highlight, &result.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("could not read search result: %v", err)
+		}
+		// The content is user input, only the hit markers may become markup
+		result.Highlight = highlightMarkup.Replace(html.EscapeString(result.Highlight))
+		result.Message = msg
+		results = append(results, &result)
+	}
+	return results, rows.Err()
+}
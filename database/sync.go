@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// userConversationCondition limits rows of a table with a conversation_id column to the
+// conversations the user given as $1 belongs to
+const userConversationCondition = `((conversation_id LIKE 'dm:%'
+		AND $1 = ANY(string_to_array(substr(conversation_id, 4), ':')))
+	OR conversation_id IN (SELECT 'channel:' || channel_id FROM data.channel_members WHERE user_id=$1))`
+
+// RecordConversationUpdate appends a change to a conversation's update log and returns the event
+// with its sequence number and timestamp set.
+func RecordConversationUpdate(conversationID, eventType string, payload interface{}) (*models.Event, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode conversation update: %v", err)
+	}
+
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	seq, err := nextConversationSeq(tx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	var createdAt time.Time
+	err = tx.QueryRow(
+		`INSERT INTO data.conversation_updates (conversation_id, seq, event_type, payload, created_at)
+		VALUES ($1, $2, $3, $4, clock_timestamp()) RETURNING created_at`,
+		conversationID, seq, eventType, encoded,
+	).Scan(&createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("could not save conversation update: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit conversation update: %v", err)
+	}
+
+	return &models.Event{
+		Type:           eventType,
+		Payload:        payload,
+		ConversationID: conversationID,
+		Seq:            seq,
+		Timestamp:      createdAt.UTC().Format(models.TimestampFormat),
+	}, nil
+}
+
+// redactMessageUpdates strips the updates of the given conversations whose payload is one of the
+// given messages down to the message ID, so that deleted content is not replayed from the log
+func redactMessageUpdates(tx *sql.Tx, conversationIDs, messageIDs []string) error {
+	_, err := tx.Exec(
+		`UPDATE data.conversation_updates
+		SET payload = jsonb_build_object('id', payload->'id', 'conversation_id', payload->'conversation_id',
+			'sender_id', payload->'sender_id', 'deleted', true)
+		WHERE conversation_id = ANY($1) AND payload ? 'sender_id' AND payload->>'id' = ANY($2)`,
+		pq.Array(conversationIDs), pq.Array(messageIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("could not redact updates of deleted messages: %v", err)
+	}
+	return nil
+}
+
+// scanConversationUpdate reads a row of data.conversation_updates into an event with a raw JSON payload
+func scanConversationUpdate(row rowScanner) (*models.Event, error) {
+	var event models.Event
+	var payload []byte
+	var createdAt time.Time
+	if err := row.Scan(&event.ConversationID, &event.Seq, &event.Type, &payload, &createdAt); err != nil {
+		return nil, err
+	}
+	event.Payload = json.RawMessage(payload)
+	event.Timestamp = createdAt.UTC().Format(models.TimestampFormat)
+	return &event, nil
+}
+
+// listConversationUpdates runs a query selecting conversation updates
+func listConversationUpdates(query string, args ...interface{}) ([]*models.Event, error) {
+	rows, err := PostgresDB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list conversation updates: %v", err)
+	}
+	defer rows.Close()
+
+	updates := []*models.Event{}
+	for rows.Next() {
+		update, err := scanConversationUpdate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read conversation update: %v", err)
+		}
+		updates = append(updates, update)
+	}
+	return updates, rows.Err()
+}
+
+// ListConversationUpdates returns up to limit updates of a conversation with a sequence number
+// greater than afterSeq, in sequence order.
+func ListConversationUpdates(conversationID string, afterSeq int64, limit int) ([]*models.Event, error) {
+	return listConversationUpdates(
+		`SELECT conversation_id, seq, event_type, payload, created_at FROM data.conversation_updates
+		WHERE conversation_id=$1 AND seq > $2 ORDER BY seq LIMIT $3`,
+		conversationID, afterSeq, limit,
+	)
+}
+
+// ListUserUpdatesSince returns up to limit updates stored at or after since in the conversations
+// a user belongs to, oldest first.
+func ListUserUpdatesSince(userID string, since time.Time, limit int) ([]*models.Event, error) {
+	return listConversationUpdates(
+		`SELECT conversation_id, seq, event_type, payload, created_at FROM data.conversation_updates
+		WHERE `+userConversationCondition+` AND created_at >= $2 ORDER BY created_at, seq LIMIT $3`,
+		userID, since, limit,
+	)
+}
+
+// ListUserMessagesSince returns up to limit messages stored at or after since in the conversations
+// a user belongs to, oldest first.
+func ListUserMessagesSince(userID string, since time.Time, limit int) ([]*models.Message, error) {
+	rows, err := PostgresDB.Query(
+		"SELECT "+messageColumns+` FROM data.messages m
+		WHERE `+userConversationCondition+` AND created_at >= $2 AND `+liveMessageCondition("m")+`
+		ORDER BY created_at, seq LIMIT $3`,
+		userID, since, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read message: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// GetPrunedSeq returns the highest sequence number of a conversation whose update was pruned.
+// Clients that have not seen it can no longer be brought up to date by replaying.
+func GetPrunedSeq(conversationID string) (int64, error) {
+	var seq int64
+	err := PostgresDB.QueryRow(
+		"SELECT pruned_seq FROM data.conversation_sequences WHERE conversation_id=$1", conversationID,
+	).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("could not load conversation sequence: %v", err)
+	}
+	return seq, nil
+}
+
+// PruneConversationUpdates deletes updates stored before the given time and remembers the highest
+// pruned sequence number of each conversation. It returns the number of deleted updates.
+func PruneConversationUpdates(before time.Time) (int64, error) {
+	var deleted int64
+	err := PostgresDB.QueryRow(
+		`WITH pruned AS (
+			DELETE FROM data.conversation_updates WHERE created_at < $1 RETURNING conversation_id, seq
+		), latest AS (
+			SELECT conversation_id, max(seq) AS seq, count(*) AS deleted FROM pruned GROUP BY conversation_id
+		), marked AS (
+			UPDATE data.conversation_sequences s SET pruned_seq = GREATEST(s.pruned_seq, latest.seq)
+			FROM latest WHERE s.conversation_id = latest.conversation_id
+		)
+		SELECT coalesce(sum(deleted), 0) FROM latest`,
+		before,
+	).Scan(&deleted)
+	if err != nil {
+		return 0, fmt.Errorf("could not prune conversation updates: %v", err)
+	}
+	return deleted, nil
+}
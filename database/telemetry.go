@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"websocket-server/models"
+)
+
+// telemetryColumns is the column list understood by scanTelemetry, in data.device_state and
+// data.device_telemetry alike
+const telemetryColumns = "battery_level, signal_strength, connectivity_type, location, status"
+
+// scanTelemetry reads a row selected with telemetryColumns and the time of the snapshot into a
+// DeviceTelemetry. Columns selected after those are scanned into extra.
+func scanTelemetry(row rowScanner, extra ...interface{}) (*models.DeviceTelemetry, error) {
+	var batteryLevel, signalStrength sql.NullInt64
+	var connectivityType, location, status sql.NullString
+	var reportedAt time.Time
+	dest := []interface{}{&batteryLevel, &signalStrength, &connectivityType, &location, &status, &reportedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	telemetry := &models.DeviceTelemetry{ReportedAt: reportedAt.UTC().Format(time.RFC3339)}
+	if batteryLevel.Valid {
+		value := int(batteryLevel.Int64)
+		telemetry.BatteryLevel = &value
+	}
+	if signalStrength.Valid {
+		value := int(signalStrength.Int64)
+		telemetry.SignalStrength = &value
+	}
+	if connectivityType.Valid {
+		telemetry.ConnectivityType = &connectivityType.String
+	}
+	if location.Valid {
+		telemetry.Location = &location.String
+	}
+	if status.Valid {
+		telemetry.Status = &status.String
+	}
+	return telemetry, nil
+}
+
+// RecordTelemetry merges a report into the latest state of a user's device, adds the resulting
+// snapshot to the device's history and drops all but the newest historySize snapshots
+func RecordTelemetry(userID, deviceID string, report *models.DeviceTelemetry, historySize int) error {
+	// The statements of the CTEs see the history as it was before the new snapshot, of which
+	// historySize-1 are kept
+	_, err := PostgresDB.Exec(
+		`WITH state AS (
+			INSERT INTO data.device_state AS s (user_id, device_id, `+telemetryColumns+`, location_reported_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $6::text IS NULL THEN NULL ELSE now() END)
+			ON CONFLICT (user_id, device_id) DO UPDATE SET
+				battery_level=coalesce(EXCLUDED.battery_level, s.battery_level),
+				signal_strength=coalesce(EXCLUDED.signal_strength, s.signal_strength),
+				connectivity_type=coalesce(EXCLUDED.connectivity_type, s.connectivity_type),
+				location=coalesce(EXCLUDED.location, s.location),
+				location_reported_at=coalesce(EXCLUDED.location_reported_at, s.location_reported_at),
+				status=coalesce(EXCLUDED.status, s.status),
+				updated_at=now()
+			RETURNING user_id, device_id, `+telemetryColumns+`, updated_at
+		), snapshot AS (
+			INSERT INTO data.device_telemetry (user_id, device_id, `+telemetryColumns+`, reported_at)
+			SELECT user_id, device_id, `+telemetryColumns+`, updated_at FROM state
+		)
+		DELETE FROM data.device_telemetry WHERE user_id=$1 AND device_id=$2 AND telemetry_id <= (
+			SELECT telemetry_id FROM data.device_telemetry WHERE user_id=$1 AND device_id=$2
+			ORDER BY telemetry_id DESC OFFSET $8 LIMIT 1
+		)`,
+		userID, deviceID, report.BatteryLevel, report.SignalStrength, report.ConnectivityType, report.Location, report.Status,
+		historySize-1,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save device telemetry: %v", err)
+	}
+	return nil
+}
+
+// ClearStaleLocations clears the locations reported before a point in time from the state and
+// history of every device, and returns how many rows held one
+func ClearStaleLocations(before time.Time) (int64, error) {
+	var cleared int64
+	err := PostgresDB.QueryRow(
+		`WITH state AS (
+			UPDATE data.device_state SET location=NULL, location_reported_at=NULL
+			WHERE location IS NOT NULL AND coalesce(location_reported_at, updated_at) < $1
+			RETURNING 1
+		), history AS (
+			UPDATE data.device_telemetry SET location=NULL
+			WHERE location IS NOT NULL AND reported_at < $1
+			RETURNING 1
+		)
+		SELECT (SELECT count(*) FROM state) + (SELECT count(*) FROM history)`,
+		before,
+	).Scan(&cleared)
+	if err != nil {
+		return 0, fmt.Errorf("could not clear stale locations: %v", err)
+	}
+	return cleared, nil
+}
+
+// ListDeviceStates returns the latest telemetry of every device of a user that reported any,
+// most recently updated first
+func ListDeviceStates(userID string) ([]*models.DeviceState, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT s.battery_level, s.signal_strength, s.connectivity_type, s.location, s.status, s.updated_at,
+			s.device_id, coalesce(d.display_name, d.name, '')
+		FROM data.device_state s
+		LEFT JOIN data.users u ON u.uid = s.user_id
+		LEFT JOIN data.devices d ON d.user_id = u.user_id AND d.device_id = s.device_id
+		WHERE s.user_id=$1
+		ORDER BY s.updated_at DESC, s.device_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list device states: %v", err)
+	}
+	defer rows.Close()
+
+	states := []*models.DeviceState{}
+	for rows.Next() {
+		var state models.DeviceState
+		telemetry, err := scanTelemetry(rows, &state.DeviceID, &state.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read device state: %v", err)
+		}
+		state.DeviceTelemetry = *telemetry
+		states = append(states, &state)
+	}
+	return states, rows.Err()
+}
+
+// ListTelemetryHistory returns the snapshots kept for a user's device, newest first
+func ListTelemetryHistory(userID, deviceID string, limit int) ([]*models.DeviceTelemetry, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT `+telemetryColumns+`, reported_at FROM data.device_telemetry
+		WHERE user_id=$1 AND device_id=$2 ORDER BY telemetry_id DESC LIMIT $3`,
+		userID, deviceID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not list device telemetry: %v", err)
+	}
+	defer rows.Close()
+
+	history := []*models.DeviceTelemetry{}
+	for rows.Next() {
+		telemetry, err := scanTelemetry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read device telemetry: %v", err)
+		}
+		history = append(history, telemetry)
+	}
+	return history, rows.Err()
+}
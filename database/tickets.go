@@ -0,0 +1,48 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CreateConnectionTicket stores the hash of a single-use WebSocket connection ticket together with
+// the device, ID, issue time, expiry and scopes of the token it was issued for, and drops expired
+// tickets.
+func CreateConnectionTicket(ticketHash, userID, deviceID, tokenID string, expiresAt, tokenIssuedAt, tokenExpiresAt time.Time, scopes []string) error {
+	if _, err := PostgresDB.Exec("DELETE FROM data.connection_tickets WHERE expires_at <= now()"); err != nil {
+		return fmt.Errorf("could not delete expired connection tickets: %v", err)
+	}
+	_, err := PostgresDB.Exec(
+		`INSERT INTO data.connection_tickets (ticket_hash, user_id, device_id, token_id, expires_at, token_issued_at,
+			token_expires_at, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		ticketHash, userID, deviceID, tokenID, expiresAt, tokenIssuedAt, tokenExpiresAt, pq.Array(scopes),
+	)
+	if err != nil {
+		return fmt.Errorf("could not save connection ticket: %v", err)
+	}
+	return nil
+}
+
+// ConsumeConnectionTicket deletes an unexpired ticket and returns the user and device it was issued
+// to and the ID, issue time, expiry and scopes of their token. The issue time is zero for tickets
+// stored without one. It returns sql.ErrNoRows if the ticket is unknown, expired or already used.
+func ConsumeConnectionTicket(ticketHash string) (string, string, string, time.Time, time.Time, []string, error) {
+	var userID string
+	var deviceID, tokenID sql.NullString
+	var tokenIssuedAt sql.NullTime
+	var tokenExpiresAt time.Time
+	var scopes []string
+	err := PostgresDB.QueryRow(
+		`DELETE FROM data.connection_tickets WHERE ticket_hash=$1 AND expires_at > now() AND token_expires_at IS NOT NULL
+		RETURNING user_id, device_id, token_id, token_issued_at, token_expires_at, scopes`,
+		ticketHash,
+	).Scan(&userID, &deviceID, &tokenID, &tokenIssuedAt, &tokenExpiresAt, pq.Array(&scopes))
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", "", time.Time{}, time.Time{}, nil, fmt.Errorf("could not redeem connection ticket: %v", err)
+	}
+	return userID, deviceID.String, tokenID.String, tokenIssuedAt.Time, tokenExpiresAt, scopes, err
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"websocket-server/models"
+
+	"github.com/lib/pq"
+)
+
+// accountColumns is the column list understood by scanAccount
+const accountColumns = "user_id, uid, username, email"
+
+// scanAccount reads a data.users row selected with accountColumns
+func scanAccount(row rowScanner) (*models.Account, error) {
+	var account models.Account
+	if err := row.Scan(&account.ID, &account.UserID, &account.Username, &account.Email); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// GetAccount returns the account of a user ID. It returns sql.ErrNoRows if there is none.
+func GetAccount(userID string) (*models.Account, error) {
+	account, err := scanAccount(PostgresDB.QueryRow("SELECT "+accountColumns+" FROM data.users WHERE uid=$1", userID))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("could not load user: %v", err)
+	}
+	return account, err
+}
+
+// UserIDExists reports whether a user or bot account has the given user ID
+func UserIDExists(userID string) (bool, error) {
+	var exists bool
+	err := PostgresDB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM data.users WHERE uid=$1) OR EXISTS (SELECT 1 FROM data.bots WHERE uid=$1)`,
+		userID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check user: %v", err)
+	}
+	return exists, nil
+}
+
+// GetAccountByName returns the account of a username. It returns sql.ErrNoRows if there is none.
+func GetAccountByName(username string) (*models.Account, error) {
+	account, err := scanAccount(PostgresDB.QueryRow("SELECT "+accountColumns+" FROM data.users WHERE username=$1", username))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("could not load user: %v", err)
+	}
+	return account, err
+}
+
+// GetUserByID returns the account with a numeric user_id
+func GetUserByID(id int) (*models.Account, error) {
+	account, err := scanAccount(PostgresDB.QueryRow("SELECT "+accountColumns+" FROM data.users WHERE user_id=$1", id))
+	if err != nil {
+		return nil, fmt.Errorf("could not load user: %v", err)
+	}
+	return account, nil
+}
+
+// LookupUsers returns the profiles of the users and bots with any of the given user IDs or usernames
+func LookupUsers(userIDs, usernames []string) ([]*models.UserProfile, error) {
+	rows, err := PostgresDB.Query(
+		`SELECT uid, username, false FROM data.users WHERE uid = ANY($1) OR username = ANY($2)
+		UNION ALL
+		SELECT uid, bot_id, true FROM data.bots WHERE uid = ANY($1) OR bot_id = ANY($2)
+		ORDER BY 2`,
+		pq.Array(userIDs), pq.Array(usernames),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up users: %v", err)
+	}
+	defer rows.Close()
+
+	profiles := []*models.UserProfile{}
+	for rows.Next() {
+		var profile models.UserProfile
+		if err := rows.Scan(&profile.UserID, &profile.Username, &profile.Bot); err != nil {
+			return nil, fmt.Errorf("could not read user: %v", err)
+		}
+		profiles = append(profiles, &profile)
+	}
+	return profiles, rows.Err()
+}
+
+// RenameUser changes the username of a user. It returns false if the name is taken by another
+// user or a bot, or is the user ID of one.
+func RenameUser(userID, username string) (bool, error) {
+	result, err := PostgresDB.Exec(
+		`UPDATE data.users SET username=$2 WHERE uid=$1
+		AND NOT EXISTS (SELECT 1 FROM data.users WHERE (lower(username)=lower($2) AND uid<>$1) OR lower(uid)=lower($2))
+		AND NOT EXISTS (SELECT 1 FROM data.bots WHERE bot_id=$2 OR lower(uid)=lower($2))`,
+		userID, username,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not rename user: %v", err)
+	}
+	renamed, _ := result.RowsAffected()
+	return renamed > 0, nil
+}
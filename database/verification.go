@@ -0,0 +1,145 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CreateEmailVerification marks a user's email address unverified and stores the hash of a
+// verification token for it.
+func CreateEmailVerification(userID int, email, tokenHash string, expiresAt time.Time) error {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO data.email_verification_status (user_id, email) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET email=$2, verified_at=NULL
+		WHERE data.email_verification_status.email <> $2`,
+		userID, email,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save verification status: %v", err)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO data.email_verification_tokens (token_hash, user_id, email, expires_at) VALUES ($1, $2, $3, $4)",
+		tokenHash, userID, email, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not save verification token: %v", err)
+	}
+	return tx.Commit()
+}
+
+// ConsumeEmailVerification deletes an unexpired verification token and marks the address it was
+// issued for verified. It returns sql.ErrNoRows if the token is unknown, expired or already used.
+func ConsumeEmailVerification(tokenHash string) (int, error) {
+	tx, err := PostgresDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRow(
+		`DELETE FROM data.email_verification_tokens WHERE token_hash=$1 AND expires_at > now()
+		RETURNING user_id, email`,
+		tokenHash,
+	).Scan(&userID, &email)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			err = fmt.Errorf("could not redeem verification token: %v", err)
+		}
+		return 0, err
+	}
+
+	// A token for an address the user has since replaced verifies nothing
+	result, err := tx.Exec(
+		`UPDATE data.email_verification_status SET verified_at=coalesce(verified_at, now())
+		WHERE user_id=$1 AND email=$2`,
+		userID, email,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not mark email verified: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return 0, sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM data.email_verification_tokens WHERE user_id=$1 AND email=$2", userID, email); err != nil {
+		return 0, fmt.Errorf("could not delete verification tokens: %v", err)
+	}
+	return userID, tx.Commit()
+}
+
+// GetPendingVerification returns the numeric ID and unverified email address of a user. It returns
+// sql.ErrNoRows if the user has no address waiting for verification.
+func GetPendingVerification(userID string) (int, string, error) {
+	var id int
+	var email string
+	err := PostgresDB.QueryRow(
+		`SELECT v.user_id, v.email FROM data.email_verification_status v
+		JOIN data.users u ON u.user_id = v.user_id
+		WHERE u.uid=$1 AND v.verified_at IS NULL`,
+		userID,
+	).Scan(&id, &email)
+	return id, email, err
+}
+
+// IsEmailUnverified reports whether a user has an email address waiting for verification.
+// Accounts created before verification existed have no status and count as verified.
+func IsEmailUnverified(userID string) (bool, error) {
+	_, _, err := GetPendingVerification(userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not load verification status: %v", err)
+	}
+	return true, nil
+}
+
+// IsEmailVerified reports whether a user's address is the given one and was verified. Accounts
+// created before verification existed have no status and count as verified.
+func IsEmailVerified(userID int, email string) (bool, error) {
+	var verified bool
+	err := PostgresDB.QueryRow(
+		`SELECT NOT EXISTS (
+			SELECT 1 FROM data.email_verification_status
+			WHERE user_id=$1 AND (verified_at IS NULL OR lower(email) <> lower($2))
+		)`,
+		userID, email,
+	).Scan(&verified)
+	if err != nil {
+		return false, fmt.Errorf("could not load verification status: %v", err)
+	}
+	return verified, nil
+}
+
+// HasReceivedMessageFrom reports whether a user ever received a direct message from another user.
+func HasReceivedMessageFrom(userID, senderID string) (bool, error) {
+	var received bool
+	err := PostgresDB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM data.messages WHERE receiver_id=$1 AND sender_id=$2)", userID, senderID,
+	).Scan(&received)
+	if err != nil {
+		return false, fmt.Errorf("could not check conversation history: %v", err)
+	}
+	return received, nil
+}
+
+// MarkEmailVerified marks a user's address verified without a token, such as when an identity
+// provider vouches for it
+func MarkEmailVerified(userID int, email string) error {
+	_, err := PostgresDB.Exec(
+		`UPDATE data.email_verification_status SET verified_at=coalesce(verified_at, now())
+		WHERE user_id=$1 AND lower(email)=lower($2)`,
+		userID, email,
+	)
+	if err != nil {
+		return fmt.Errorf("could not mark email verified: %v", err)
+	}
+	return nil
+}
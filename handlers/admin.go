@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// RolesHandler returns the roles of a user. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func RolesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	s := services.NewRoleService()
+	roles, err := s.ListRoles(userID)
+	if err != nil {
+		writeServiceError(w, err, "load roles")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "roles": roles})
+}
+
+// GrantRoleHandler grants a role to a user. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func GrantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	handleRoleChange(w, r, "grant role", services.NewRoleService().GrantRole)
+}
+
+// RevokeRoleHandler takes a role away from a user. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func RevokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	handleRoleChange(w, r, "revoke role", services.NewRoleService().RevokeRole)
+}
+
+// handleRoleChange decodes a role request and applies it on behalf of the calling admin
+func handleRoleChange(w http.ResponseWriter, r *http.Request, action string, change func(adminID, userID, role string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request models.RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := change(requestClaims(r).UserID(), request.UserID, request.Role); err != nil {
+		writeServiceError(w, err, action)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BroadcastHandler sends an announcement to every connected user. Wrapped with
+// RequireScope(utils.ScopeBroadcast).
+func BroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request models.BroadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewModerationService()
+	recipients, err := s.Broadcast(requestClaims(r).UserID(), request.Content)
+	if err != nil {
+		writeServiceError(w, err, "broadcast")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"recipients": recipients})
+}
+
+// ModerateDeleteHandler deletes any user's message. Wrapped with RequireScope(utils.ScopeModerate).
+func ModerateDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request models.MessageActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewModerationService()
+	msg, err := s.DeleteMessage(requestClaims(r).UserID(), request.MessageID)
+	if err != nil {
+		writeServiceError(w, err, "delete message")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// maxChunkSize caps the body of a single resumable upload chunk
+const maxChunkSize = 16 << 20
+
+// UploadAttachmentHandler accepts a multipart upload with the file in the "file" field
+func UploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, services.MaxAttachmentSize+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart upload", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Missing file field", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid multipart upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		s := services.NewAttachmentService()
+		attachment, err := s.Upload(userID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			writeServiceError(w, err, "upload attachment")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, attachment)
+		return
+	}
+}
+
+// UploadsHandler starts a resumable upload (POST) or reports its progress (GET)
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewAttachmentService()
+	switch r.Method {
+	case http.MethodPost:
+		var request models.UploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		upload, err := s.StartUpload(userID, &request)
+		if err != nil {
+			writeServiceError(w, err, "start upload")
+			return
+		}
+		writeJSON(w, http.StatusCreated, upload)
+
+	case http.MethodGet:
+		upload, err := s.UploadStatus(userID, r.URL.Query().Get("upload_id"))
+		if err != nil {
+			writeServiceError(w, err, "load upload")
+			return
+		}
+		writeJSON(w, http.StatusOK, upload)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// UploadChunkHandler appends the request body to a resumable upload at the given offset
+func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxChunkSize)
+	s := services.NewAttachmentService()
+	upload, err := s.AppendChunk(userID, query.Get("upload_id"), offset, r.Body)
+	if err != nil {
+		writeServiceError(w, err, "store chunk")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, upload)
+}
+
+// CompleteUploadHandler finalizes a resumable upload into an attachment
+func CompleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.UploadCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewAttachmentService()
+	attachment, err := s.CompleteUpload(userID, request.UploadID)
+	if err != nil {
+		writeServiceError(w, err, "complete upload")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, attachment)
+}
+
+// DownloadAttachmentHandler serves an attachment through a signed, time-limited URL
+func DownloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	s := services.NewAttachmentService()
+	attachment, content, err := s.Open(query.Get("id"), query.Get("size"), query.Get("expires"), query.Get("sig"))
+	if err != nil {
+		writeServiceError(w, err, "download attachment")
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	if attachment.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.FileName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, content)
+}
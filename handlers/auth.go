@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"websocket-server/services"
+	"websocket-server/utils"
+)
+
+// authenticateRequest validates the bearer token of a REST request and returns the user ID
+func authenticateRequest(r *http.Request) (string, error) {
+	claims, err := authenticateClaims(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.UserID(), nil
+}
+
+// authenticateClaims validates the bearer token of a request and returns its claims, or returns
+// the claims RequireScope already validated
+func authenticateClaims(r *http.Request) (*utils.Claims, error) {
+	if claims := requestClaims(r); claims != nil {
+		return claims, nil
+	}
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	return parseToken(token)
+}
+
+// claimsKey is the request context key of the claims stored by RequireScope
+type claimsKey struct{}
+
+// RequireScope wraps a handler that may only be called with a token granting scope. The handler
+// reads the caller's claims with requestClaims, authenticateRequest and authenticateClaims.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := authenticateClaims(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !claims.HasScope(scope) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+// requestClaims returns the claims RequireScope authenticated the request with
+func requestClaims(r *http.Request) *utils.Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(*utils.Claims)
+	return claims
+}
+
+// parseToken validates an access token, rejecting tokens revoked by a password change, or a bot's API key
+func parseToken(token string) (*utils.Claims, error) {
+	return services.AuthenticateToken(token)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// BotsHandler lists bot accounts on GET and creates one on POST. Wrapped with
+// RequireScope(utils.ScopeUserAdmin).
+func BotsHandler(w http.ResponseWriter, r *http.Request) {
+	s := services.NewBotService()
+	switch r.Method {
+	case http.MethodGet:
+		bots, err := s.ListBots()
+		if err != nil {
+			writeServiceError(w, err, "list bots")
+			return
+		}
+		writeJSON(w, http.StatusOK, bots)
+	case http.MethodPost:
+		var request models.CreateBotRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		bot, err := s.CreateBot(requestClaims(r).UserID(), &request)
+		if err != nil {
+			writeServiceError(w, err, "create bot")
+			return
+		}
+		writeJSON(w, http.StatusCreated, bot)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// APIKeysHandler lists the keys of the bot given by bot_id on GET and issues a key on POST. The
+// full key is only returned on creation. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	s := services.NewBotService()
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := s.ListAPIKeys(r.URL.Query().Get("bot_id"))
+		if err != nil {
+			writeServiceError(w, err, "list API keys")
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+	case http.MethodPost:
+		var request models.CreateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		key, err := s.CreateAPIKey(requestClaims(r).UserID(), &request)
+		if err != nil {
+			writeServiceError(w, err, "create API key")
+			return
+		}
+		writeJSON(w, http.StatusCreated, key)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// RotateAPIKeyHandler replaces a key with a new one, the old key keeps working for a grace
+// period. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func RotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAPIKeyAction(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := services.NewBotService().RotateAPIKey(requestClaims(r).UserID(), request.KeyID)
+	if err != nil {
+		writeServiceError(w, err, "rotate API key")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, key)
+}
+
+// RevokeAPIKeyHandler disables a key at once. Wrapped with RequireScope(utils.ScopeUserAdmin).
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAPIKeyAction(w, r)
+	if !ok {
+		return
+	}
+
+	if err := services.NewBotService().RevokeAPIKey(requestClaims(r).UserID(), request.KeyID); err != nil {
+		writeServiceError(w, err, "revoke API key")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAPIKeyAction checks the method and decodes the body of a request acting on a key
+func decodeAPIKeyAction(w http.ResponseWriter, r *http.Request) (*models.APIKeyActionRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var request models.APIKeyActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return nil, false
+	}
+	return &request, true
+}
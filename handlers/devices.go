@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// DevicesHandler lists the devices the caller signed in from, with when and where they were last seen
+func DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := authenticateClaims(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewDeviceService()
+	devices, err := s.ListDevices(claims.UserID(), claims.DeviceID)
+	if err != nil {
+		writeServiceError(w, err, "list devices")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"devices": devices})
+}
+
+// RenameDeviceHandler sets the name one of the caller's devices is shown with
+func RenameDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.RenameDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := services.NewDeviceService().RenameDevice(userID, &request); err != nil {
+		writeServiceError(w, err, "rename device")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SignOutDeviceHandler signs one of the caller's devices out, revoking its tokens and closing its connection
+func SignOutDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.SignOutDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := services.NewDeviceService().SignOutDevice(userID, request.DeviceID); err != nil {
+		writeServiceError(w, err, "sign out device")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeviceStatesHandler returns the latest telemetry of the caller's devices
+func DeviceStatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeDeviceStates(w, userID)
+}
+
+// AdminDeviceStatesHandler returns the latest telemetry of the devices of the user in ?user_id=.
+// Wrapped with RequireScope(utils.ScopeUserAdmin).
+func AdminDeviceStatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeDeviceStates(w, r.URL.Query().Get("user_id"))
+}
+
+// writeDeviceStates responds with the latest telemetry of a user's devices
+func writeDeviceStates(w http.ResponseWriter, userID string) {
+	s := services.NewDeviceService()
+	states, err := s.DeviceStates(userID)
+	if err != nil {
+		writeServiceError(w, err, "load device states")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": userID, "devices": states})
+}
+
+// TelemetryHistoryHandler returns the telemetry snapshots kept for the caller's device in ?device_id=
+func TelemetryHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	s := services.NewDeviceService()
+	history, err := s.TelemetryHistory(userID, deviceID)
+	if err != nil {
+		writeServiceError(w, err, "load device telemetry")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"device_id": deviceID, "telemetry": history})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// MarkReadHandler marks a received message as read, starting its lifetime if it self-destructs after reading
+func MarkReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, messageID, ok := decodeMessageAction(w, r)
+	if !ok {
+		return
+	}
+
+	s := services.NewEphemeralService()
+	msg, err := s.MarkRead(userID, messageID)
+	if err != nil {
+		writeServiceError(w, err, "mark message read")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// ConversationTTLHandler sets the default lifetime of new messages in a conversation
+func ConversationTTLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.ConversationTTLRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ConversationID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewEphemeralService()
+	if err := s.SetConversationTTL(userID, &request); err != nil {
+		writeServiceError(w, err, "update conversation")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, request)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// ForwardHandler forwards an existing message into one or more conversations
+func ForwardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.ForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.MessageID == "" {
+		http.Error(w, "message_id is required", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewForwardService()
+	forwarded, err := s.Forward(userID, &request)
+	if err != nil {
+		writeServiceError(w, err, "forward message")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"messages": forwarded})
+}
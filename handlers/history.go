@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"websocket-server/services"
+)
+
+// ConversationMessagesHandler returns the messages and updates of a conversation after a sequence number
+func ConversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	conversationID := params.Get("conversation_id")
+	if conversationID == "" {
+		http.Error(w, "conversation_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var afterSeq int64
+	if value := params.Get("after_seq"); value != "" {
+		if afterSeq, err = strconv.ParseInt(value, 10, 64); err != nil || afterSeq < 0 {
+			http.Error(w, "Invalid after_seq", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewHistoryService()
+	page, err := s.GetMessagesAfter(userID, conversationID, afterSeq, limit)
+	if err != nil {
+		writeServiceError(w, err, "load messages")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
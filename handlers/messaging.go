@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"websocket-server/connections"
 	"websocket-server/models"
 	"websocket-server/services"
@@ -14,33 +16,106 @@ import (
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: utils.CheckOrigin,
+}
+
+// bearerSubprotocol is the WebSocket subprotocol browsers offer together with their access token,
+// as in new WebSocket(url, ["bearer", token]). The server only ever selects "bearer".
+const bearerSubprotocol = "bearer"
+
+// webSocketCredentials is the outcome of authenticating a WebSocket handshake
+type webSocketCredentials struct {
+	claims *utils.Claims // The token's expiry closes the connection, its scopes limit the frames
+	header http.Header   // Response headers to upgrade with
+}
+
+// authenticateWebSocket resolves the user of a WebSocket handshake. The credential is taken, in
+// order, from the Authorization header, the bearer subprotocol, a single-use ticket or the
+// deprecated token query parameter.
+func authenticateWebSocket(r *http.Request) (*webSocketCredentials, error) {
+	fromToken := func(token string, header http.Header) (*webSocketCredentials, error) {
+		claims, err := parseToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return &webSocketCredentials{claims, header}, nil
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return nil, errors.New("missing bearer token")
+		}
+		return fromToken(token, nil)
+	}
+
+	if protocols := websocket.Subprotocols(r); len(protocols) == 2 && protocols[0] == bearerSubprotocol {
+		return fromToken(protocols[1], http.Header{"Sec-WebSocket-Protocol": {bearerSubprotocol}})
+	}
+
+	params := r.URL.Query()
+	if ticket := params.Get("ticket"); ticket != "" {
+		claims, err := services.NewTicketService().RedeemTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+		return &webSocketCredentials{claims: claims}, nil
+	}
+
+	// Query tokens end up in proxy and access logs, new clients should use one of the above
+	if token := params.Get("token"); token != "" {
+		return fromToken(token, nil)
+	}
+	return nil, errors.New("missing credentials")
 }
 
 func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if err := services.CheckRateLimit(services.PolicyConnectionIP, utils.ClientIP(r)); err != nil {
+		writeServiceError(w, err, "connect")
 		return
 	}
 
-	userID, err := utils.ValidateToken(token)
+	credentials, err := authenticateWebSocket(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	claims := credentials.claims
+	userID := claims.UserID()
+	if err := services.CheckRateLimit(services.PolicyConnectionUser, userID); err != nil {
+		writeServiceError(w, err, "connect")
+		return
+	}
+
+	resume, err := parseResumeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, credentials.header)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v\n", err)
 		return
 	}
 	defer conn.Close()
 
-	connections.AddConnection(userID, token, conn)
-	defer connections.RemoveConnection(userID, token)
+	connection := connections.AddConnection(userID, claims.DeviceID, conn)
+	defer connections.RemoveConnection(userID, connection)
+	services.WatchTokenExpiry(connection, claims.ExpiresAt.Time)
+
+	devices := services.NewDeviceService()
+	devices.TouchDevice(userID, claims.DeviceID, utils.ClientIP(r))
+	defer devices.TouchDevice(userID, claims.DeviceID, "")
 
 	log.Printf("User %s connected\n", userID)
+	// A resume only replays what the client asked for, messages of the conversations it did not
+	// list follow from the backlog
+	if resume != nil {
+		services.ResumeSession(userID, connection, resume)
+	}
+	services.DeliverBacklog(userID)
+	connection.Start()
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -49,8 +124,88 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		services.HandleMessage(userID, message)
+		claims = dispatchFrame(connection, claims, message)
+	}
+}
+
+// dispatchFrame handles a client frame if the connection's token grants the scope its type
+// requires, and returns the claims that apply to the following frames
+func dispatchFrame(connection *connections.Connection, claims *utils.Claims, message []byte) *utils.Claims {
+	userID := connection.UserID
+
+	// Frames without a type are chat messages
+	var frame models.ClientFrame
+	json.Unmarshal(message, &frame)
+
+	// Frames over the limit are dropped, the client is told when to retry. Telemetry has a limit
+	// of its own, checked by ReportTelemetry.
+	if frame.Type != services.FrameTelemetry {
+		if err := services.CheckRateLimit(services.PolicyMessages, userID); err != nil {
+			services.NotifyThrottled(connection, err)
+			return claims
+		}
+	}
+
+	scope, known := services.FrameScope(frame.Type)
+	if !known {
+		services.NotifyFrameRejected(connection, frame.Type, errors.New("unknown frame type"))
+		return claims
+	}
+	if !claims.HasScope(scope) {
+		log.Printf("Rejected %q frame from %s without scope %s\n", frame.Type, userID, scope)
+		services.NotifyFrameRejected(connection, frame.Type, services.ErrForbidden)
+		return claims
+	}
+
+	var err error
+	switch frame.Type {
+	case services.FrameReauth:
+		fresh, reauthErr := services.Reauthenticate(connection, frame.Token)
+		if reauthErr != nil {
+			log.Printf("Rejected re-authentication of %s: %v\n", userID, reauthErr)
+			return claims
+		}
+		return fresh
+	case services.FrameBroadcast:
+		_, err = services.NewModerationService().Broadcast(userID, frame.Content)
+	case services.FrameDeleteMessage:
+		_, err = services.NewModerationService().DeleteMessage(userID, frame.MessageID)
+	case services.FrameTelemetry:
+		err = services.NewDeviceService().ReportTelemetry(connection, frame.Telemetry)
+		if errors.Is(err, services.ErrRateLimited) {
+			services.NotifyThrottled(connection, err)
+			return claims
+		}
+	default:
+		if err := services.HandleMessage(userID, message); err != nil {
+			log.Printf("Rejected message from %s: %v\n", userID, err)
+		}
+		return claims
+	}
+	if err != nil {
+		log.Printf("Rejected %q frame from %s: %v\n", frame.Type, userID, err)
+		services.NotifyFrameRejected(connection, frame.Type, err)
+	}
+	return claims
+}
+
+// parseResumeRequest reads the optional resume parameters of a WebSocket handshake. Clients either
+// pass their last seen sequence per conversation as a JSON object in "resume" or the global sync
+// cursor from their last sync_complete event in "cursor".
+func parseResumeRequest(r *http.Request) (*models.ResumeRequest, error) {
+	params := r.URL.Query()
+	resume, cursor := params.Get("resume"), params.Get("cursor")
+	if resume == "" && cursor == "" {
+		return nil, nil
 	}
+
+	request := &models.ResumeRequest{Cursor: cursor}
+	if resume != "" {
+		if err := json.Unmarshal([]byte(resume), &request.Seqs); err != nil {
+			return nil, fmt.Errorf("invalid resume: %v", err)
+		}
+	}
+	return request, nil
 }
 
 // GenerateTokenHandler handles token generation for a given user
@@ -62,12 +217,16 @@ func GenerateTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username := requestData.Username
+	account, err := services.NewUserService().FindUser(requestData.Username)
+	if err != nil {
+		writeServiceError(w, err, "generate token")
+		return
+	}
 	device_id := requestData.DeviceID
 	email := requestData.Email
 
 	// Generate a token for the user
-	token, err := utils.GenerateToken(username, device_id, email)
+	token, err := utils.GenerateToken(account.UserID, account.Username, device_id, email, nil)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to generate access token: %v", err), http.StatusInternalServerError)
 		return
@@ -80,7 +239,7 @@ func GenerateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// Send the token as a JSON response
 	response := models.TokenResponse{
-		UserName:     username,
+		UserName:     account.UserID,
 		AccessToken:  token,
 		RefreshToken: refreshToken,
 	}
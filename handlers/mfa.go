@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// MFALoginHandler completes a login that is waiting for its second factor
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request models.MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewMFAService()
+	response, err := s.CompleteLogin(request.ChallengeToken, request.Code)
+	if err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// TOTPEnrollHandler starts TOTP enrollment for the caller and returns the secret to scan
+func TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewMFAService()
+	enrollment, err := s.BeginTOTPEnrollment(userID)
+	if err != nil {
+		writeServiceError(w, err, "start two-factor enrollment")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, enrollment)
+}
+
+// TOTPConfirmHandler enables TOTP with a first code from the authenticator app and returns the recovery codes
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	handleMFACode(w, r, "enable two-factor authentication", func(userID, code string) (interface{}, error) {
+		return services.NewMFAService().ConfirmTOTPEnrollment(userID, code)
+	})
+}
+
+// TOTPDisableHandler turns off TOTP for the caller after checking a current code
+func TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	handleMFACode(w, r, "disable two-factor authentication", func(userID, code string) (interface{}, error) {
+		return nil, services.NewMFAService().DisableTOTP(userID, code)
+	})
+}
+
+// RecoveryCodesHandler replaces the caller's recovery codes after checking a current code
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	handleMFACode(w, r, "regenerate recovery codes", func(userID, code string) (interface{}, error) {
+		return services.NewMFAService().RegenerateRecoveryCodes(userID, code)
+	})
+}
+
+// handleMFACode runs an authenticated MFA change confirmed by a code. A nil result is answered
+// with 204 No Content.
+func handleMFACode(w http.ResponseWriter, r *http.Request, action string, change func(userID, code string) (interface{}, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	result, err := change(userID, request.Code)
+	if err != nil {
+		writeServiceError(w, err, action)
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"websocket-server/models"
+	"websocket-server/services"
+	"websocket-server/utils"
+)
+
+// oidcStateCookie binds a sign in at an identity provider to the browser that started it
+const oidcStateCookie = "oidc_state"
+
+// OIDCProvidersHandler lists the identity providers users can sign in with
+func OIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := services.NewOIDCService()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"providers": s.Providers()})
+}
+
+// OIDCLoginHandler redirects to an identity provider to sign in
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	s := services.NewOIDCService()
+	redirectURL, state, err := s.BeginLogin(r.Context(), params.Get("provider"), params.Get("device_id"))
+	if err != nil {
+		writeServiceError(w, err, "start sign in")
+		return
+	}
+
+	// Lax lets the cookie through on the provider's top-level redirect back to the callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/callback",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.ResultURL(), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a sign in when the identity provider redirects back. The browser
+// is sent on to the app's result page with the fields of a login response, or an error, in the
+// fragment, where they stay out of server logs and Referer headers.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := services.NewOIDCService()
+	cookie, cookieErr := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/oidc/callback",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.ResultURL(), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if err := services.CheckRateLimit(services.PolicyLoginIP, utils.ClientIP(r)); err != nil {
+		redirectOIDCResult(w, r, oidcErrorResult(err))
+		return
+	}
+
+	params := r.URL.Query()
+	if providerError := params.Get("error"); providerError != "" {
+		redirectOIDCResult(w, r, url.Values{"error": {"Sign in was not completed: " + providerError}})
+		return
+	}
+	state := params.Get("state")
+	if state == "" || params.Get("code") == "" {
+		redirectOIDCResult(w, r, url.Values{"error": {"state and code are required"}})
+		return
+	}
+	// A state returned to another browser than the one that started the sign in is a login CSRF
+	if cookieErr != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		redirectOIDCResult(w, r, url.Values{"error": {"Sign in was started in another browser"}})
+		return
+	}
+
+	response, err := s.CompleteLogin(r.Context(), state, params.Get("code"), utils.ClientIP(r))
+	if err != nil {
+		redirectOIDCResult(w, r, oidcErrorResult(err))
+		return
+	}
+
+	redirectOIDCResult(w, r, loginResult(response))
+}
+
+// OIDCLinkHandler links an identity provider account to the user it matched once the user's
+// password is confirmed, and returns the same response as a password login
+func OIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := services.CheckRateLimit(services.PolicyLoginIP, utils.ClientIP(r)); err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+
+	var request models.OIDCLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewOIDCService()
+	response, err := s.ConfirmLink(&request, utils.ClientIP(r))
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// redirectOIDCResult sends the browser to the app's result page with the outcome of a sign in
+func redirectOIDCResult(w http.ResponseWriter, r *http.Request, result url.Values) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, services.NewOIDCService().ResultURL()+"#"+result.Encode(), http.StatusFound)
+}
+
+// oidcErrorResult describes a failed sign in without revealing internal errors
+func oidcErrorResult(err error) url.Values {
+	var limited *services.RateLimitError
+	switch {
+	case errors.As(err, &limited):
+		return url.Values{"error": {"Too many requests"}}
+	case errors.Is(err, services.ErrForbidden), errors.Is(err, services.ErrInvalidRequest),
+		errors.Is(err, services.ErrInvalidMFAChallenge):
+		return url.Values{"error": {err.Error()}}
+	}
+	log.Printf("OIDC sign in failed: %v\n", err)
+	return url.Values{"error": {"Sign in failed"}}
+}
+
+// loginResult returns the fields of a login response that are set, under their JSON names
+func loginResult(response *models.LoginResponse) url.Values {
+	result := url.Values{}
+	for key, value := range map[string]string{
+		"user_id":              response.UserID,
+		"device_id":            response.DeviceID,
+		"access_token":         response.AccessToken,
+		"refresh_token":        response.RefreshToken,
+		"challenge_token":      response.ChallengeToken,
+		"challenge_expires_at": response.ChallengeExpiresAt,
+		"link_token":           response.LinkToken,
+	} {
+		if value != "" {
+			result.Set(key, value)
+		}
+	}
+	for key, value := range map[string]bool{
+		"mfa_required":          response.MFARequired,
+		"mfa_enrollment_needed": response.MFAEnrollmentNeeded,
+		"link_required":         response.LinkRequired,
+	} {
+		if value {
+			result.Set(key, strconv.FormatBool(value))
+		}
+	}
+	return result
+}
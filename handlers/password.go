@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"websocket-server/models"
+	"websocket-server/services"
+	"websocket-server/utils"
+)
+
+// ForgotPasswordHandler emails a password reset link. It accepts the request whether or not an
+// account has the address.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request models.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := services.CheckRateLimit(services.PolicyPasswordResetIP, utils.ClientIP(r)); err != nil {
+		writeServiceError(w, err, "send password reset email")
+		return
+	}
+
+	s := services.NewPasswordService()
+	if err := s.ForgotPassword(request.Email); err != nil {
+		writeServiceError(w, err, "send password reset email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resetPasswordForm is shown by browsers that open the link of a password reset email. It posts
+// back to the link.
+var resetPasswordForm = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Reset your password</title></head>
+<body><form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="new_password" autocomplete="new-password" required></label>
+<button type="submit">Set password</button>
+</form></body></html>
+`))
+
+// ResetPasswordHandler sets a new password with the token from a password reset link. Opening the
+// link shows a form, which posts the password form encoded; API clients post JSON.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The token is in the address, it must not leak to other sites
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resetPasswordForm.Execute(w, r.URL.Query().Get("token"))
+		return
+	}
+
+	var request models.ResetPasswordRequest
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	if form {
+		request.Token, request.NewPassword = r.PostFormValue("token"), r.PostFormValue("new_password")
+	} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewPasswordService()
+	if err := s.ResetPassword(request.Token, request.NewPassword); err != nil {
+		writeServiceError(w, err, "reset password")
+		return
+	}
+
+	if form {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Your password was changed, you can sign in with it now.\n"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePasswordHandler replaces the caller's password, which signs them out on every device
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewPasswordService()
+	err = s.ChangePassword(userID, request.CurrentPassword, request.NewPassword)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	} else if err != nil {
+		writeServiceError(w, err, "change password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// decodeMessageAction authenticates a POST request carrying a message ID. It writes the
+// error response itself and returns ok=false if the request cannot be served.
+func decodeMessageAction(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return "", "", false
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", "", false
+	}
+
+	var request models.MessageActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MessageID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return "", "", false
+	}
+	return userID, request.MessageID, true
+}
+
+// PinHandler pins a message in its conversation
+func PinHandler(w http.ResponseWriter, r *http.Request) {
+	userID, messageID, ok := decodeMessageAction(w, r)
+	if !ok {
+		return
+	}
+
+	s := services.NewPinService()
+	msg, err := s.Pin(userID, messageID)
+	if err != nil {
+		writeServiceError(w, err, "pin message")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// UnpinHandler removes a message from its conversation's pins
+func UnpinHandler(w http.ResponseWriter, r *http.Request) {
+	userID, messageID, ok := decodeMessageAction(w, r)
+	if !ok {
+		return
+	}
+
+	s := services.NewPinService()
+	if err := s.Unpin(userID, messageID); err != nil {
+		writeServiceError(w, err, "unpin message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListPinsHandler returns the pinned messages of a conversation
+func ListPinsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversationID := r.URL.Query().Get("conversation_id")
+	if conversationID == "" {
+		http.Error(w, "conversation_id is required", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewPinService()
+	pins, err := s.ListPins(userID, conversationID)
+	if err != nil {
+		writeServiceError(w, err, "list pinned messages")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": pins})
+}
+
+// StarHandler stars a message for the calling user
+func StarHandler(w http.ResponseWriter, r *http.Request) {
+	userID, messageID, ok := decodeMessageAction(w, r)
+	if !ok {
+		return
+	}
+
+	s := services.NewPinService()
+	if err := s.Star(userID, messageID); err != nil {
+		writeServiceError(w, err, "star message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnstarHandler removes the calling user's star from a message
+func UnstarHandler(w http.ResponseWriter, r *http.Request) {
+	userID, messageID, ok := decodeMessageAction(w, r)
+	if !ok {
+		return
+	}
+
+	s := services.NewPinService()
+	if err := s.Unstar(userID, messageID); err != nil {
+		writeServiceError(w, err, "unstar message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListStarredHandler returns a page of the calling user's starred messages
+func ListStarredHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewPinService()
+	starred, nextCursor, err := s.ListStarred(userID, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeServiceError(w, err, "list starred messages")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": starred, "next_cursor": nextCursor})
+}
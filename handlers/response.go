@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"websocket-server/services"
+)
+
+// writeJSON encodes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeServiceError maps the shared service errors to HTTP status codes
+func writeServiceError(w http.ResponseWriter, err error, action string) {
+	var limited *services.RateLimitError
+	switch {
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrInvalidMFAChallenge):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, services.ErrMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrAttachmentNotFound):
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, services.ErrInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusInternalServerError)
+	}
+}
+
+// queryLimit parses the optional limit query parameter, returning 0 when it is absent
+func queryLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
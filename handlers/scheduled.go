@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// ScheduledMessagesHandler lists (GET), creates (POST) or edits (PUT) the caller's scheduled messages
+func ScheduledMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewSchedulerService()
+	switch r.Method {
+	case http.MethodGet:
+		scheduled, err := s.List(userID)
+		if err != nil {
+			writeServiceError(w, err, "list scheduled messages")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"scheduled": scheduled})
+
+	case http.MethodPost, http.MethodPut:
+		var request models.ScheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			scheduled, err := s.Schedule(userID, &request)
+			if err != nil {
+				writeServiceError(w, err, "schedule message")
+				return
+			}
+			writeJSON(w, http.StatusCreated, scheduled)
+			return
+		}
+
+		if request.ScheduleID == "" {
+			http.Error(w, "schedule_id is required", http.StatusBadRequest)
+			return
+		}
+		scheduled, err := s.Edit(userID, &request)
+		if err != nil {
+			writeServiceError(w, err, "edit scheduled message")
+			return
+		}
+		writeJSON(w, http.StatusOK, scheduled)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// CancelScheduledHandler cancels one of the caller's scheduled messages before it is due
+func CancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ScheduleID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewSchedulerService()
+	if err := s.Cancel(userID, request.ScheduleID); err != nil {
+		writeServiceError(w, err, "cancel scheduled message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
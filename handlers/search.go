@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"websocket-server/models"
+	"websocket-server/services"
+)
+
+// SearchHandler searches the caller's message history
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	query := models.SearchQuery{
+		UserID:         userID,
+		Text:           params.Get("q"),
+		Language:       params.Get("language"),
+		ConversationID: params.Get("conversation_id"),
+		SenderID:       params.Get("sender_id"),
+		From:           params.Get("from"),
+		To:             params.Get("to"),
+	}
+	if value := params.Get("has_attachment"); value != "" {
+		if query.HasAttachment, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid has_attachment", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := params.Get("tags"); value != "" {
+		query.Tags = strings.Split(value, ",")
+	}
+	if query.Limit, err = queryLimit(r); err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if value := params.Get("offset"); value != "" {
+		if query.Offset, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := services.NewSearchService()
+	results, nextOffset, err := s.Search(&query)
+	if err != nil {
+		writeServiceError(w, err, "search messages")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results, "next_offset": nextOffset})
+}
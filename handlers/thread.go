@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"websocket-server/services"
+)
+
+// ThreadRepliesHandler returns a page of replies for a thread
+func ThreadRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	threadID := r.URL.Query().Get("thread_id")
+	if threadID == "" {
+		http.Error(w, "thread_id is required", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewThreadService()
+	page, err := s.GetReplies(userID, threadID, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeServiceError(w, err, "load thread")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
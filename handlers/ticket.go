@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+	"websocket-server/services"
+)
+
+// ConnectionTicketHandler exchanges the caller's access token for a single-use WebSocket connection ticket
+func ConnectionTicketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := authenticateClaims(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewTicketService()
+	ticket, err := s.IssueTicket(claims)
+	if err != nil {
+		writeServiceError(w, err, "issue connection ticket")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ticket)
+}
@@ -1,14 +1,15 @@
 package handlers
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strings"
 	"websocket-server/models"
 	"websocket-server/services"
+	"websocket-server/utils"
 )
 
 // RegisterHandler handles user registration
@@ -23,16 +24,6 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		Device models.Device `json:"device"`
 	}
 
-	fmt.Printf("Headers: %v\n", r.Header)
-	fmt.Printf("Params: %v\n", r.URL.Query())
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-		return
-	}
-	fmt.Printf("Body: %s\n", body)
-	r.Body = io.NopCloser(bytes.NewBuffer(body)) // Reset body for further use
-
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
@@ -40,6 +31,22 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	user := requestData.User
 	device := requestData.Device
 
+	if err := services.CheckRateLimit(services.PolicyRegisterIP, utils.ClientIP(r)); err != nil {
+		writeServiceError(w, err, "register")
+		return
+	}
+
+	// Names ending in _bot are reserved for bot accounts
+	if services.IsBotName(user.Username) {
+		http.Error(w, "Usernames ending in _bot are reserved", http.StatusBadRequest)
+		return
+	}
+	// Names shaped like user IDs could stand for another user
+	if services.IsUserIDName(user.Username) {
+		http.Error(w, "Usernames shaped like user IDs are reserved", http.StatusBadRequest)
+		return
+	}
+
 	s := services.NewUserService()
 
 	// Check if user already exists
@@ -51,7 +58,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save the user (password should be hashed in production)
-	token, refresh_token, err := s.RegisterUser(&user, &device)
+	tokens, err := s.RegisterUser(&user, &device, utils.ClientIP(r))
 	log.Printf("%s", fmt.Sprintf("Failed to register user: %v", err))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to register user: %v", err), http.StatusInternalServerError)
@@ -61,8 +68,10 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message":       "User registered successfully",
-		"access_token":  token,
-		"refresh_token": refresh_token,
+		"user_id":       tokens.UserID,
+		"device_id":     tokens.DeviceID,
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
 	})
 }
 
@@ -78,9 +87,6 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		Device      models.Device      `json:"device"`
 	}
 
-	fmt.Printf("Body: %v\n", r.Body)
-	fmt.Printf("JSON Decoder: %v\n", json.NewDecoder(r.Body))
-
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
@@ -89,14 +95,103 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	credentials := requestData.Credentials
 	device := requestData.Device
 
+	// Both limits apply so that neither one address nor one targeted account can be brute-forced
+	if err := services.CheckRateLimit(services.PolicyLoginIP, utils.ClientIP(r)); err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+	if err := services.CheckRateLimit(services.PolicyLoginUsername, strings.ToLower(credentials.Username)); err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+
 	s := services.NewUserService()
 
 	// Validate user credentials
-	token, refresh_token, err := s.AuthenticateUser(&credentials, &device)
+	response, err := s.AuthenticateUser(&credentials, &device, utils.ClientIP(r))
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		writeServiceError(w, err, "log in")
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// LoginHistoryHandler returns the latest login attempts on the caller's account
+func LoginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewUserService()
+	attempts, err := s.LoginHistory(userID)
+	if err != nil {
+		writeServiceError(w, err, "load login history")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"attempts": attempts})
+}
+
+// UserLookupHandler translates between user IDs and usernames. Both user_id and username may be
+// repeated, e.g. /users/lookup?username=alice&username=bob.
+func UserLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := authenticateRequest(r); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	s := services.NewUserService()
+	users, err := s.LookupUsers(params["user_id"], params["username"])
+	if err != nil {
+		writeServiceError(w, err, "look up users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+}
+
+// RenameHandler changes the caller's username
+func RenameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request models.RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewUserService()
+	profile, err := s.RenameUser(userID, request.Username)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid email or password %s: %v", credentials.Username, err), http.StatusUnauthorized)
+		writeServiceError(w, err, "rename user")
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"access_token": token, "refresh_token": refresh_token})
+	writeJSON(w, http.StatusOK, profile)
 }
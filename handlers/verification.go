@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"websocket-server/services"
+)
+
+// VerifyEmailHandler confirms an email address with the token from a verification link
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	s := services.NewVerificationService()
+	if err := s.Verify(token); err != nil {
+		writeServiceError(w, err, "verify email")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"verified": true})
+}
+
+// ResendVerificationHandler sends the caller a new verification email
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := authenticateRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := services.NewVerificationService()
+	if err := s.Resend(userID); err != nil {
+		writeServiceError(w, err, "send verification email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
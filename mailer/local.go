@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes every email to a file in a directory instead of sending it, for development and tests
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer creates a mailer writing to dir, creating it if needed
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create mail directory: %v", err)
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+// Send writes a message to a new .eml file
+func (m *FileMailer) Send(msg *Message) error {
+	if err := validateHeaders(msg); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(m.dir, time.Now().UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return fmt.Errorf("could not write email: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(format(m.from, msg)); err != nil {
+		return fmt.Errorf("could not write email: %v", err)
+	}
+	log.Printf("Wrote email to %s as %s\n", msg.To, filepath.Base(file.Name()))
+	return nil
+}
+
+// LogMailer writes every email to the log instead of sending it
+type LogMailer struct {
+	from string
+}
+
+// NewLogMailer creates a mailer writing to the log
+func NewLogMailer(from string) *LogMailer {
+	return &LogMailer{from: from}
+}
+
+// Send logs a message
+func (m *LogMailer) Send(msg *Message) error {
+	if err := validateHeaders(msg); err != nil {
+		return err
+	}
+	log.Printf("Email to %s\n%s\n", msg.To, format(m.from, msg))
+	return nil
+}
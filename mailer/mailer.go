@@ -0,0 +1,77 @@
+// Package mailer sends transactional emails such as address verifications.
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// FromEnv builds the mailer selected by MAIL_DRIVER: "smtp" sends through SMTP_HOST, "file" writes
+// each email to MAIL_DIR and "log" writes emails to the log. There is no default, since emails carry
+// links that sign the recipient in and must not end up in a log by accident.
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch strings.ToLower(os.Getenv("MAIL_DRIVER")) {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail driver")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir, from)
+	case "log":
+		return NewLogMailer(from), nil
+	case "":
+		return nil, fmt.Errorf("MAIL_DRIVER is required, one of smtp, file or log")
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q, expected smtp, file or log", os.Getenv("MAIL_DRIVER"))
+	}
+}
+
+// format renders a message with its headers
+func format(from string, msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validateHeaders rejects addresses and subjects that would inject headers
+func validateHeaders(msg *Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends emails through an SMTP server, authenticating when a username is set
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a mailer for the SMTP server at host:port
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	mailer := &SMTPMailer{addr: net.JoinHostPort(host, port), from: from}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+// Send delivers a message, using STARTTLS when the server offers it
+func (m *SMTPMailer) Send(msg *Message) error {
+	if err := validateHeaders(msg); err != nil {
+		return err
+	}
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg)); err != nil {
+		return fmt.Errorf("could not send email: %v", err)
+	}
+	return nil
+}
@@ -4,13 +4,25 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 	"websocket-server/database"
 	"websocket-server/routes"
+	"websocket-server/services"
 )
 
 func main() {
 
 	database.InitializePostgresDB()
+	services.InitializeAttachmentStorage()
+	services.InitializeRateLimiter()
+	services.InitializeMailer()
+	services.InitializeOIDC()
+	services.StartMediaWorkers(4)
+	services.StartMessageReaper(10 * time.Second)
+	services.StartMessageScheduler(5 * time.Second)
+	services.StartSyncLogPruner(time.Hour)
+	services.StartUploadReaper(time.Hour)
+	services.StartLocationPruner(time.Hour)
 
 	mux := http.NewServeMux()
 
@@ -19,6 +31,8 @@ func main() {
 
 	routes.RegisterUserRoutes(mux)
 	routes.RegisterMessagingRoutes(mux)
+	routes.RegisterAttachmentRoutes(mux)
+	routes.RegisterAdminRoutes(mux)
 
 	// WebSocket endpoint
 	// http.HandleFunc("/ws", handlers.WebSocketHandler)
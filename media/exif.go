@@ -0,0 +1,187 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	jpegSOI         = 0xD8
+	jpegSOS         = 0xDA
+	jpegAPP1        = 0xE1
+	tagGPSInfo      = 0x8825
+	ifdEntrySize    = 12
+	tiffHeaderSize  = 8
+	exifHeaderBytes = "Exif\x00\x00"
+	pngSignature    = "\x89PNG\r\n\x1a\n"
+	pngChunkEXIF    = "eXIf"
+	pngChunkEnd     = "IEND"
+	webpChunkEXIF   = "EXIF"
+)
+
+// exifTypeSizes are the byte sizes of the TIFF field types
+var exifTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// StripLocation removes the GPS information from the EXIF metadata of a JPEG, PNG or WebP image
+// in place and reports whether anything was removed. Other data is returned unchanged.
+func StripLocation(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, jpegSOI}):
+		return StripJPEGLocation(data)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return stripPNGLocation(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebPLocation(data)
+	}
+	return false
+}
+
+// StripJPEGLocation removes the GPS information from the EXIF block of a JPEG while keeping
+// the rest of the metadata (such as orientation). It reports whether anything was removed.
+// Data that is not a well-formed JPEG is returned unchanged.
+func StripJPEGLocation(data []byte) bool {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return false
+	}
+
+	stripped := false
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return stripped
+		}
+		marker := data[pos+1]
+		if marker == jpegSOS {
+			// Entropy coded image data follows, there is no more metadata
+			return stripped
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return stripped
+		}
+
+		segment := data[pos+4 : end]
+		if marker == jpegAPP1 && bytes.HasPrefix(segment, []byte(exifHeaderBytes)) {
+			if stripGPS(segment[len(exifHeaderBytes):]) {
+				stripped = true
+			}
+		}
+		pos = end
+	}
+	return stripped
+}
+
+// stripPNGLocation removes the GPS information from the eXIf chunk of a PNG and updates the
+// checksum of the chunk
+func stripPNGLocation(data []byte) bool {
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || chunkType == pngChunkEnd {
+			return false
+		}
+		if chunkType == pngChunkEXIF && stripEXIFGPS(data[pos+8:end-4]) {
+			binary.BigEndian.PutUint32(data[end-4:end], crc32.ChecksumIEEE(data[pos+4:end-4]))
+			return true
+		}
+		pos = end
+	}
+	return false
+}
+
+// stripWebPLocation removes the GPS information from the EXIF chunk of a WebP
+func stripWebPLocation(data []byte) bool {
+	pos := 12
+	for pos+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return false
+		}
+		if string(data[pos:pos+4]) == webpChunkEXIF {
+			return stripEXIFGPS(data[pos+8 : end])
+		}
+		// Chunks are padded to an even size
+		pos = end + length%2
+	}
+	return false
+}
+
+// stripEXIFGPS strips the GPS information from an EXIF payload stored outside of a JPEG, which
+// some writers still prefix with the JPEG EXIF header
+func stripEXIFGPS(payload []byte) bool {
+	return stripGPS(bytes.TrimPrefix(payload, []byte(exifHeaderBytes)))
+}
+
+// stripGPS zeroes the GPS IFD of a TIFF structure in place
+func stripGPS(tiff []byte) bool {
+	if len(tiff) < tiffHeaderSize {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+
+	ifd0 := order.Uint32(tiff[4:8])
+	entries, ok := ifdEntries(tiff, order, ifd0)
+	if !ok {
+		return false
+	}
+
+	for i := uint32(0); i < entries; i++ {
+		entry := ifd0 + 2 + i*ifdEntrySize
+		if order.Uint16(tiff[entry:entry+2]) != tagGPSInfo {
+			continue
+		}
+		gpsIFD := order.Uint32(tiff[entry+8 : entry+12])
+		return clearIFD(tiff, order, gpsIFD)
+	}
+	return false
+}
+
+// ifdEntries returns the number of entries of the IFD at offset if it lies within the data
+func ifdEntries(tiff []byte, order binary.ByteOrder, offset uint32) (uint32, bool) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 0, false
+	}
+	count := uint32(order.Uint16(tiff[offset : offset+2]))
+	if uint64(offset)+2+uint64(count)*ifdEntrySize > uint64(len(tiff)) {
+		return 0, false
+	}
+	return count, true
+}
+
+// clearIFD zeroes every value of an IFD, including values stored outside of the entries,
+// and leaves an empty IFD behind
+func clearIFD(tiff []byte, order binary.ByteOrder, offset uint32) bool {
+	entries, ok := ifdEntries(tiff, order, offset)
+	if !ok || entries == 0 {
+		return false
+	}
+
+	for i := uint32(0); i < entries; i++ {
+		entry := offset + 2 + i*ifdEntrySize
+		fieldType := order.Uint16(tiff[entry+2 : entry+4])
+		count := order.Uint32(tiff[entry+4 : entry+8])
+		size := uint64(exifTypeSizes[fieldType]) * uint64(count)
+		if size > 4 {
+			valueOffset := uint64(order.Uint32(tiff[entry+8 : entry+12]))
+			if valueOffset+size <= uint64(len(tiff)) {
+				clear(tiff[valueOffset : valueOffset+size])
+			}
+		}
+	}
+	clear(tiff[offset+2 : offset+2+entries*ifdEntrySize])
+	order.PutUint16(tiff[offset:offset+2], 0)
+	return true
+}
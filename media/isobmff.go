@@ -0,0 +1,218 @@
+package media
+
+import (
+	"encoding/binary"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// boxLocation is the QuickTime user data box holding the ISO 6709 recording location
+	boxLocation = "\xa9xyz"
+	// boxLocationInfo is the 3GPP user data box holding the recording location
+	boxLocationInfo = "loci"
+	// maxMetaBoxSize bounds the metadata box read into memory to look for location items
+	maxMetaBoxSize = 16 << 20
+	// zeroChunkSize is how much is written at once when clearing a box
+	zeroChunkSize = 4096
+)
+
+// heifBrands are the ftyp brands of HEIF and AVIF still images
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1", "avif", "avis"}
+
+// ReadWriterAt is a file that can be patched in place
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// IsISOBMFF reports whether data starts like an ISO base media file, such as an MP4 or
+// QuickTime video or a HEIF image
+func IsISOBMFF(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	switch string(head[4:8]) {
+	case "ftyp", "moov", "mdat", "wide":
+		return true
+	}
+	return false
+}
+
+// IsHEIF reports whether an ISO base media file is a HEIF or AVIF image. Those keep their EXIF
+// metadata in items this package does not rewrite.
+func IsHEIF(head []byte) bool {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	end := min(int(binary.BigEndian.Uint32(head[:4])), len(head))
+	// The major brand is followed by the minor version and the compatible brands
+	brands := []string{string(head[8:12])}
+	for pos := 16; pos+4 <= end; pos += 4 {
+		brands = append(brands, string(head[pos:pos+4]))
+	}
+	for _, brand := range brands {
+		if slices.Contains(heifBrands, brand) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripMP4Location removes the recording location from the metadata of an MP4 or QuickTime file
+// of the given size in place, leaving the media data untouched. It reports whether anything was
+// removed. Boxes that are not well-formed end the walk.
+func StripMP4Location(file ReadWriterAt, size int64) (bool, error) {
+	return stripBoxes(file, 0, size)
+}
+
+// stripBoxes walks the boxes between start and end, descending into the containers that hold
+// user data and metadata
+func stripBoxes(file ReadWriterAt, start, end int64) (bool, error) {
+	stripped := false
+	for pos := start; pos+8 <= end; {
+		boxType, headerSize, boxSize, err := readBoxHeader(file, pos, end)
+		if err != nil || boxSize == 0 {
+			return stripped, err
+		}
+		payload, boxEnd := pos+headerSize, pos+boxSize
+
+		var found bool
+		switch boxType {
+		case "moov", "trak", "udta":
+			found, err = stripBoxes(file, payload, boxEnd)
+		case "meta":
+			found, err = stripMetaBox(file, payload, boxEnd)
+		case boxLocation, boxLocationInfo:
+			found, err = true, zeroRange(file, payload, boxEnd)
+		}
+		if err != nil {
+			return stripped, err
+		}
+		stripped = stripped || found
+		pos = boxEnd
+	}
+	return stripped, nil
+}
+
+// readBoxHeader reads the type, header size and total size of the box at pos. A size of zero
+// means the box is not well-formed.
+func readBoxHeader(file io.ReaderAt, pos, end int64) (string, int64, int64, error) {
+	header := make([]byte, min(16, end-pos))
+	if _, err := file.ReadAt(header, pos); err != nil {
+		return "", 0, 0, err
+	}
+	boxType := string(header[4:8])
+	headerSize, boxSize := int64(8), int64(binary.BigEndian.Uint32(header[:4]))
+	switch boxSize {
+	case 0:
+		// The box extends to the end of its parent
+		boxSize = end - pos
+	case 1:
+		if len(header) < 16 {
+			return boxType, 0, 0, nil
+		}
+		headerSize, boxSize = 16, int64(binary.BigEndian.Uint64(header[8:16]))
+	}
+	if boxSize < headerSize || boxSize > end-pos {
+		return boxType, 0, 0, nil
+	}
+	return boxType, headerSize, boxSize, nil
+}
+
+// stripMetaBox clears the values of the location items of a metadata box, in the QuickTime
+// layout (keys and ilst) as well as the iTunes one (ilst items typed ©xyz)
+func stripMetaBox(file ReadWriterAt, start, end int64) (bool, error) {
+	if end-start > maxMetaBoxSize {
+		return false, nil
+	}
+	data := make([]byte, end-start)
+	if _, err := file.ReadAt(data, start); err != nil {
+		return false, err
+	}
+
+	children := data
+	if len(children) >= 4 && binary.BigEndian.Uint32(children[:4]) == 0 {
+		// The ISO metadata box starts with a version and flags, the QuickTime one does not
+		children = children[4:]
+	}
+
+	keys := map[uint32]string{}
+	var items []byte
+	eachBox(children, func(boxType string, payload []byte) {
+		switch boxType {
+		case "keys":
+			keys = parseMetadataKeys(payload)
+		case "ilst":
+			items = payload
+		}
+	})
+
+	stripped := false
+	eachBox(items, func(itemType string, item []byte) {
+		key := keys[binary.BigEndian.Uint32([]byte(itemType))]
+		if itemType != boxLocation && !strings.Contains(key, "location") {
+			return
+		}
+		eachBox(item, func(boxType string, value []byte) {
+			// The value follows the type and locale of the data box
+			if boxType == "data" && len(value) > 8 {
+				clear(value[8:])
+				stripped = true
+			}
+		})
+	})
+	if !stripped {
+		return false, nil
+	}
+	if _, err := file.WriteAt(data, start); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parseMetadataKeys maps the 1-based indexes of a QuickTime keys box to the key names
+func parseMetadataKeys(payload []byte) map[uint32]string {
+	keys := map[uint32]string{}
+	if len(payload) < 8 {
+		return keys
+	}
+	// Version and flags, then the entry count
+	pos := 8
+	for index := uint32(1); pos+8 <= len(payload); index++ {
+		size := int(binary.BigEndian.Uint32(payload[pos : pos+4]))
+		if size < 8 || pos+size > len(payload) {
+			break
+		}
+		keys[index] = string(payload[pos+8 : pos+size])
+		pos += size
+	}
+	return keys
+}
+
+// eachBox calls fn with the type and payload of every well-formed box in data
+func eachBox(data []byte, fn func(boxType string, payload []byte)) {
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if size == 0 {
+			size = len(data) - pos
+		}
+		if size < 8 || pos+size > len(data) {
+			return
+		}
+		fn(string(data[pos+4:pos+8]), data[pos+8:pos+size])
+		pos += size
+	}
+}
+
+// zeroRange overwrites the bytes between start and end with zeros
+func zeroRange(file io.WriterAt, start, end int64) error {
+	zeros := make([]byte, min(zeroChunkSize, end-start))
+	for pos := start; pos < end; pos += int64(len(zeros)) {
+		if _, err := file.WriteAt(zeros[:min(int64(len(zeros)), end-pos)], pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package media
+
+import (
+	"image"
+	"image/draw"
+	_ "image/gif" // register GIF decoding
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Dimensions returns the width and height of an encoded image without decoding the pixels
+func Dimensions(r io.Reader) (int, int, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return config.Width, config.Height, format, nil
+}
+
+// Decode decodes a JPEG, PNG or GIF image and returns it with its format name
+func Decode(r io.Reader) (image.Image, string, error) {
+	return image.Decode(r)
+}
+
+// Thumbnail scales an image down so that its longest side is at most maxSide pixels,
+// averaging the source pixels covered by each destination pixel. Images that already
+// fit are returned unchanged.
+func Thumbnail(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img
+	}
+
+	dstWidth, dstHeight := maxSide, height*maxSide/width
+	if height > width {
+		dstWidth, dstHeight = width*maxSide/height, maxSide
+	}
+	dstWidth, dstHeight = max(dstWidth, 1), max(dstHeight, 1)
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := y*height/dstHeight, max((y+1)*height/dstHeight, y*height/dstHeight+1)
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := x*width/dstWidth, max((x+1)*width/dstWidth, x*width/dstWidth+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+uint64(p[0]), g+uint64(p[1]), b+uint64(p[2]), a+uint64(p[3])
+					n++
+				}
+			}
+
+			offset := y*dst.Stride + x*4
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Encode writes a thumbnail as PNG when the source format may carry transparency and as JPEG
+// otherwise. It returns the content type written.
+func Encode(w io.Writer, img image.Image, sourceFormat string) (string, error) {
+	if sourceFormat == "png" || sourceFormat == "gif" {
+		return "image/png", png.Encode(w, img)
+	}
+	return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: 80})
+}
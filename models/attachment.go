@@ -0,0 +1,45 @@
+package models
+
+// Attachment is an uploaded file that messages can reference by ID
+type Attachment struct {
+	ID             string `json:"id"`
+	OwnerID        string `json:"owner_id"`
+	FileName       string `json:"file_name"`
+	ContentType    string `json:"content_type"`    // Sniffed MIME type of the content
+	AttachmentType string `json:"attachment_type"` // Coarse type (image, video, audio, file)
+	Size           int64  `json:"size"`
+	SHA256         string `json:"sha256"`
+	StorageKey     string `json:"-"`
+	URL            string `json:"url,omitempty"` // Signed, time-limited download URL
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	MediaStatus    string `json:"media_status"` // Background processing state (none, pending, ready, failed)
+	CreatedAt      string `json:"created_at"`
+}
+
+// Thumbnail is a scaled down rendition of an image attachment
+type Thumbnail struct {
+	MaxSide     int    `json:"max_side"` // Requested bound of the longest side
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+	StorageKey  string `json:"-"`
+	URL         string `json:"url,omitempty"`
+}
+
+// MediaInfo describes an image attachment so clients can render it without downloading it
+type MediaInfo struct {
+	Width      int          `json:"width"`
+	Height     int          `json:"height"`
+	Thumbnails []*Thumbnail `json:"thumbnails"`
+}
+
+// Upload tracks a resumable chunked upload that has not been completed yet
+type Upload struct {
+	ID        string `json:"upload_id"`
+	OwnerID   string `json:"owner_id"`
+	FileName  string `json:"file_name"`
+	Size      int64  `json:"size"`     // Total size declared by the client
+	Received  int64  `json:"received"` // Bytes received so far, the offset of the next chunk
+	CreatedAt string `json:"created_at"`
+}
@@ -0,0 +1,44 @@
+package models
+
+// Bot is an account of an internal service that authenticates with API keys instead of a password
+type Bot struct {
+	ID          string `json:"id"`      // Username of the bot, always ending in "_bot"
+	UserID      string `json:"user_id"` // Identity of the bot in messages and connections
+	DisplayName string `json:"display_name"`
+	CreatedBy   string `json:"created_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// APIKey is a long-lived credential of a bot. The key itself is only returned when it is created.
+type APIKey struct {
+	ID         string   `json:"id"`
+	BotID      string   `json:"bot_id"`
+	BotUserID  string   `json:"bot_user_id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	Key        string   `json:"key,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+}
+
+// CreateBotRequest creates a bot account
+type CreateBotRequest struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// CreateAPIKeyRequest creates an API key for a bot. Keys without scopes may send and read messages,
+// keys without an expiry stay valid until they are revoked.
+type CreateAPIKeyRequest struct {
+	BotID         string   `json:"bot_id"`
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// APIKeyActionRequest identifies the API key an action such as rotation applies to
+type APIKeyActionRequest struct {
+	KeyID string `json:"key_id"`
+}
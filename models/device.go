@@ -0,0 +1,46 @@
+package models
+
+// DeviceSession is a device a user signed in from, as shown in their list of devices
+type DeviceSession struct {
+	DeviceID        string `json:"device_id"`
+	Name            string `json:"name"`
+	Type            string `json:"type,omitempty"`
+	Model           string `json:"model,omitempty"`
+	OperatingSystem string `json:"operating_system,omitempty"`
+	LastIP          string `json:"last_ip,omitempty"`
+	LastLoginAt     string `json:"last_login_at,omitempty"`
+	LastSeenAt      string `json:"last_seen_at,omitempty"`
+	SignedIn        bool   `json:"signed_in"` // False once signed out remotely, until the next login
+	Online          bool   `json:"online"`    // The user's live connection was opened from this device
+	Current         bool   `json:"current"`   // The device of the token that asked
+}
+
+// RenameDeviceRequest sets the name a device is shown with
+type RenameDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"`
+}
+
+// SignOutDeviceRequest signs a device out remotely
+type SignOutDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// DeviceTelemetry is a report of the live attributes of a device, or a snapshot of them. Reports
+// may leave attributes out, which keep their last reported value.
+type DeviceTelemetry struct {
+	BatteryLevel     *int    `json:"battery_level,omitempty"` // Percent
+	SignalStrength   *int    `json:"signal_strength,omitempty"`
+	ConnectivityType *string `json:"connectivity_type,omitempty"`
+	Location         *string `json:"location,omitempty"`
+	Status           *string `json:"status,omitempty"`
+	ReportedAt       string  `json:"reported_at,omitempty"` // Set by the server
+}
+
+// DeviceState is the latest telemetry of one of a user's devices
+type DeviceState struct {
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name,omitempty"`
+	Online   bool   `json:"online"`
+	DeviceTelemetry
+}
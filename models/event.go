@@ -0,0 +1,75 @@
+package models
+
+// Event is a server-initiated frame pushed to connected clients
+type Event struct {
+	Type           string      `json:"type"`
+	Payload        interface{} `json:"payload"`
+	ConversationID string      `json:"conversation_id,omitempty"` // Set on conversation updates
+	Seq            int64       `json:"seq,omitempty"`             // Position of a conversation update in its conversation
+	Timestamp      string      `json:"timestamp,omitempty"`       // Server time a conversation update was stored
+}
+
+// ThreadSummary describes the state of a thread after a new reply
+type ThreadSummary struct {
+	ThreadID    string   `json:"thread_id"`
+	ReplyCount  int      `json:"reply_count"`
+	LastReplyAt string   `json:"last_reply_at"`
+	Reply       *Message `json:"reply"`
+}
+
+// ThreadPage is a page of replies returned by the thread endpoint
+type ThreadPage struct {
+	Root       *Message   `json:"root"`
+	Replies    []*Message `json:"replies"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// HistoryPage is a page of a conversation's messages and updates, which share one sequence, each in
+// sequence order. Sequence numbers of deleted messages are never reused and updates are only kept
+// for the sync retention, so a page may skip them.
+type HistoryPage struct {
+	ConversationID string     `json:"conversation_id"`
+	Messages       []*Message `json:"messages"`
+	Updates        []*Event   `json:"updates"`
+	LatestSeq      int64      `json:"latest_seq"` // Sequence number of the conversation's latest message or update
+	HasMore        bool       `json:"has_more"`
+}
+
+// ResumeRequest is presented by a reconnecting client to have the frames it missed replayed
+type ResumeRequest struct {
+	Seqs   map[string]int64 // Last sequence number seen per conversation
+	Cursor string           // Global sync cursor, the timestamp of the last frame seen
+}
+
+// SyncStatus is the payload of the events closing a replay
+type SyncStatus struct {
+	Cursor        string   `json:"cursor,omitempty"`        // Global sync cursor to present on the next reconnect
+	Replayed      int      `json:"replayed"`                // Number of replayed frames
+	FullSync      bool     `json:"full_sync,omitempty"`     // Every conversation needs a full sync
+	Conversations []string `json:"conversations,omitempty"` // Conversations that need a full sync
+}
+
+// TokenExpiry is the payload of the events about a connection's token
+type TokenExpiry struct {
+	ExpiresAt string `json:"expires_at"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Announcement is the payload of a broadcast to every connected user
+type Announcement struct {
+	From      string `json:"from"`
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+}
+
+// FrameRejection is the payload of the event sent when a client frame is not allowed or fails
+type FrameRejection struct {
+	FrameType string `json:"frame_type"`
+	Error     string `json:"error"`
+}
+
+// Throttle is the payload of the event sent when a rate limit drops a client frame
+type Throttle struct {
+	Policy       string `json:"policy"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
@@ -1,37 +1,59 @@
 package models
 
+// Message priorities, higher values are delivered first
+const (
+	PriorityLow    = -1 // Bulk traffic such as notifications digests
+	PriorityNormal = 0  // Default for chat messages
+	PriorityHigh   = 1  // Highest priority a normal user may set
+	PriorityUrgent = 2  // Alerts and call invites, reserved for the server
+)
+
+// TimestampFormat is the layout of server-assigned message timestamps, RFC 3339 with milliseconds
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
 // Message represents a user-to-user text message
 type Message struct {
+	ID              string            `json:"id"`              // Server-assigned message ID
+	ConversationID  string            `json:"conversation_id"` // Server-assigned conversation the message belongs to
+	Seq             int64             `json:"seq"`             // Server-assigned position of the message in its conversation
 	SenderID        string            `json:"sender_id"`
 	RecipientID     string            `json:"recipient_id"`
 	Content         string            `json:"content"`
-	Timestamp       string            `json:"timestamp"`
-	MessageType     string            `json:"message_type"`     // Type of message (e.g., text, image, video)
-	IsRead          bool              `json:"is_read"`          // Indicates if the message has been read
-	DeliveryStatus  string            `json:"delivery_status"`  // Status of message delivery (e.g., sent, delivered, failed)
-	ReadReceipt     bool              `json:"read_receipt"`     // Indicates if read receipt is enabled
-	Edited          bool              `json:"edited"`           // Indicates if the message has been edited
-	EditTimestamp   string            `json:"edit_timestamp"`   // Timestamp of the last edit
-	Deleted         bool              `json:"deleted"`          // Indicates if the message has been deleted
-	DeleteTimestamp string            `json:"delete_timestamp"` // Timestamp of the deletion
-	Forwarded       bool              `json:"forwarded"`        // Indicates if the message has been forwarded
-	ForwardedFrom   string            `json:"forwarded_from"`   // ID of the original sender if forwarded
-	ReplyToID       string            `json:"reply_to_id"`      // ID of the message being replied to
-	ThreadID        string            `json:"thread_id"`        // ID of the message thread
-	ChannelID       string            `json:"channel_id"`       // ID of the channel where the message was sent
-	Priority        int               `json:"priority"`         // Priority level of the message
-	AttachmentURL   string            `json:"attachment_url"`   // URL to any attachment if present
-	AttachmentType  string            `json:"attachment_type"`  // Type of attachment (e.g., image, video, file)
-	Reactions       map[string]int    `json:"reactions"`        // Reactions to the message (e.g., like, love, etc.)
-	ReactionCount   int               `json:"reaction_count"`   // Total number of reactions
-	Tags            []string          `json:"tags"`             // Tags associated with the message
-	Location        string            `json:"location"`         // Location information if shared
-	Language        string            `json:"language"`         // Language of the message content
-	SeenBy          []string          `json:"seen_by"`          // List of user IDs who have seen the message
-	Starred         bool              `json:"starred"`          // Indicates if the message is starred
-	Pinned          bool              `json:"pinned"`           // Indicates if the message is pinned
-	PinTimestamp    string            `json:"pin_timestamp"`    // Timestamp of when the message was pinned
-	ReactionSummary map[string]string `json:"reaction_summary"` // Summary of reactions (e.g., {"like": "5", "love": "3"})
-	Encryption      bool              `json:"encryption"`       // Indicates if the message is encrypted
-	EncryptionType  string            `json:"encryption_type"`  // Type of encryption used
+	Timestamp       string            `json:"timestamp"`         // Server-assigned time the message was stored, see TimestampFormat
+	MessageType     string            `json:"message_type"`      // Type of message (e.g., text, image, video)
+	IsRead          bool              `json:"is_read"`           // Indicates if the message has been read
+	DeliveryStatus  string            `json:"delivery_status"`   // Status of message delivery (e.g., sent, delivered, failed)
+	ReadReceipt     bool              `json:"read_receipt"`      // Indicates if read receipt is enabled
+	Edited          bool              `json:"edited"`            // Indicates if the message has been edited
+	EditTimestamp   string            `json:"edit_timestamp"`    // Timestamp of the last edit
+	Deleted         bool              `json:"deleted"`           // Indicates if the message has been deleted
+	DeleteTimestamp string            `json:"delete_timestamp"`  // Timestamp of the deletion
+	FromBot         bool              `json:"from_bot"`          // Server-assigned, set if a bot account sent the message
+	Forwarded       bool              `json:"forwarded"`         // Indicates if the message has been forwarded
+	ForwardedFrom   string            `json:"forwarded_from"`    // ID of the original sender if forwarded
+	ReplyToID       string            `json:"reply_to_id"`       // ID of the message being replied to
+	ThreadID        string            `json:"thread_id"`         // ID of the message thread
+	ReplyCount      int               `json:"reply_count"`       // Number of replies in the thread started by this message
+	LastReplyAt     string            `json:"last_reply_at"`     // Timestamp of the latest reply in the thread
+	ChannelID       string            `json:"channel_id"`        // ID of the channel where the message was sent
+	Priority        int               `json:"priority"`          // Priority level of the message
+	AttachmentID    string            `json:"attachment_id"`     // ID of an attachment uploaded to the server
+	AttachmentURL   string            `json:"attachment_url"`    // URL to any attachment if present
+	AttachmentType  string            `json:"attachment_type"`   // Type of attachment (e.g., image, video, file)
+	Media           *MediaInfo        `json:"media,omitempty"`   // Dimensions and thumbnails of image attachments
+	Reactions       map[string]int    `json:"reactions"`         // Reactions to the message (e.g., like, love, etc.)
+	ReactionCount   int               `json:"reaction_count"`    // Total number of reactions
+	Tags            []string          `json:"tags"`              // Tags associated with the message
+	Location        string            `json:"location"`          // Location information if shared
+	Language        string            `json:"language"`          // Language of the message content
+	SeenBy          []string          `json:"seen_by"`           // List of user IDs who have seen the message
+	Starred         bool              `json:"starred"`           // Indicates if the message is starred
+	Pinned          bool              `json:"pinned"`            // Indicates if the message is pinned
+	PinTimestamp    string            `json:"pin_timestamp"`     // Timestamp of when the message was pinned
+	ReactionSummary map[string]string `json:"reaction_summary"`  // Summary of reactions (e.g., {"like": "5", "love": "3"})
+	TTLSeconds      int               `json:"ttl_seconds"`       // Lifetime of an ephemeral message in seconds
+	ExpireAfterRead bool              `json:"expire_after_read"` // Start the lifetime when the recipient reads the message
+	ExpiresAt       string            `json:"expires_at"`        // Server-assigned time at which the message is deleted
+	Encryption      bool              `json:"encryption"`        // Indicates if the message is encrypted
+	EncryptionType  string            `json:"encryption_type"`   // Type of encryption used
 }
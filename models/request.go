@@ -12,3 +12,65 @@ type TokenResponse struct {
 	AccessToken  string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
 }
+
+// ForwardTarget identifies a conversation a message is forwarded into
+type ForwardTarget struct {
+	RecipientID string `json:"recipient_id"`
+	ChannelID   string `json:"channel_id"`
+}
+
+// ForwardRequest asks the server to copy an existing message into other conversations
+type ForwardRequest struct {
+	MessageID string          `json:"message_id"`
+	Targets   []ForwardTarget `json:"targets"`
+}
+
+// MessageActionRequest identifies the message an action such as pinning applies to
+type MessageActionRequest struct {
+	MessageID string `json:"message_id"`
+}
+
+// UploadRequest starts a resumable chunked upload
+type UploadRequest struct {
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+}
+
+// UploadCompleteRequest finalizes a resumable chunked upload
+type UploadCompleteRequest struct {
+	UploadID string `json:"upload_id"`
+}
+
+// ConversationTTLRequest sets the default lifetime of new messages in a conversation
+type ConversationTTLRequest struct {
+	ConversationID  string `json:"conversation_id"`
+	TTLSeconds      int    `json:"ttl_seconds"` // 0 disables self-destructing messages
+	ExpireAfterRead bool   `json:"expire_after_read"`
+}
+
+// ConnectionTicket is a single-use credential for opening a WebSocket connection
+type ConnectionTicket struct {
+	Ticket    string `json:"ticket"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ClientFrame is the envelope of control frames sent by clients over the WebSocket. Frames
+// without a type are chat messages.
+type ClientFrame struct {
+	Type      string           `json:"type"`
+	Token     string           `json:"token"`      // Fresh access token of a reauth frame
+	Content   string           `json:"content"`    // Text of a broadcast frame
+	MessageID string           `json:"message_id"` // Message a delete_message frame removes
+	Telemetry *DeviceTelemetry `json:"telemetry"`  // Report of a telemetry frame
+}
+
+// RoleRequest grants or revokes a role of a user
+type RoleRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// BroadcastRequest is an announcement to every connected user
+type BroadcastRequest struct {
+	Content string `json:"content"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// ScheduledMessage is a message composed now and sent by the server at SendAt
+type ScheduledMessage struct {
+	ID        string  `json:"schedule_id"`
+	SenderID  string  `json:"sender_id"`
+	Message   Message `json:"message"`
+	SendAt    string  `json:"send_at"` // RFC 3339
+	Status    string  `json:"status"`  // pending, sending, sent, cancelled or failed
+	Attempts  int     `json:"attempts"`
+	LastError string  `json:"last_error,omitempty"`
+	CreatedAt string  `json:"created_at"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+// ScheduleRequest creates or edits a scheduled message
+type ScheduleRequest struct {
+	ScheduleID string  `json:"schedule_id"` // Only used when editing
+	Message    Message `json:"message"`
+	SendAt     string  `json:"send_at"`
+}
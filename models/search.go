@@ -0,0 +1,23 @@
+package models
+
+// SearchQuery holds the filters of a message search
+type SearchQuery struct {
+	UserID         string   // Caller, results are limited to conversations they belong to
+	Text           string   // Free text in web search syntax
+	Language       string   // Language used to parse the query, defaults to no stemming
+	ConversationID string   // Restrict to one conversation
+	SenderID       string   // Restrict to one sender
+	From           string   // Inclusive lower bound of the server timestamp (RFC 3339)
+	To             string   // Exclusive upper bound of the server timestamp (RFC 3339)
+	HasAttachment  bool     // Only messages carrying an attachment
+	Tags           []string // Messages must carry every tag
+	Limit          int
+	Offset         int
+}
+
+// SearchResult is a single search hit
+type SearchResult struct {
+	Message   *Message `json:"message"`
+	Highlight string   `json:"highlight"` // HTML-escaped matching fragments with hits wrapped in <mark> tags
+	Rank      float64  `json:"rank"`
+}
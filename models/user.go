@@ -66,3 +66,128 @@ type Device struct {
 	UsageTime        string `json:"usage_time"`
 	Notes            string `json:"notes"`
 }
+
+// Account identifies a user on the server: the numeric user_id of the authentication tables, the
+// stable user ID of tokens, connections and messages, and the username and email address, which
+// can change
+type Account struct {
+	ID       int
+	UserID   string
+	Username string
+	Email    string
+}
+
+// UserProfile is the public view of a user or bot, used to translate between user IDs and usernames
+type UserProfile struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// RenameRequest changes the username of the caller
+type RenameRequest struct {
+	Username string `json:"username"`
+}
+
+// LoginAttempt is an entry of a user's login history
+type LoginAttempt struct {
+	Username  string `json:"username"`
+	UserID    int    `json:"-"`
+	IPAddress string `json:"ip_address"`
+	DeviceID  string `json:"device_id"`
+	Succeeded bool   `json:"succeeded"`
+	NewDevice bool   `json:"new_device"` // First successful login from this device
+	NewIP     bool   `json:"new_ip"`     // First successful login from this address
+	CreatedAt string `json:"created_at"`
+}
+
+// ForgotPasswordRequest asks for a password reset link to be emailed
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest sets a new password with the token from a password reset link
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePasswordRequest replaces the password of a signed in user
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// LoginResponse carries the tokens of a successful login, or the challenge of a login that is
+// waiting for its second factor
+type LoginResponse struct {
+	UserID             string `json:"user_id,omitempty"`
+	DeviceID           string `json:"device_id,omitempty"` // Assigned if the login did not name a device
+	AccessToken        string `json:"access_token,omitempty"`
+	RefreshToken       string `json:"refresh_token,omitempty"`
+	MFARequired        bool   `json:"mfa_required,omitempty"`
+	ChallengeToken     string `json:"challenge_token,omitempty"`
+	ChallengeExpiresAt string `json:"challenge_expires_at,omitempty"`
+	// MFAEnrollmentNeeded is set when privileged roles were left out of the token because the
+	// account has no second factor
+	MFAEnrollmentNeeded bool `json:"mfa_enrollment_needed,omitempty"`
+	// LinkRequired is set when a provider account matches a user whose address is not verified,
+	// LinkToken then links it once the user's password is confirmed
+	LinkRequired bool   `json:"link_required,omitempty"`
+	LinkToken    string `json:"link_token,omitempty"`
+}
+
+// MFAChallenge is a login whose password was accepted and that waits for its second factor
+type MFAChallenge struct {
+	UserID    int
+	Username  string
+	Email     string
+	IPAddress string
+	Device    Device
+	Attempts  int
+}
+
+// MFALoginRequest completes a login with the challenge token and a TOTP or recovery code
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// MFACodeRequest carries a TOTP or recovery code confirming an MFA change
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPEnrollment is a new TOTP secret waiting to be confirmed with a code from the authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"` // Shown as a QR code for authenticator apps to scan
+}
+
+// RecoveryCodes are single-use codes that replace a TOTP code, shown to the user only once
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// OIDCLoginState is an OpenID Connect login waiting for the user to return from the provider
+type OIDCLoginState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	DeviceID     string
+}
+
+// OIDCPendingLink is a provider account waiting for the password of the user it would be linked to
+type OIDCPendingLink struct {
+	Provider string
+	Subject  string
+	UserID   int
+	Email    string
+	DeviceID string
+}
+
+// OIDCLinkRequest confirms the link of a provider account with the password of the user
+type OIDCLinkRequest struct {
+	LinkToken string `json:"link_token"`
+	Password  string `json:"password"`
+}
@@ -0,0 +1,186 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockProvider serves the discovery document and key set of an OpenID provider signing with key
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&discovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+			KeyID: "test-key",
+			Type:  "RSA",
+			Use:   "sig",
+			N:     base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:     base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// sign issues an ID token with the given key ID and signing key
+func (m *mockProvider) sign(t *testing.T, claims *Claims, keyID string, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims returns the claims of an ID token the provider issued to client for nonce
+func (m *mockProvider) validClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Nonce:         "nonce",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.URL,
+			Subject:   "provider-user-1",
+			Audience:  jwt.ClaimStrings{"client"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockProvider(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(claims *Claims)
+		keyID  string
+		key    *rsa.PrivateKey
+		err    string
+	}{
+		{name: "valid token"},
+		{name: "other issuer", modify: func(c *Claims) { c.Issuer = "https://evil.test" }, err: "invalid ID token"},
+		{name: "other audience", modify: func(c *Claims) { c.Audience = jwt.ClaimStrings{"other-client"} }, err: "invalid ID token"},
+		{name: "expired", modify: func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute)) }, err: "invalid ID token"},
+		{name: "expired within leeway", modify: func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-30 * time.Second)) }},
+		{name: "no expiry", modify: func(c *Claims) { c.ExpiresAt = nil }, err: "invalid ID token"},
+		{name: "other nonce", modify: func(c *Claims) { c.Nonce = "replayed" }, err: "nonce does not match"},
+		{name: "no subject", modify: func(c *Claims) { c.Subject = "" }, err: "has no subject"},
+		{name: "signed with another key", key: otherKey, err: "invalid ID token"},
+		{name: "unknown key ID", keyID: "rotated-away", err: "unknown signing key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := NewProvider(Config{Name: "mock", Issuer: m.URL, ClientID: "client"})
+			claims := m.validClaims()
+			if test.modify != nil {
+				test.modify(claims)
+			}
+			keyID, key := "test-key", m.key
+			if test.keyID != "" {
+				keyID = test.keyID
+			}
+			if test.key != nil {
+				key = test.key
+			}
+
+			verified, err := provider.VerifyIDToken(context.Background(), m.sign(t, claims, keyID, key), "nonce")
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("VerifyIDToken: %v", err)
+				}
+				if verified.Subject != "provider-user-1" || verified.Email != "ada@example.com" {
+					t.Errorf("VerifyIDToken returned %+v", verified)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("VerifyIDToken error = %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsSymmetricSignatures(t *testing.T) {
+	m := newMockProvider(t)
+	provider := NewProvider(Config{Name: "mock", Issuer: m.URL, ClientID: "client"})
+
+	// A token "signed" with HS256 using the public key as the secret must not verify
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, m.validClaims())
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(m.key.N.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyIDToken(context.Background(), signed, "nonce"); err == nil {
+		t.Error("VerifyIDToken accepted an HS256 token")
+	}
+}
+
+func TestVerifyIDTokenEmailVerified(t *testing.T) {
+	m := newMockProvider(t)
+	tests := []struct {
+		name       string
+		trustEmail bool
+		verified   bool
+		email      string
+		want       bool
+	}{
+		{"asserted by the provider", false, true, "ada@example.com", true},
+		{"not asserted", false, false, "ada@example.com", false},
+		{"trusted provider", true, false, "ada@example.com", true},
+		{"trusted provider without email", true, false, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := NewProvider(Config{Name: "mock", Issuer: m.URL, ClientID: "client", TrustEmail: test.trustEmail})
+			claims := m.validClaims()
+			claims.EmailVerified, claims.Email = test.verified, test.email
+
+			verified, err := provider.VerifyIDToken(context.Background(), m.sign(t, claims, "test-key", m.key), "nonce")
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if verified.EmailVerified != test.want {
+				t.Errorf("EmailVerified = %v, want %v", verified.EmailVerified, test.want)
+			}
+		})
+	}
+}
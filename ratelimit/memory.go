@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are dropped from a MemoryStore
+const sweepInterval = time.Minute
+
+// bucket is the state of a single token bucket
+type bucket struct {
+	tokens   float64
+	updated  time.Time
+	fullTime time.Time // When the bucket is full again if left alone
+}
+
+// MemoryStore keeps buckets in process memory. Limits are per replica.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore creates an empty in-memory bucket store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Take removes a token from the bucket of key if one is available
+func (s *MemoryStore) Take(key string, policy Policy, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	key = policy.Name + ":" + key
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(policy.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = refill(b.tokens, now.Sub(b.updated), policy)
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.fullTime = now.Add(fullAfter(policy))
+	return result(allowed, b.tokens, policy), nil
+}
+
+// sweep drops buckets that have refilled completely, they behave exactly like new ones
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	for key, b := range s.buckets {
+		if !now.Before(b.fullTime) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRefill(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	// Three requests at once, then one every 10 seconds
+	policy := Per("test", 3, 30*time.Second)
+
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{"first of the burst", 0, true, 2, 0},
+		{"second of the burst", 0, true, 1, 0},
+		{"last of the burst", 0, true, 0, 0},
+		{"empty bucket", 0, false, 0, 10 * time.Second},
+		{"partly refilled", 5 * time.Second, false, 0, 5 * time.Second},
+		{"refilled one token", 10 * time.Second, true, 0, 0},
+		{"refilled to the burst, not beyond", 10*time.Second + time.Hour, true, 2, 0},
+	}
+	store := NewMemoryStore()
+	for _, test := range tests {
+		result, err := store.Take("user", policy, start.Add(test.elapsed))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if result.Allowed != test.allowed || result.Remaining != test.remaining {
+			t.Errorf("%s: allowed %v with %d remaining, want %v with %d",
+				test.name, result.Allowed, result.Remaining, test.allowed, test.remaining)
+		}
+		if diff := result.RetryAfter - test.retryAfter; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%s: retry after %s, want %s", test.name, result.RetryAfter, test.retryAfter)
+		}
+	}
+}
+
+func TestMemoryStoreKeysAndPolicies(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	every := Every("single", time.Minute)
+	other := Every("other", time.Minute)
+
+	if result, _ := store.Take("a", every, now); !result.Allowed {
+		t.Fatal("first request of a was not allowed")
+	}
+	if result, _ := store.Take("a", every, now); result.Allowed {
+		t.Error("second request of a was allowed without a burst")
+	}
+	if result, _ := store.Take("b", every, now); !result.Allowed {
+		t.Error("b shares the bucket of a")
+	}
+	if result, _ := store.Take("a", other, now); !result.Allowed {
+		t.Error("another policy shares the bucket of a")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.lastSweep = now
+	policy := Per("test", 2, time.Minute)
+
+	store.Take("idle", policy, now)
+	store.Take("busy", policy, now.Add(50*time.Second))
+	store.Take("busy", policy, now.Add(50*time.Second))
+	store.Take("other", policy, now.Add(61*time.Second))
+
+	if _, ok := store.buckets["test:idle"]; ok {
+		t.Error("a refilled bucket was not swept")
+	}
+	if _, ok := store.buckets["test:busy"]; !ok {
+		t.Error("a bucket that is not full yet was swept")
+	}
+}
@@ -0,0 +1,57 @@
+// Package ratelimit implements token bucket rate limiting with pluggable bucket storage.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Policy describes a token bucket. Each allowed request takes one token, buckets hold up to
+// Burst tokens and refill at Rate tokens per second.
+type Policy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+// Per returns a policy allowing count requests per interval, all of which may be used at once
+func Per(name string, count int, interval time.Duration) Policy {
+	return Policy{Name: name, Rate: float64(count) / interval.Seconds(), Burst: count}
+}
+
+// Every returns a policy allowing one request per interval and no bursts
+func Every(name string, interval time.Duration) Policy {
+	return Per(name, 1, interval)
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed    bool
+	Remaining  int           // Whole tokens left in the bucket
+	RetryAfter time.Duration // Time until a token is available when the request was not allowed
+}
+
+// Store keeps token buckets. Implementations must take tokens atomically so that concurrent
+// callers, possibly on other replicas, never share a token.
+type Store interface {
+	Take(key string, policy Policy, now time.Time) (Result, error)
+}
+
+// refill returns the tokens of a bucket after elapsed time, capped at the burst size
+func refill(tokens float64, elapsed time.Duration, policy Policy) float64 {
+	return math.Min(float64(policy.Burst), tokens+elapsed.Seconds()*policy.Rate)
+}
+
+// result builds the outcome of a take from the tokens left in the bucket
+func result(allowed bool, tokens float64, policy Policy) Result {
+	r := Result{Allowed: allowed, Remaining: int(tokens)}
+	if !allowed {
+		r.RetryAfter = time.Duration((1 - tokens) / policy.Rate * float64(time.Second))
+	}
+	return r
+}
+
+// fullAfter is how long an unused bucket takes to refill completely, after which it can be forgotten
+func fullAfter(policy Policy) time.Duration {
+	return time.Duration(float64(policy.Burst) / policy.Rate * float64(time.Second))
+}
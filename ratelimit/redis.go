@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// takeScript refills and takes from a bucket stored as a hash in a single atomic step. It
+// returns whether a token was taken and the tokens left.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+if now > updated then
+	tokens = math.min(burst, tokens + (now - updated) / 1000 * rate)
+	updated = now
+end
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', updated)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisStore keeps buckets in Redis so that limits hold across replicas
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore creates a bucket store using the given client. Keys are prefixed with prefix.
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+// Take removes a token from the bucket of key if one is available
+func (s *RedisStore) Take(key string, policy Policy, now time.Time) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ttl := fullAfter(policy).Milliseconds() + 1
+	reply, err := takeScript.Run(ctx, s.client, []string{s.prefix + policy.Name + ":" + key},
+		policy.Rate, policy.Burst, now.UnixMilli(), ttl).Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("could not take rate limit token: %v", err)
+	}
+	if len(reply) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+
+	allowed, _ := reply[0].(int64)
+	remaining, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	return result(allowed == 1, tokens, policy), nil
+}
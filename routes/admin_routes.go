@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"expvar"
+	"net/http"
+	"websocket-server/handlers"
+	"websocket-server/utils"
+)
+
+// RegisterAdminRoutes sets up the routes reserved to moderators, admins and services
+func RegisterAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/roles", handlers.RequireScope(utils.ScopeUserAdmin, handlers.RolesHandler))                        // GET roles of a user
+	mux.HandleFunc("/admin/roles/grant", handlers.RequireScope(utils.ScopeUserAdmin, handlers.GrantRoleHandler))              // POST grant a role
+	mux.HandleFunc("/admin/roles/revoke", handlers.RequireScope(utils.ScopeUserAdmin, handlers.RevokeRoleHandler))            // POST revoke a role
+	mux.HandleFunc("/admin/devices/state", handlers.RequireScope(utils.ScopeUserAdmin, handlers.AdminDeviceStatesHandler))    // GET latest telemetry of a user's devices
+	mux.HandleFunc("/admin/broadcast", handlers.RequireScope(utils.ScopeBroadcast, handlers.BroadcastHandler))                // POST announce to every connected user
+	mux.HandleFunc("/moderation/messages/delete", handlers.RequireScope(utils.ScopeModerate, handlers.ModerateDeleteHandler)) // POST delete any message
+	mux.HandleFunc("/bots", handlers.RequireScope(utils.ScopeUserAdmin, handlers.BotsHandler))                                // GET list bots, POST create a bot
+	mux.HandleFunc("/bots/keys", handlers.RequireScope(utils.ScopeUserAdmin, handlers.APIKeysHandler))                        // GET keys of a bot, POST issue a key
+	mux.HandleFunc("/bots/keys/rotate", handlers.RequireScope(utils.ScopeUserAdmin, handlers.RotateAPIKeyHandler))            // POST replace a key
+	mux.HandleFunc("/bots/keys/revoke", handlers.RequireScope(utils.ScopeUserAdmin, handlers.RevokeAPIKeyHandler))            // POST disable a key
+	mux.HandleFunc("/debug/vars", handlers.RequireScope(utils.ScopeUserAdmin, expvar.Handler().ServeHTTP))                    // GET runtime counters such as rejected WebSocket upgrades
+}
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"net/http"
+	"websocket-server/handlers"
+	"websocket-server/utils"
+)
+
+// RegisterAttachmentRoutes sets up routes for the Attachment Service
+func RegisterAttachmentRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/attachments", handlers.RequireScope(utils.ScopeMessages, handlers.UploadAttachmentHandler))                // POST multipart upload
+	mux.HandleFunc("/attachments/uploads", handlers.RequireScope(utils.ScopeMessages, handlers.UploadsHandler))                 // POST start / GET status of a resumable upload
+	mux.HandleFunc("/attachments/uploads/chunk", handlers.RequireScope(utils.ScopeMessages, handlers.UploadChunkHandler))       // PUT a chunk of a resumable upload
+	mux.HandleFunc("/attachments/uploads/complete", handlers.RequireScope(utils.ScopeMessages, handlers.CompleteUploadHandler)) // POST finalize a resumable upload
+	mux.HandleFunc("/attachments/download", handlers.DownloadAttachmentHandler)                                                 // GET via signed URL
+}
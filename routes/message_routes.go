@@ -3,10 +3,26 @@ package routes
 import (
 	"net/http"
 	"websocket-server/handlers"
+	"websocket-server/utils"
 )
 
 // RegisterMessagingRoutes sets up WebSocket routes
 func RegisterMessagingRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/ws", handlers.WebSocketHandler) // WebSocket connection endpoint
+	mux.HandleFunc("/ws", handlers.WebSocketHandler)                                                                            // WebSocket connection endpoint
+	mux.HandleFunc("/ws/ticket", handlers.ConnectionTicketHandler)                                                              // POST exchange a token for a connection ticket
+	mux.HandleFunc("/threads", handlers.RequireScope(utils.ScopeMessages, handlers.ThreadRepliesHandler))                       // GET replies of a thread
+	mux.HandleFunc("/messages/forward", handlers.RequireScope(utils.ScopeMessages, handlers.ForwardHandler))                    // POST forward a message
+	mux.HandleFunc("/messages/pin", handlers.RequireScope(utils.ScopeMessages, handlers.PinHandler))                            // POST pin a message in its conversation
+	mux.HandleFunc("/messages/unpin", handlers.RequireScope(utils.ScopeMessages, handlers.UnpinHandler))                        // POST unpin a message
+	mux.HandleFunc("/conversations/pins", handlers.RequireScope(utils.ScopeMessages, handlers.ListPinsHandler))                 // GET pinned messages of a conversation
+	mux.HandleFunc("/conversations/messages", handlers.RequireScope(utils.ScopeMessages, handlers.ConversationMessagesHandler)) // GET messages and updates of a conversation after a sequence number
+	mux.HandleFunc("/messages/star", handlers.RequireScope(utils.ScopeMessages, handlers.StarHandler))                          // POST star a message for the caller
+	mux.HandleFunc("/messages/unstar", handlers.RequireScope(utils.ScopeMessages, handlers.UnstarHandler))                      // POST unstar a message
+	mux.HandleFunc("/messages/starred", handlers.RequireScope(utils.ScopeMessages, handlers.ListStarredHandler))                // GET the caller's starred messages
+	mux.HandleFunc("/messages/search", handlers.RequireScope(utils.ScopeMessages, handlers.SearchHandler))                      // GET full-text search over the caller's messages
+	mux.HandleFunc("/messages/read", handlers.RequireScope(utils.ScopeMessages, handlers.MarkReadHandler))                      // POST mark a received message read
+	mux.HandleFunc("/conversations/ttl", handlers.RequireScope(utils.ScopeMessages, handlers.ConversationTTLHandler))           // POST default lifetime of new messages
+	mux.HandleFunc("/messages/scheduled", handlers.RequireScope(utils.ScopeMessages, handlers.ScheduledMessagesHandler))        // GET list, POST create, PUT edit scheduled messages
+	mux.HandleFunc("/messages/scheduled/cancel", handlers.RequireScope(utils.ScopeMessages, handlers.CancelScheduledHandler))   // POST cancel a scheduled message
 	// mux.HandleFunc("/generate-token", handlers.GenerateTokenHandler)
 }
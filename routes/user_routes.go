@@ -3,13 +3,36 @@ package routes
 import (
 	"net/http"
 	"websocket-server/handlers"
+	"websocket-server/utils"
 )
 
 // RegisterUserRoutes sets up routes for the User Service
 func RegisterUserRoutes(mux *http.ServeMux) {
 	// User-related routes
-	mux.HandleFunc("/login", handlers.LoginHandler)       // POST for user login
-	mux.HandleFunc("/register", handlers.RegisterHandler) // POST for user registration
+	mux.HandleFunc("/login", handlers.LoginHandler)                                                                        // POST for user login
+	mux.HandleFunc("/login/mfa", handlers.MFALoginHandler)                                                                 // POST complete a login with its second factor
+	mux.HandleFunc("/oidc/providers", handlers.OIDCProvidersHandler)                                                       // GET identity providers to sign in with
+	mux.HandleFunc("/oidc/login", handlers.OIDCLoginHandler)                                                               // GET redirect to an identity provider
+	mux.HandleFunc("/oidc/callback", handlers.OIDCCallbackHandler)                                                         // GET complete a sign in at an identity provider, redirects to the app
+	mux.HandleFunc("/oidc/link", handlers.OIDCLinkHandler)                                                                 // POST link an identity provider account with the user's password
+	mux.HandleFunc("/login/history", handlers.RequireScope(utils.ScopeMessages, handlers.LoginHistoryHandler))             // GET recent login attempts on the caller's account
+	mux.HandleFunc("/users/lookup", handlers.RequireScope(utils.ScopeMessages, handlers.UserLookupHandler))                // GET translate between user IDs and usernames
+	mux.HandleFunc("/users/rename", handlers.RequireScope(utils.ScopeMessages, handlers.RenameHandler))                    // POST change the caller's username
+	mux.HandleFunc("/devices", handlers.RequireScope(utils.ScopeMessages, handlers.DevicesHandler))                        // GET the caller's devices with last seen time and address
+	mux.HandleFunc("/devices/rename", handlers.RequireScope(utils.ScopeMessages, handlers.RenameDeviceHandler))            // POST name one of the caller's devices
+	mux.HandleFunc("/devices/sign-out", handlers.RequireScope(utils.ScopeMessages, handlers.SignOutDeviceHandler))         // POST revoke a device's tokens and close its connection
+	mux.HandleFunc("/devices/state", handlers.RequireScope(utils.ScopeMessages, handlers.DeviceStatesHandler))             // GET latest telemetry of the caller's devices
+	mux.HandleFunc("/devices/telemetry", handlers.RequireScope(utils.ScopeMessages, handlers.TelemetryHistoryHandler))     // GET recent telemetry of one of the caller's devices
+	mux.HandleFunc("/register", handlers.RegisterHandler)                                                                  // POST for user registration
+	mux.HandleFunc("/verify-email", handlers.VerifyEmailHandler)                                                           // GET or POST confirm an email address
+	mux.HandleFunc("/verify-email/resend", handlers.RequireScope(utils.ScopeMessages, handlers.ResendVerificationHandler)) // POST send the verification email again
+	mux.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler)                                                     // POST email a password reset link
+	mux.HandleFunc("/password/reset", handlers.ResetPasswordHandler)                                                       // GET reset form, POST set a new password with a reset token
+	mux.HandleFunc("/password/change", handlers.RequireScope(utils.ScopeMessages, handlers.ChangePasswordHandler))         // POST replace the caller's password
+	mux.HandleFunc("/mfa/totp/enroll", handlers.RequireScope(utils.ScopeMessages, handlers.TOTPEnrollHandler))             // POST start TOTP enrollment, returns the secret and otpauth URI
+	mux.HandleFunc("/mfa/totp/confirm", handlers.RequireScope(utils.ScopeMessages, handlers.TOTPConfirmHandler))           // POST enable TOTP with a first code, returns recovery codes
+	mux.HandleFunc("/mfa/totp/disable", handlers.RequireScope(utils.ScopeMessages, handlers.TOTPDisableHandler))           // POST disable TOTP with a current code
+	mux.HandleFunc("/mfa/recovery-codes", handlers.RequireScope(utils.ScopeMessages, handlers.RecoveryCodesHandler))       // POST replace the recovery codes
 	// mux.HandleFunc("/user/logs", handlers.GetUserLogsHandler)       // GET logs for a user
 	// mux.HandleFunc("/user/details", handlers.GetUserDetailsHandler) // GET user details
 }
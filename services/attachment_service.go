@@ -0,0 +1,521 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/media"
+	"websocket-server/models"
+	"websocket-server/storage"
+	"websocket-server/utils"
+)
+
+const (
+	// MaxAttachmentSize is the largest upload accepted for any attachment type
+	MaxAttachmentSize = 100 << 20
+
+	downloadURLTTL = time.Hour
+	sniffLength    = 512
+
+	// uploadChunkTimeout is how long a chunk may take before another request can take over its offset
+	uploadChunkTimeout = 10 * time.Minute
+	// uploadIdleTimeout is how long a resumable upload is kept without receiving a chunk
+	uploadIdleTimeout = 24 * time.Hour
+)
+
+// attachmentSizeLimits caps the upload size for each attachment type
+var attachmentSizeLimits = map[string]int64{
+	"image": 10 << 20,
+	"video": MaxAttachmentSize,
+	"audio": 25 << 20,
+	"file":  25 << 20,
+}
+
+var (
+	attachmentStore storage.BlobStore
+	stagingDir      string
+	publicBaseURL   = strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+)
+
+// InitializeAttachmentStorage sets up the blob store for attachments and the staging
+// directory for resumable uploads.
+func InitializeAttachmentStorage() {
+	root := os.Getenv("ATTACHMENT_DIR")
+	if root == "" {
+		root = "attachments"
+	}
+	store, err := storage.NewLocalStore(root)
+	if err != nil {
+		log.Fatalf("Failed to initialize attachment storage: %v", err)
+	}
+	attachmentStore = store
+
+	stagingDir = os.Getenv("ATTACHMENT_STAGING_DIR")
+	if stagingDir == "" {
+		stagingDir = filepath.Join(os.TempDir(), "attachment-uploads")
+	}
+	if err := os.MkdirAll(stagingDir, 0o750); err != nil {
+		log.Fatalf("Failed to create upload staging directory: %v", err)
+	}
+
+	log.Printf("Attachment storage initialized at %s\n", root)
+}
+
+// AttachmentService provides attachment upload and download functionalities
+type AttachmentService struct {
+	store storage.BlobStore
+}
+
+// NewAttachmentService creates a new instance of AttachmentService
+func NewAttachmentService() *AttachmentService {
+	return &AttachmentService{store: attachmentStore}
+}
+
+// classifyContentType maps a MIME type to the coarse attachment type used by messages
+func classifyContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	default:
+		return "file"
+	}
+}
+
+// Upload stores a complete file received in a single request
+func (s *AttachmentService) Upload(ownerID, fileName string, content io.Reader) (*models.Attachment, error) {
+	tmp, err := os.CreateTemp(stagingDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not stage upload: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	written, err := io.Copy(tmp, io.LimitReader(content, MaxAttachmentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not stage upload: %v", err)
+	}
+	if written > MaxAttachmentSize {
+		return nil, fmt.Errorf("%w: attachment exceeds %d bytes", ErrInvalidRequest, MaxAttachmentSize)
+	}
+	return s.finalize(ownerID, fileName, tmp)
+}
+
+// StartUpload begins a resumable upload of a file of the declared size
+func (s *AttachmentService) StartUpload(ownerID string, request *models.UploadRequest) (*models.Upload, error) {
+	if request.Size <= 0 || request.Size > MaxAttachmentSize {
+		return nil, fmt.Errorf("%w: size must be between 1 and %d bytes", ErrInvalidRequest, MaxAttachmentSize)
+	}
+
+	uploadID, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	upload := &models.Upload{
+		ID:       uploadID,
+		OwnerID:  ownerID,
+		FileName: filepath.Base(request.FileName),
+		Size:     request.Size,
+	}
+	if err := database.CreateUpload(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// UploadStatus returns a resumable upload so clients can resume from its received offset
+func (s *AttachmentService) UploadStatus(ownerID, uploadID string) (*models.Upload, error) {
+	upload, err := database.GetUpload(uploadID, ownerID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: unknown upload", ErrInvalidRequest)
+	}
+	return upload, err
+}
+
+// AppendChunk writes a chunk at offset, which must equal the number of bytes received so far
+func (s *AttachmentService) AppendChunk(ownerID, uploadID string, offset int64, content io.Reader) (*models.Upload, error) {
+	upload, err := s.UploadStatus(ownerID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Received {
+		return nil, fmt.Errorf("%w: expected chunk at offset %d", ErrInvalidRequest, upload.Received)
+	}
+
+	// Claim the offset first, so that concurrent chunks never write the staged file together
+	claimed, err := database.ClaimUploadChunk(upload.ID, offset, uploadChunkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("%w: another chunk is being written or the offset moved", ErrInvalidRequest)
+	}
+	written, err := s.writeChunk(upload, offset, content)
+	if err != nil {
+		if releaseErr := database.ReleaseUpload(upload.ID); releaseErr != nil {
+			log.Printf("%v\n", releaseErr)
+		}
+		return nil, err
+	}
+
+	advanced, err := database.AdvanceUpload(upload.ID, offset, offset+written)
+	if err != nil {
+		return nil, err
+	}
+	if !advanced {
+		return nil, fmt.Errorf("%w: upload was modified concurrently", ErrInvalidRequest)
+	}
+	upload.Received = offset + written
+	return upload, nil
+}
+
+// writeChunk writes a claimed chunk to the staged file and returns its length
+func (s *AttachmentService) writeChunk(upload *models.Upload, offset int64, content io.Reader) (int64, error) {
+	file, err := os.OpenFile(filepath.Join(stagingDir, upload.ID), os.O_WRONLY|os.O_CREATE, 0o640)
+	if err != nil {
+		return 0, fmt.Errorf("could not open staged upload: %v", err)
+	}
+	defer file.Close()
+
+	// Drop anything left behind by an interrupted chunk before writing
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("could not prepare staged upload: %v", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("could not prepare staged upload: %v", err)
+	}
+
+	remaining := upload.Size - offset
+	written, err := io.Copy(file, io.LimitReader(content, remaining+1))
+	if err != nil {
+		return 0, fmt.Errorf("could not write chunk: %v", err)
+	}
+	if written > remaining {
+		return 0, fmt.Errorf("%w: chunk exceeds the declared size", ErrInvalidRequest)
+	}
+	return written, nil
+}
+
+// StartUploadReaper periodically deletes resumable uploads that saw no chunk for uploadIdleTimeout
+// together with their staged files
+func StartUploadReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ids, err := database.DeleteStaleUploads(time.Now().Add(-uploadIdleTimeout))
+			if err != nil {
+				log.Printf("Failed to reap stale uploads: %v\n", err)
+				continue
+			}
+			for _, id := range ids {
+				if err := os.Remove(filepath.Join(stagingDir, id)); err != nil && !os.IsNotExist(err) {
+					log.Printf("Failed to remove staged upload %s: %v\n", id, err)
+				}
+			}
+			if len(ids) > 0 {
+				log.Printf("Reaped %d stale uploads\n", len(ids))
+			}
+		}
+	}()
+	log.Printf("Started upload reaper running every %s\n", interval)
+}
+
+// CompleteUpload turns a fully received resumable upload into an attachment
+func (s *AttachmentService) CompleteUpload(ownerID, uploadID string) (*models.Attachment, error) {
+	upload, err := s.UploadStatus(ownerID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Received != upload.Size {
+		return nil, fmt.Errorf("%w: received %d of %d bytes", ErrInvalidRequest, upload.Received, upload.Size)
+	}
+
+	path := filepath.Join(stagingDir, upload.ID)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open staged upload: %v", err)
+	}
+	defer file.Close()
+
+	attachment, err := s.finalize(ownerID, upload.FileName, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.DeleteUpload(upload.ID); err != nil {
+		log.Printf("Failed to delete upload %s: %v\n", upload.ID, err)
+	}
+	os.Remove(path)
+	return attachment, nil
+}
+
+// finalize sniffs, sanitizes, hashes and stores a staged file and records it as an attachment.
+// Identical content is stored once and shared by every attachment referencing it.
+func (s *AttachmentService) finalize(ownerID, fileName string, file *os.File) (*models.Attachment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not read staged upload: %v", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("%w: attachment is empty", ErrInvalidRequest)
+	}
+
+	head := make([]byte, min(size, sniffLength))
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("could not read staged upload: %v", err)
+	}
+	contentType := http.DetectContentType(head)
+	attachmentType := classifyContentType(contentType)
+	if size > attachmentSizeLimits[attachmentType] {
+		return nil, fmt.Errorf("%w: %s attachments are limited to %d bytes", ErrInvalidRequest, attachmentType, attachmentSizeLimits[attachmentType])
+	}
+
+	// Location data must never reach storage, so it is removed before hashing. HEIF images keep
+	// it where it cannot be removed and are refused.
+	switch {
+	case media.IsHEIF(head):
+		return nil, fmt.Errorf("%w: HEIC and HEIF images are not supported, send them as JPEG", ErrInvalidRequest)
+	case media.IsISOBMFF(head):
+		if _, err := media.StripMP4Location(file, size); err != nil {
+			return nil, fmt.Errorf("could not sanitize staged upload: %v", err)
+		}
+	case attachmentType == "image":
+		if err := stripLocation(file, size); err != nil {
+			return nil, err
+		}
+	}
+
+	attachment := &models.Attachment{
+		OwnerID:        ownerID,
+		FileName:       filepath.Base(fileName),
+		ContentType:    contentType,
+		AttachmentType: attachmentType,
+		Size:           size,
+		MediaStatus:    mediaStatusNone,
+	}
+	if attachmentType == "image" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("could not read staged upload: %v", err)
+		}
+		if width, height, _, err := media.Dimensions(file); err == nil {
+			attachment.Width, attachment.Height = width, height
+			attachment.MediaStatus = mediaStatusPending
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not read staged upload: %v", err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("could not hash staged upload: %v", err)
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+
+	attachment.ID, err = utils.GenerateRandomString(24)
+	if err != nil {
+		return nil, err
+	}
+	attachment.SHA256 = digest
+	attachment.StorageKey = digest
+
+	// The blob is found or stored and referenced under its lock, so a message deletion that
+	// releases the same blob cannot remove it in between
+	err = database.WithBlobLock(digest, func() error {
+		exists, err := s.store.Exists(digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("could not read staged upload: %v", err)
+			}
+			if _, err := s.store.Put(digest, file); err != nil {
+				return err
+			}
+		}
+		return database.SaveAttachment(attachment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attachment.MediaStatus == mediaStatusPending {
+		enqueueMediaJob(attachment.ID)
+	}
+	attachment.URL = SignedAttachmentURL(attachment.ID)
+	return attachment, nil
+}
+
+// stripLocation removes GPS metadata from a staged image in place
+func stripLocation(file *os.File, size int64) error {
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("could not read staged upload: %v", err)
+	}
+	if !media.StripLocation(data) {
+		return nil
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("could not sanitize staged upload: %v", err)
+	}
+	return nil
+}
+
+// Open verifies a signed download URL and returns the attachment and its content. A non-empty
+// size selects the thumbnail with that bound instead of the original file.
+func (s *AttachmentService) Open(attachmentID, size, expires, signature string) (*models.Attachment, io.ReadCloser, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !utils.VerifySignedValue(signedAttachmentValue(attachmentID, size), expiresAt, signature) {
+		return nil, nil, ErrForbidden
+	}
+
+	attachment, err := database.GetAttachment(attachmentID)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("could not load attachment: %v", err)
+	}
+
+	key := attachment.StorageKey
+	if size != "" {
+		thumbnail, err := findThumbnail(attachment.SHA256, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = thumbnail.StorageKey
+		attachment.ContentType = thumbnail.ContentType
+		attachment.Size = 0
+	}
+
+	content, err := s.store.Open(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open attachment: %v", err)
+	}
+	return attachment, content, nil
+}
+
+// findThumbnail returns the thumbnail of a blob with the given bound
+func findThumbnail(sha256, size string) (*models.Thumbnail, error) {
+	thumbnails, err := database.ListThumbnails(sha256)
+	if err != nil {
+		return nil, err
+	}
+	for _, thumbnail := range thumbnails {
+		if strconv.Itoa(thumbnail.MaxSide) == size {
+			return thumbnail, nil
+		}
+	}
+	return nil, ErrAttachmentNotFound
+}
+
+// LinkAttachment fills in the attachment fields of an outgoing message from the stored
+// attachment it references. Only the uploader may attach a file to a new message.
+func (s *AttachmentService) LinkAttachment(msg *models.Message) error {
+	attachment, err := database.GetAttachment(msg.AttachmentID)
+	if err == sql.ErrNoRows || (err == nil && attachment.OwnerID != msg.SenderID) {
+		return fmt.Errorf("%w: unknown attachment %s", ErrInvalidRequest, msg.AttachmentID)
+	} else if err != nil {
+		return fmt.Errorf("could not load attachment: %v", err)
+	}
+
+	msg.AttachmentType = attachment.AttachmentType
+	msg.AttachmentURL = ""
+	if msg.MessageType == "" {
+		msg.MessageType = attachment.AttachmentType
+	}
+	return nil
+}
+
+// signedAttachmentValue is the value signed for the original file or one of its thumbnails
+func signedAttachmentValue(attachmentID, size string) string {
+	if size == "" {
+		return attachmentID
+	}
+	return attachmentID + "/" + size
+}
+
+// SignedAttachmentURL returns a time-limited download URL for an attachment
+func SignedAttachmentURL(attachmentID string) string {
+	return signedDownloadURL(attachmentID, "")
+}
+
+// signedDownloadURL returns a time-limited download URL for an attachment or one of its thumbnails
+func signedDownloadURL(attachmentID, size string) string {
+	signature, expiresAt := utils.SignValue(signedAttachmentValue(attachmentID, size), time.Now().Add(downloadURLTTL))
+	query := url.Values{}
+	query.Set("id", attachmentID)
+	if size != "" {
+		query.Set("size", size)
+	}
+	query.Set("expires", strconv.FormatInt(expiresAt, 10))
+	query.Set("sig", signature)
+	return publicBaseURL + "/attachments/download?" + query.Encode()
+}
+
+// presentAttachments sets fresh download URLs on messages that reference uploaded attachments
+// and adds the dimensions and thumbnails of image attachments
+func presentAttachments(messages ...*models.Message) {
+	imageIDs := []string{}
+	for _, msg := range messages {
+		if msg == nil || msg.AttachmentID == "" {
+			continue
+		}
+		msg.AttachmentURL = SignedAttachmentURL(msg.AttachmentID)
+		if msg.AttachmentType == "image" {
+			imageIDs = append(imageIDs, msg.AttachmentID)
+		}
+	}
+	if len(imageIDs) == 0 {
+		return
+	}
+
+	media, err := database.ListMediaInfo(imageIDs)
+	if err != nil {
+		log.Printf("Failed to load media of attachments: %v\n", err)
+		return
+	}
+	for attachmentID, info := range media {
+		for _, thumbnail := range info.Thumbnails {
+			thumbnail.URL = signedDownloadURL(attachmentID, strconv.Itoa(thumbnail.MaxSide))
+		}
+	}
+	for _, msg := range messages {
+		if msg != nil && msg.AttachmentType == "image" {
+			msg.Media = media[msg.AttachmentID]
+		}
+	}
+}
+
+// releaseBlobs deletes the stored blobs, by digest, that deleted attachments left unreferenced,
+// together with their thumbnails
+func releaseBlobs(blobs map[string]string) {
+	for digest, storageKey := range blobs {
+		err := database.ReleaseBlob(digest, storageKey, func(keys []string) error {
+			for _, key := range keys {
+				if err := attachmentStore.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to delete blob %s: %v\n", digest, err)
+		}
+	}
+}
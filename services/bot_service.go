@@ -0,0 +1,296 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// apiKeyPrefix starts every API key, so keys are told apart from access tokens and are easy
+	// to find by secret scanners. Keys look like wsk_<key ID>_<secret>.
+	apiKeyPrefix = "wsk_"
+
+	// apiKeyRotationGrace is how long a rotated key keeps working, so services can roll out its successor
+	apiKeyRotationGrace = time.Hour
+
+	// apiKeySessionLifetime caps how long a connection opened with an API key lives before it has
+	// to re-authenticate, like one opened with an access token
+	apiKeySessionLifetime = 24 * time.Hour
+
+	// maxAPIKeyLifetimeDays bounds the expiry requested for a new key
+	maxAPIKeyLifetimeDays = 3650
+)
+
+// botNamePattern is the form of bot names. The _bot suffix is reserved, so bots are recognizable
+// and never collide with users.
+var botNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,58}_bot$`)
+
+// ErrInvalidAPIKey is returned for unknown, expired or revoked API keys
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// IsBotName reports whether a username is reserved for bots
+func IsBotName(username string) bool {
+	return strings.HasSuffix(strings.ToLower(username), "_bot")
+}
+
+// userIDPattern matches the shape of the user IDs of users and bots
+var userIDPattern = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+// IsUserIDName reports whether a username is shaped like a user ID. Such names are refused so
+// that no name can stand for another user's ID.
+func IsUserIDName(username string) bool {
+	return userIDPattern.MatchString(strings.TrimSpace(username))
+}
+
+// BotService manages bot accounts and the API keys they authenticate with
+type BotService struct{}
+
+// NewBotService creates a new instance of BotService
+func NewBotService() *BotService {
+	return &BotService{}
+}
+
+// hashAPIKeySecret returns the stored form of the secret part of an API key
+func hashAPIKeySecret(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+// CreateBot creates a bot account
+func (s *BotService) CreateBot(adminID string, request *models.CreateBotRequest) (*models.Bot, error) {
+	if !botNamePattern.MatchString(request.Name) {
+		return nil, fmt.Errorf("%w: bot names are lowercase and end in _bot", ErrInvalidRequest)
+	}
+	bot := &models.Bot{ID: request.Name, DisplayName: request.DisplayName, CreatedBy: adminID}
+	if bot.DisplayName == "" {
+		bot.DisplayName = strings.TrimSuffix(bot.ID, "_bot")
+	}
+	created, err := database.CreateBot(bot)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: the name %q is taken", ErrInvalidRequest, bot.ID)
+	}
+	s.recordChange(adminID, "create_bot", bot.ID)
+	return bot, nil
+}
+
+// ListBots returns every bot account
+func (s *BotService) ListBots() ([]*models.Bot, error) {
+	return database.ListBots()
+}
+
+// CreateAPIKey issues a new API key for a bot. The key is returned in full only here.
+func (s *BotService) CreateAPIKey(adminID string, request *models.CreateAPIKeyRequest) (*models.APIKey, error) {
+	if err := s.checkBot(request.BotID); err != nil {
+		return nil, err
+	}
+	scopes := request.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{utils.ScopeMessages}
+	}
+	allowed := utils.ScopesForRoles([]string{utils.RoleService})
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return nil, fmt.Errorf("%w: bots cannot be granted the scope %q", ErrInvalidRequest, scope)
+		}
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > maxAPIKeyLifetimeDays {
+		return nil, fmt.Errorf("%w: expires_in_days must be between 0 and %d", ErrInvalidRequest, maxAPIKeyLifetimeDays)
+	}
+	var expiresAt sql.NullTime
+	if request.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, request.ExpiresInDays), Valid: true}
+	}
+
+	key, err := s.issueAPIKey(request.BotID, request.Name, scopes, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	s.recordChange(adminID, "create_api_key", request.BotID+":"+key.ID)
+	return key, nil
+}
+
+// issueAPIKey generates and stores a key
+func (s *BotService) issueAPIKey(botID, name string, scopes []string, expiresAt sql.NullTime) (*models.APIKey, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	secret, err := utils.GenerateRandomString(43)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &models.APIKey{ID: hex.EncodeToString(id), BotID: botID, Name: name, Scopes: slices.Sorted(slices.Values(scopes))}
+	if err := database.CreateAPIKey(key, hashAPIKeySecret(secret), expiresAt); err != nil {
+		return nil, err
+	}
+	key.Key = apiKeyPrefix + key.ID + "_" + secret
+	return key, nil
+}
+
+// ListAPIKeys returns the keys of a bot without their secrets
+func (s *BotService) ListAPIKeys(botID string) ([]*models.APIKey, error) {
+	if err := s.checkBot(botID); err != nil {
+		return nil, err
+	}
+	return database.ListAPIKeys(botID)
+}
+
+// RotateAPIKey replaces a key with a new one with the same name, scopes and lifetime. The old
+// key keeps working for apiKeyRotationGrace, and so does a connection opened with it unless it
+// re-authenticates with the new key.
+func (s *BotService) RotateAPIKey(adminID, keyID string) (*models.APIKey, error) {
+	old, _, err := database.GetAPIKey(keyID)
+	if err == sql.ErrNoRows || (err == nil && old.RevokedAt != "") {
+		return nil, fmt.Errorf("%w: unknown or revoked API key", ErrInvalidRequest)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var expiresAt sql.NullTime
+	if old.ExpiresAt != "" {
+		oldExpiry, _ := time.Parse(time.RFC3339, old.ExpiresAt)
+		oldCreated, _ := time.Parse(time.RFC3339, old.CreatedAt)
+		expiresAt = sql.NullTime{Time: time.Now().Add(oldExpiry.Sub(oldCreated)), Valid: true}
+	}
+	key, err := s.issueAPIKey(old.BotID, old.Name, old.Scopes, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	graceEnd := time.Now().Add(apiKeyRotationGrace)
+	if _, err := database.ExpireAPIKey(keyID, graceEnd); err != nil {
+		return nil, err
+	}
+	for _, connection := range connections.OpenConnections(old.BotUserID, apiKeyDeviceID(keyID)) {
+		if connection.ExpiresAt().After(graceEnd) {
+			WatchTokenExpiry(connection, graceEnd)
+		}
+	}
+	s.recordChange(adminID, "rotate_api_key", old.BotID+":"+keyID+"->"+key.ID)
+	return key, nil
+}
+
+// RevokeAPIKey disables a key at once and closes the connections of its bot opened with it
+func (s *BotService) RevokeAPIKey(adminID, keyID string) error {
+	botUserID, err := database.RevokeAPIKey(keyID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: unknown or revoked API key", ErrInvalidRequest)
+	} else if err != nil {
+		return err
+	}
+	connections.CloseConnections(botUserID, apiKeyDeviceID(keyID), connections.CloseCredentialsRevoked, "API key revoked")
+	s.recordChange(adminID, "revoke_api_key", botUserID+":"+keyID)
+	return nil
+}
+
+// checkBot validates the bot an operation applies to
+func (s *BotService) checkBot(botID string) error {
+	exists, err := database.BotExists(botID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: unknown bot %q", ErrInvalidRequest, botID)
+	}
+	return nil
+}
+
+// recordChange writes a bot or key change to the moderation log
+func (s *BotService) recordChange(adminID, action, target string) {
+	log.Printf("%s: %s %s\n", adminID, action, target)
+	if err := database.RecordModerationAction(adminID, action, target); err != nil {
+		log.Printf("%v\n", err)
+	}
+}
+
+// IsAPIKey reports whether a credential is an API key rather than an access token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// AuthenticateAPIKey validates an API key and returns claims for its bot, as if it had signed in
+// with the service role and the key's scopes
+func AuthenticateAPIKey(token string) (*utils.Claims, error) {
+	keyID, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok || !IsAPIKey(token) {
+		return nil, ErrInvalidAPIKey
+	}
+	key, secretHash, err := database.GetAPIKey(keyID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(secretHash)) != 1 || key.RevokedAt != "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(apiKeySessionLifetime)
+	if key.ExpiresAt != "" {
+		keyExpiry, _ := time.Parse(time.RFC3339, key.ExpiresAt)
+		if !keyExpiry.After(now) {
+			return nil, ErrInvalidAPIKey
+		}
+		if keyExpiry.Before(expiresAt) {
+			expiresAt = keyExpiry
+		}
+	}
+	if err := database.TouchAPIKey(key.ID); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	return &utils.Claims{
+		UserName: key.BotID,
+		DeviceID: apiKeyDeviceID(key.ID),
+		Roles:    []string{utils.RoleService},
+		Scopes:   key.Scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        key.ID,
+			Subject:   key.BotUserID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}, nil
+}
+
+// apiKeyDeviceID returns the device connections authenticated with an API key are opened from
+func apiKeyDeviceID(keyID string) string {
+	return "api-key-" + keyID
+}
+
+// AuthenticateToken validates the credential of a request or connection, either an access token
+// that has not been revoked or a bot's API key
+func AuthenticateToken(token string) (*utils.Claims, error) {
+	if IsAPIKey(token) {
+		return AuthenticateAPIKey(token)
+	}
+	claims, err := utils.ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckTokenRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
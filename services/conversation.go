@@ -0,0 +1,111 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	directConversationPrefix  = "dm:"
+	channelConversationPrefix = "channel:"
+)
+
+// ConversationID derives the conversation a message belongs to. Channel messages share
+// the channel's conversation, direct messages share one per pair of users.
+func ConversationID(msg *models.Message) string {
+	if msg.ChannelID != "" {
+		return channelConversationPrefix + msg.ChannelID
+	}
+	users := []string{msg.SenderID, msg.RecipientID}
+	sort.Strings(users)
+	return directConversationPrefix + strings.Join(users, ":")
+}
+
+// checkRecipient validates the recipient of a message. Direct messages must go to an existing user
+// or bot, whose ID is part of the conversation ID.
+func checkRecipient(msg *models.Message) error {
+	if msg.RecipientID == "" {
+		return fmt.Errorf("%w: missing recipient ID", ErrInvalidRequest)
+	}
+	if msg.ChannelID != "" {
+		return nil
+	}
+	exists, err := database.UserIDExists(msg.RecipientID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: unknown recipient %q", ErrInvalidRequest, msg.RecipientID)
+	}
+	return nil
+}
+
+// CanAccessConversation reports whether a user is allowed to read a conversation
+func CanAccessConversation(userID, conversationID string) (bool, error) {
+	if channelID, ok := strings.CutPrefix(conversationID, channelConversationPrefix); ok {
+		return database.IsChannelMember(channelID, userID)
+	}
+	if pair, ok := strings.CutPrefix(conversationID, directConversationPrefix); ok {
+		for _, member := range strings.Split(pair, ":") {
+			if member == userID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ConversationMembers returns every user who can read a conversation
+func ConversationMembers(conversationID string) ([]string, error) {
+	if channelID, ok := strings.CutPrefix(conversationID, channelConversationPrefix); ok {
+		return database.ListChannelMembers(channelID)
+	}
+	if pair, ok := strings.CutPrefix(conversationID, directConversationPrefix); ok {
+		return strings.Split(pair, ":"), nil
+	}
+	return nil, nil
+}
+
+// publishConversationUpdate records a change in a conversation's update log, so that reconnecting
+// clients can replay it, and pushes it to every connected member. The actor receives it as well
+// because the update takes a sequence number in the conversation.
+func publishConversationUpdate(conversationID, eventType string, payload interface{}) {
+	event, err := database.RecordConversationUpdate(conversationID, eventType, payload)
+	if err != nil {
+		log.Printf("Failed to record %s in conversation %s: %v\n", eventType, conversationID, err)
+		event = &models.Event{Type: eventType, Payload: payload, ConversationID: conversationID}
+	}
+
+	members, err := ConversationMembers(conversationID)
+	if err != nil {
+		log.Printf("Failed to notify conversation %s: %v\n", conversationID, err)
+		return
+	}
+	for _, member := range members {
+		sendEvent(member, models.PriorityNormal, event)
+	}
+}
+
+// loadVisibleMessage loads a message and makes sure the user can read its conversation
+func loadVisibleMessage(userID, messageID string) (*models.Message, error) {
+	msg, err := database.GetMessage(messageID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load message: %v", err)
+	}
+
+	allowed, err := CanAccessConversation(userID, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrMessageNotFound
+	}
+	return msg, nil
+}
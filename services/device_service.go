@@ -0,0 +1,162 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/ratelimit"
+)
+
+const (
+	// FrameTelemetry is the type of the client frame reporting the live attributes of the
+	// connection's device
+	FrameTelemetry = "telemetry"
+
+	// maxDeviceNameLength bounds the name a user gives a device
+	maxDeviceNameLength = 64
+	// maxTelemetryValueLength bounds the text attributes of a telemetry report
+	maxTelemetryValueLength = 128
+	// telemetryHistorySize is how many snapshots are kept per device
+	telemetryHistorySize = 100
+	// telemetryInterval is how often a device may report telemetry
+	telemetryInterval = 10 * time.Second
+	// locationRetention is how long a reported location is kept, in the latest state and the history
+	locationRetention = 7 * 24 * time.Hour
+)
+
+// PolicyTelemetry limits telemetry reports per device, apart from the messages a user sends
+var PolicyTelemetry = ratelimit.Every("telemetry", telemetryInterval)
+
+// DeviceService lets users see the devices they are signed in on, name them, sign them out
+// remotely and follow the telemetry they report
+type DeviceService struct{}
+
+// NewDeviceService creates a new instance of DeviceService
+func NewDeviceService() *DeviceService {
+	return &DeviceService{}
+}
+
+// ListDevices returns a user's devices, marking the one with the live connection and the current
+// device of the caller
+func (s *DeviceService) ListDevices(userID, currentDeviceID string) ([]*models.DeviceSession, error) {
+	devices, err := database.ListDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		device.Online = len(connections.OpenConnections(userID, device.DeviceID)) > 0
+		device.Current = device.DeviceID == currentDeviceID
+	}
+	return devices, nil
+}
+
+// RenameDevice sets the name one of a user's devices is shown with
+func (s *DeviceService) RenameDevice(userID string, request *models.RenameDeviceRequest) error {
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len(name) > maxDeviceNameLength {
+		return fmt.Errorf("%w: device names are 1 to %d characters", ErrInvalidRequest, maxDeviceNameLength)
+	}
+	renamed, err := database.RenameDevice(userID, request.DeviceID, name)
+	if err != nil {
+		return err
+	}
+	if !renamed {
+		return fmt.Errorf("%w: unknown device %q", ErrInvalidRequest, request.DeviceID)
+	}
+	return nil
+}
+
+// SignOutDevice revokes the tokens a user was issued on one of their devices and closes every
+// connection opened from it. The device can sign in again.
+func (s *DeviceService) SignOutDevice(userID, deviceID string) error {
+	signedOut, err := database.SignOutDevice(userID, deviceID)
+	if err != nil {
+		return err
+	}
+	if !signedOut {
+		return fmt.Errorf("%w: unknown device %q", ErrInvalidRequest, deviceID)
+	}
+
+	connections.CloseConnections(userID, deviceID, connections.CloseCredentialsRevoked, "device signed out")
+	log.Printf("Signed out device %s of %s\n", deviceID, userID)
+	return nil
+}
+
+// ReportTelemetry stores a telemetry report of the device a connection was opened from. Reports
+// beyond PolicyTelemetry fail with a *RateLimitError.
+func (s *DeviceService) ReportTelemetry(connection *connections.Connection, report *models.DeviceTelemetry) error {
+	if connection.DeviceID == "" {
+		return fmt.Errorf("%w: the connection was not opened from a known device", ErrInvalidRequest)
+	}
+	if err := CheckRateLimit(PolicyTelemetry, connection.UserID+":"+connection.DeviceID); err != nil {
+		return err
+	}
+	if report == nil {
+		return fmt.Errorf("%w: missing telemetry", ErrInvalidRequest)
+	}
+	if report.BatteryLevel != nil && (*report.BatteryLevel < 0 || *report.BatteryLevel > 100) {
+		return fmt.Errorf("%w: battery_level must be between 0 and 100", ErrInvalidRequest)
+	}
+	for _, value := range []*string{report.ConnectivityType, report.Location, report.Status} {
+		if value != nil && len(*value) > maxTelemetryValueLength {
+			return fmt.Errorf("%w: telemetry values are at most %d characters", ErrInvalidRequest, maxTelemetryValueLength)
+		}
+	}
+
+	return database.RecordTelemetry(connection.UserID, connection.DeviceID, report, telemetryHistorySize)
+}
+
+// DeviceStates returns the latest telemetry of a user's devices
+func (s *DeviceService) DeviceStates(userID string) ([]*models.DeviceState, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("%w: missing user_id", ErrInvalidRequest)
+	}
+	states, err := database.ListDeviceStates(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		state.Online = len(connections.OpenConnections(userID, state.DeviceID)) > 0
+	}
+	return states, nil
+}
+
+// TelemetryHistory returns the snapshots kept for one of a user's devices, newest first
+func (s *DeviceService) TelemetryHistory(userID, deviceID string) ([]*models.DeviceTelemetry, error) {
+	if deviceID == "" {
+		return nil, fmt.Errorf("%w: missing device_id", ErrInvalidRequest)
+	}
+	return database.ListTelemetryHistory(userID, deviceID, telemetryHistorySize)
+}
+
+// TouchDevice records that a user's device was seen, and from which address unless ipAddress is empty
+func (s *DeviceService) TouchDevice(userID, deviceID, ipAddress string) {
+	if deviceID == "" {
+		return
+	}
+	if err := database.TouchDevice(userID, deviceID, ipAddress); err != nil {
+		log.Printf("%v\n", err)
+	}
+}
+
+// StartLocationPruner periodically clears the device locations reported longer than the location
+// retention ago
+func StartLocationPruner(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cleared, err := database.ClearStaleLocations(time.Now().Add(-locationRetention))
+			if err != nil {
+				log.Printf("Failed to clear stale device locations: %v\n", err)
+			} else if cleared > 0 {
+				log.Printf("Cleared %d stale device locations\n", cleared)
+			}
+		}
+	}()
+	log.Printf("Started location pruner running every %s\n", interval)
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	// EventMessageDeleted is pushed to conversation members when a message is removed
+	EventMessageDeleted = "message_deleted"
+	// EventConversationTTLChanged is pushed when the default lifetime of a conversation changes
+	EventConversationTTLChanged = "conversation_ttl_changed"
+
+	minMessageTTL = 5
+	maxMessageTTL = 30 * 24 * 60 * 60
+
+	reaperBatchSize = 500
+)
+
+// EphemeralService provides self-destructing message functionalities
+type EphemeralService struct{}
+
+// NewEphemeralService creates a new instance of EphemeralService
+func NewEphemeralService() *EphemeralService {
+	return &EphemeralService{}
+}
+
+// validateTTL checks that a lifetime is either disabled (0) or within the supported range
+func validateTTL(ttlSeconds int) error {
+	if ttlSeconds != 0 && (ttlSeconds < minMessageTTL || ttlSeconds > maxMessageTTL) {
+		return fmt.Errorf("%w: ttl must be between %d and %d seconds", ErrInvalidRequest, minMessageTTL, maxMessageTTL)
+	}
+	return nil
+}
+
+// applyExpiry resolves the lifetime of an outgoing message from the message itself or,
+// when it has none, from its conversation's default. The expiry time is always server-assigned.
+func applyExpiry(msg *models.Message) error {
+	msg.ExpiresAt = ""
+	if msg.TTLSeconds < 0 {
+		msg.TTLSeconds = 0
+	}
+	if msg.TTLSeconds == 0 {
+		ttlSeconds, expireAfterRead, err := database.GetConversationTTL(msg.ConversationID)
+		if err != nil {
+			return err
+		}
+		msg.TTLSeconds, msg.ExpireAfterRead = ttlSeconds, expireAfterRead
+	}
+	if msg.TTLSeconds == 0 {
+		msg.ExpireAfterRead = false
+	}
+	return validateTTL(msg.TTLSeconds)
+}
+
+// SetConversationTTL changes the default lifetime of new messages in a conversation. Any member
+// of a direct conversation may change it, channels require a moderator.
+func (s *EphemeralService) SetConversationTTL(userID string, request *models.ConversationTTLRequest) error {
+	if err := validateTTL(request.TTLSeconds); err != nil {
+		return err
+	}
+
+	allowed, err := CanAccessConversation(userID, request.ConversationID)
+	if err != nil {
+		return err
+	}
+	if channelID, ok := strings.CutPrefix(request.ConversationID, channelConversationPrefix); ok && allowed {
+		role, err := database.GetChannelRole(channelID, userID)
+		if err != nil {
+			return err
+		}
+		allowed = channelRoleRanks[role] >= channelRoleRanks["moderator"]
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+
+	expireAfterRead := request.ExpireAfterRead && request.TTLSeconds > 0
+	if err := database.SetConversationTTL(request.ConversationID, request.TTLSeconds, expireAfterRead, userID); err != nil {
+		return err
+	}
+	request.ExpireAfterRead = expireAfterRead
+	publishConversationUpdate(request.ConversationID, EventConversationTTLChanged, request)
+	return nil
+}
+
+// MarkRead records that the recipient read a message, starting its lifetime if it expires after being read
+func (s *EphemeralService) MarkRead(userID, messageID string) (*models.Message, error) {
+	msg, err := database.MarkMessageRead(messageID, userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("could not mark message read: %v", err)
+	}
+	msg.IsRead = true
+	presentAttachments(msg)
+	return msg, nil
+}
+
+// StartMessageReaper periodically hard-deletes expired messages and their attachments and tells
+// the members of their conversations to drop them
+func StartMessageReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reapExpiredMessages()
+		}
+	}()
+	log.Printf("Started message reaper running every %s\n", interval)
+}
+
+// reapExpiredMessages deletes expired messages in batches until none are left
+func reapExpiredMessages() {
+	for {
+		deleted, blobs, err := database.DeleteExpiredMessages(reaperBatchSize)
+		if err != nil {
+			log.Printf("Failed to reap expired messages: %v\n", err)
+			return
+		}
+		releaseBlobs(blobs)
+		for _, msg := range deleted {
+			publishConversationUpdate(msg.ConversationID, EventMessageDeleted, msg)
+		}
+		if len(deleted) < reaperBatchSize {
+			return
+		}
+	}
+}
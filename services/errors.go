@@ -0,0 +1,12 @@
+package services
+
+import "errors"
+
+// Errors shared by the services so handlers can map them to status codes
+var (
+	ErrMessageNotFound    = errors.New("message not found")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrForbidden          = errors.New("access denied")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"websocket-server/connections"
+	"websocket-server/models"
+)
+
+// SendEvent pushes a server event to a user if they are connected
+func SendEvent(userID string, eventType string, payload interface{}) {
+	SendEventWithPriority(userID, models.PriorityNormal, eventType, payload)
+}
+
+// SendEventWithPriority pushes a server event to a user, ahead of queued frames of lower priority
+func SendEventWithPriority(userID string, priority int, eventType string, payload interface{}) {
+	sendEvent(userID, priority, &models.Event{Type: eventType, Payload: payload})
+}
+
+// SendConnectionEvent pushes a server event to one connection of a user, for events about that
+// connection rather than the user
+func SendConnectionEvent(connection *connections.Connection, priority int, eventType string, payload interface{}) {
+	sendEventTo(connection, priority, &models.Event{Type: eventType, Payload: payload})
+}
+
+// sendEvent pushes a prepared event to a user if they are connected
+func sendEvent(userID string, priority int, event *models.Event) {
+	conn, ok := connections.GetConnection(userID, "")
+	if !ok {
+		return
+	}
+	sendEventTo(conn, priority, event)
+}
+
+// sendEventTo pushes a prepared event to a connection
+func sendEventTo(conn *connections.Connection, priority int, event *models.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", event.Type, err)
+		return
+	}
+
+	if err := conn.Send(priority, data, nil); err != nil {
+		log.Printf("Failed to send %s event to %s: %v\n", event.Type, conn.UserID, err)
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const maxForwardTargets = 20
+
+// ForwardService provides message forwarding functionalities
+type ForwardService struct{}
+
+// NewForwardService creates a new instance of ForwardService
+func NewForwardService() *ForwardService {
+	return &ForwardService{}
+}
+
+// Forward copies a stored message into each target conversation on behalf of userID. Either every
+// target receives its copy or, if any target is rejected or saving fails, none does. Provenance is
+// taken from the stored original, never from the client.
+func (s *ForwardService) Forward(userID string, request *models.ForwardRequest) ([]*models.Message, error) {
+	if len(request.Targets) == 0 {
+		return nil, fmt.Errorf("%w: at least one target is required", ErrInvalidRequest)
+	}
+	if len(request.Targets) > maxForwardTargets {
+		return nil, fmt.Errorf("%w: a message can be forwarded to at most %d targets", ErrInvalidRequest, maxForwardTargets)
+	}
+	if err := CheckRateLimit(PolicyMessages, userID); err != nil {
+		return nil, err
+	}
+
+	// Only messages the forwarder could read may be forwarded
+	original, err := loadVisibleMessage(userID, request.MessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if original.TTLSeconds > 0 {
+		return nil, fmt.Errorf("%w: self-destructing messages cannot be forwarded", ErrInvalidRequest)
+	}
+
+	// Keep pointing at the first author when forwarding a forwarded message
+	forwardedFrom := original.SenderID
+	if original.Forwarded && original.ForwardedFrom != "" {
+		forwardedFrom = original.ForwardedFrom
+	}
+
+	// Every target is checked before any copy is stored, and the copies are stored together
+	copies := make([]*models.Message, 0, len(request.Targets))
+	for _, target := range request.Targets {
+		msg := &models.Message{
+			SenderID:       userID,
+			RecipientID:    target.RecipientID,
+			ChannelID:      target.ChannelID,
+			Content:        original.Content,
+			MessageType:    original.MessageType,
+			Language:       original.Language,
+			AttachmentID:   original.AttachmentID,
+			AttachmentURL:  original.AttachmentURL,
+			AttachmentType: original.AttachmentType,
+			Forwarded:      true,
+			ForwardedFrom:  forwardedFrom,
+		}
+		if err := checkRecipient(msg); err != nil {
+			return nil, err
+		}
+		msg.ConversationID = ConversationID(msg)
+
+		if target.ChannelID != "" {
+			member, err := CanAccessConversation(userID, msg.ConversationID)
+			if err != nil {
+				return nil, err
+			}
+			if !member {
+				return nil, ErrForbidden
+			}
+		}
+
+		if err := checkSenderVerified(msg); err != nil {
+			return nil, err
+		}
+		if err := applyExpiry(msg); err != nil {
+			return nil, err
+		}
+		copies = append(copies, msg)
+	}
+
+	if err := database.SaveMessages(copies); err != nil {
+		return nil, err
+	}
+	presentAttachments(copies...)
+	for _, msg := range copies {
+		deliverMessage(msg)
+	}
+	return copies, nil
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	defaultHistoryPageSize = 100
+	maxHistoryPageSize     = 500
+)
+
+// HistoryService lets clients backfill the messages they missed in a conversation
+type HistoryService struct{}
+
+// NewHistoryService creates a new instance of HistoryService
+func NewHistoryService() *HistoryService {
+	return &HistoryService{}
+}
+
+// GetMessagesAfter returns a page of a conversation's messages and updates following afterSeq.
+// The page holds the limit lowest sequence numbers of both.
+func (s *HistoryService) GetMessagesAfter(userID, conversationID string, afterSeq int64, limit int) (*models.HistoryPage, error) {
+	allowed, err := CanAccessConversation(userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+
+	if limit <= 0 {
+		limit = defaultHistoryPageSize
+	} else if limit > maxHistoryPageSize {
+		limit = maxHistoryPageSize
+	}
+
+	// Read the latest sequence first so that the page never reports more than it covers
+	latest, err := database.GetConversationSeq(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := database.ListConversationMessages(conversationID, afterSeq, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := database.ListConversationUpdates(conversationID, afterSeq, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge by sequence number until the page is full
+	var m, u int
+	for m+u < limit && (m < len(messages) || u < len(updates)) {
+		if u == len(updates) || (m < len(messages) && messages[m].Seq < updates[u].Seq) {
+			m++
+		} else {
+			u++
+		}
+	}
+
+	page := &models.HistoryPage{
+		ConversationID: conversationID,
+		Messages:       messages[:m],
+		Updates:        updates[:u],
+		LatestSeq:      latest,
+		HasMore:        m < len(messages) || u < len(updates),
+	}
+	presentAttachments(page.Messages...)
+	presentUpdates(page.Updates)
+	return page, nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"websocket-server/database"
+	"websocket-server/media"
+	"websocket-server/models"
+)
+
+const (
+	mediaStatusNone    = "none"
+	mediaStatusPending = "pending"
+	mediaStatusReady   = "ready"
+	mediaStatusFailed  = "failed"
+
+	// EventMediaReady is pushed to conversation members once the thumbnails of a message's image exist
+	EventMediaReady = "media_ready"
+
+	mediaQueueSize = 256
+	// maxMediaPixels guards the workers against decompression bombs
+	maxMediaPixels = 50_000_000
+)
+
+// thumbnailSizes are the bounds of the longest side of the generated thumbnails
+var thumbnailSizes = []int{96, 320, 960}
+
+var mediaJobs = make(chan string, mediaQueueSize)
+
+// StartMediaWorkers starts the background pool generating thumbnails for image attachments.
+// Attachments left pending by a previous run are queued again.
+func StartMediaWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for attachmentID := range mediaJobs {
+				if err := processAttachmentMedia(attachmentID); err != nil {
+					log.Printf("Failed to process media for attachment %s: %v\n", attachmentID, err)
+					if err := database.SetAttachmentMediaStatus(attachmentID, mediaStatusFailed); err != nil {
+						log.Printf("%v\n", err)
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		pending, err := database.ListPendingMediaAttachments()
+		if err != nil {
+			log.Printf("Failed to requeue pending attachments: %v\n", err)
+			return
+		}
+		for _, attachmentID := range pending {
+			mediaJobs <- attachmentID
+		}
+	}()
+	log.Printf("Started %d media workers\n", workers)
+}
+
+// enqueueMediaJob schedules an attachment for processing without blocking the upload.
+// When the queue is full the attachment stays pending and is picked up on the next start.
+func enqueueMediaJob(attachmentID string) {
+	select {
+	case mediaJobs <- attachmentID:
+	default:
+		log.Printf("Media queue full, attachment %s stays pending\n", attachmentID)
+	}
+}
+
+// processAttachmentMedia generates the thumbnails of an image attachment
+func processAttachmentMedia(attachmentID string) error {
+	attachment, err := database.GetAttachment(attachmentID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if attachment.MediaStatus != mediaStatusPending {
+		return nil
+	}
+	if attachment.Width*attachment.Height > maxMediaPixels {
+		return fmt.Errorf("image of %dx%d pixels is too large", attachment.Width, attachment.Height)
+	}
+
+	// Attachments sharing a blob share thumbnails, which may already exist
+	existing, err := database.ListThumbnails(attachment.SHA256)
+	if err != nil {
+		return err
+	}
+	if len(existing) < len(thumbnailSizes) {
+		if err := generateThumbnails(attachment); err != nil {
+			return err
+		}
+	}
+
+	if err := database.SetAttachmentMediaStatus(attachment.ID, mediaStatusReady); err != nil {
+		return err
+	}
+	notifyMediaReady(attachment.ID)
+	return nil
+}
+
+// generateThumbnails decodes an image blob and stores a thumbnail for each configured size
+func generateThumbnails(attachment *models.Attachment) error {
+	store := NewAttachmentService().store
+	content, err := store.Open(attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	img, format, err := media.Decode(content)
+	content.Close()
+	if err != nil {
+		return fmt.Errorf("could not decode image: %v", err)
+	}
+
+	for _, size := range thumbnailSizes {
+		scaled := media.Thumbnail(img, size)
+		var encoded bytes.Buffer
+		contentType, err := media.Encode(&encoded, scaled, format)
+		if err != nil {
+			return fmt.Errorf("could not encode thumbnail: %v", err)
+		}
+
+		digest := sha256.Sum256(encoded.Bytes())
+		key := hex.EncodeToString(digest[:])
+		if _, err := store.Put(key, &encoded); err != nil {
+			return err
+		}
+
+		bounds := scaled.Bounds()
+		thumbnail := &models.Thumbnail{
+			MaxSide:     size,
+			Width:       bounds.Dx(),
+			Height:      bounds.Dy(),
+			ContentType: contentType,
+			StorageKey:  key,
+		}
+		if err := database.SaveThumbnail(attachment.SHA256, thumbnail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyMediaReady pushes the updated media details of every message using an attachment
+func notifyMediaReady(attachmentID string) {
+	messages, err := database.ListMessagesWithAttachment(attachmentID)
+	if err != nil {
+		log.Printf("Failed to notify media for attachment %s: %v\n", attachmentID, err)
+		return
+	}
+
+	presentAttachments(messages...)
+	for _, msg := range messages {
+		publishConversationUpdate(msg.ConversationID, EventMediaReady, msg)
+	}
+}
@@ -6,15 +6,13 @@ import (
 	"sync"
 
 	"websocket-server/models"
+	"websocket-server/utils"
 
 	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for simplicity; restrict as needed in production
-		return true
-	},
+	CheckOrigin: utils.CheckOrigin,
 }
 
 type Client struct {
@@ -2,33 +2,158 @@ package services
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"websocket-server/connections"
+	"websocket-server/database"
 	"websocket-server/models"
-
-	"github.com/gorilla/websocket"
 )
 
-func HandleMessage(senderID string, message []byte) {
+// HandleMessage validates, stores and routes a chat message sent by senderID. The returned
+// error describes why the message was rejected; the message is not stored in that case.
+func HandleMessage(senderID string, message []byte) error {
 	var msg models.Message
 	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Invalid message from %s: %v\n", senderID, err)
-		return
+		return fmt.Errorf("%w: invalid message: %v", ErrInvalidRequest, err)
 	}
 
 	// Ensure the message has a valid recipient
-	if msg.RecipientID == "" {
-		log.Printf("Message from %s missing recipient ID\n", senderID)
+	if err := checkRecipient(&msg); err != nil {
+		return err
+	}
+
+	// The authenticated user is always the sender
+	msg.SenderID = senderID
+	msg.ConversationID = ConversationID(&msg)
+	msg.ThreadID = ""
+
+	// Provenance is only ever set by the server side forward operation
+	msg.Forwarded = false
+	msg.ForwardedFrom = ""
+
+	// Urgent delivery is reserved for server originated traffic
+	msg.Priority = clampPriority(msg.Priority)
+
+	// Only members may post in a channel
+	if msg.ChannelID != "" {
+		member, err := CanAccessConversation(senderID, msg.ConversationID)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return fmt.Errorf("%w: not a member of channel %s", ErrForbidden, msg.ChannelID)
+		}
+	}
+
+	if err := checkSenderVerified(&msg); err != nil {
+		return err
+	}
+
+	if msg.AttachmentID != "" {
+		if err := NewAttachmentService().LinkAttachment(&msg); err != nil {
+			return err
+		}
+	}
+
+	if err := applyExpiry(&msg); err != nil {
+		return err
+	}
+
+	threads := NewThreadService()
+	if msg.ReplyToID != "" {
+		if err := threads.PrepareReply(&msg); err != nil {
+			return fmt.Errorf("invalid reply to %s: %w", msg.ReplyToID, err)
+		}
+	}
+
+	if _, err := database.SaveMessage(&msg); err != nil {
+		return err
+	}
+	presentAttachments(&msg)
+
+	if msg.ThreadID != "" {
+		if err := threads.RecordReply(&msg); err != nil {
+			log.Printf("Failed to update thread %s: %v\n", msg.ThreadID, err)
+		}
+	}
+
+	// Tell the sender where the message landed in the conversation
+	SendEvent(senderID, EventMessageSent, &msg)
+	deliverMessage(&msg)
+	return nil
+}
+
+// backlogLimit bounds how many undelivered messages are queued when a user connects
+const backlogLimit = 500
+
+// clampPriority limits a user supplied priority to the levels users may choose
+func clampPriority(priority int) int {
+	return max(models.PriorityLow, min(priority, models.PriorityHigh))
+}
+
+// DeliverBacklog queues the messages a user received while offline, most important first. Messages
+// that were also queued live are sent once.
+func DeliverBacklog(userID string) {
+	messages, err := database.ListUndeliveredMessages(userID, backlogLimit)
+	if err != nil {
+		log.Printf("Failed to load backlog for %s: %v\n", userID, err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	presentAttachments(messages...)
+	for _, msg := range messages {
+		deliverMessageTo(userID, msg)
+	}
+	if len(messages) == backlogLimit {
+		log.Printf("Backlog of %s exceeds %d messages, the rest is sent on the next connect\n", userID, backlogLimit)
+	}
+}
+
+// deliverMessage queues a stored message for its recipient, or for the members of its channel
+// other than the sender, if they are connected
+func deliverMessage(msg *models.Message) {
+	if msg.ChannelID == "" {
+		deliverMessageTo(msg.RecipientID, msg)
 		return
 	}
 
-	conn, ok := connections.GetConnection(msg.RecipientID, "")
+	members, err := ConversationMembers(msg.ConversationID)
+	if err != nil {
+		log.Printf("Failed to deliver message to channel %s: %v\n", msg.ChannelID, err)
+		return
+	}
+	for _, member := range members {
+		if member != msg.SenderID {
+			deliverMessageTo(member, msg)
+		}
+	}
+}
+
+// deliverMessageTo queues a stored message for one of its recipients if they are connected. The
+// message is marked delivered to them once it is written; otherwise it stays in their backlog.
+func deliverMessageTo(recipientID string, msg *models.Message) {
+	conn, ok := connections.GetConnection(recipientID, "")
 	if !ok {
-		log.Printf("Recipient %s not connected\n", msg.RecipientID)
+		log.Printf("Recipient %s not connected\n", recipientID)
 		return
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-		log.Printf("Failed to send message to %s: %v\n", msg.RecipientID, err)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode message for %s: %v\n", recipientID, err)
+		return
+	}
+
+	messageID := msg.ID
+	markDelivered := func() {
+		if err := database.MarkMessageDelivered(messageID, recipientID); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	if err := conn.SendUnique(messageID, msg.Priority, data, markDelivered); err != nil {
+		log.Printf("Failed to send message to %s: %v\n", recipientID, err)
 	}
 }
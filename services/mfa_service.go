@@ -0,0 +1,338 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/ratelimit"
+	"websocket-server/totp"
+	"websocket-server/utils"
+)
+
+const (
+	// mfaChallengeTTL is how long the second factor of a login can be entered
+	mfaChallengeTTL = 5 * time.Minute
+	// maxMFAChallengeAttempts is how many codes may be tried against one challenge
+	maxMFAChallengeAttempts = 5
+	// totpSkew is how many time steps of clock drift are accepted either way
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	defaultMFAIssuer  = "websocket-server"
+)
+
+// PolicyMFAUser limits how fast codes can be guessed against one account
+var PolicyMFAUser = ratelimit.Per("mfa_user", 5, time.Minute)
+
+var (
+	// ErrInvalidMFACode is returned for wrong, reused or malformed TOTP and recovery codes
+	ErrInvalidMFACode = errors.New("invalid authentication code")
+	// ErrInvalidMFAChallenge is returned for unknown, expired or exhausted login challenges
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MFAService provides TOTP second factors and the second step of logins that use them
+type MFAService struct{}
+
+// NewMFAService creates a new instance of MFAService
+func NewMFAService() *MFAService {
+	return &MFAService{}
+}
+
+// hashMFAValue returns the stored form of a challenge token ID or recovery code
+func hashMFAValue(value string) string {
+	digest := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(digest[:])
+}
+
+// normalizeMFACode strips the separators users type or copy along with a code
+func normalizeMFACode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// generateRecoveryCodes returns new recovery codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashMFAValue(code)
+	}
+	return codes, hashes, nil
+}
+
+// loadAccount resolves the account of a signed in user
+func loadAccount(userID string) (*models.Account, error) {
+	account, err := database.GetAccount(userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrForbidden
+	}
+	return account, err
+}
+
+// checkTOTPCode validates a TOTP code against a user's secret and accepts every time step only once
+func checkTOTPCode(userID int, encryptedSecret, code string) error {
+	secret, err := utils.DecryptSecret(encryptedSecret)
+	if err != nil {
+		return fmt.Errorf("could not decrypt TOTP secret: %v", err)
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), totpSkew)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	fresh, err := database.UseTOTPStep(userID, step)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code of a user with TOTP enabled
+func verifySecondFactor(account *models.Account, code string) error {
+	if err := CheckRateLimit(PolicyMFAUser, account.UserID); err != nil {
+		return err
+	}
+
+	code = normalizeMFACode(code)
+	if len(code) == totp.Digits {
+		secret, _, err := database.GetTOTP(account.ID)
+		if err != nil {
+			return fmt.Errorf("could not load second factor: %v", err)
+		}
+		return checkTOTPCode(account.ID, secret, code)
+	}
+
+	used, err := database.UseRecoveryCode(account.ID, hashMFAValue(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	log.Printf("User %s signed in with a recovery code\n", account.UserID)
+	return nil
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for a user. It takes effect once ConfirmTOTPEnrollment
+// receives a code generated from it.
+func (s *MFAService) BeginTOTPEnrollment(userID string) (*models.TOTPEnrollment, error) {
+	if !utils.SecretEncryptionEnabled() {
+		return nil, fmt.Errorf("%w: two-factor authentication requires SECRET_ENCRYPTION_KEY to be set", ErrInvalidRequest)
+	}
+	account, err := loadAccount(userID)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := database.IsTOTPEnabled(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, fmt.Errorf("%w: two-factor authentication is already enabled", ErrInvalidRequest)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := utils.EncryptSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt TOTP secret: %v", err)
+	}
+	if err := database.SaveTOTPEnrollment(account.ID, encrypted); err != nil {
+		return nil, err
+	}
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = defaultMFAIssuer
+	}
+	return &models.TOTPEnrollment{Secret: secret, URI: totp.URI(issuer, account.Username, secret)}, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP with a code from the newly enrolled authenticator app and
+// returns the user's recovery codes
+func (s *MFAService) ConfirmTOTPEnrollment(userID, code string) (*models.RecoveryCodes, error) {
+	account, err := loadAccount(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckRateLimit(PolicyMFAUser, account.UserID); err != nil {
+		return nil, err
+	}
+
+	secret, enabled, err := database.GetTOTP(account.ID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: two-factor enrollment has not been started", ErrInvalidRequest)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load second factor: %v", err)
+	}
+	if enabled {
+		return nil, fmt.Errorf("%w: two-factor authentication is already enabled", ErrInvalidRequest)
+	}
+	if err := checkTOTPCode(account.ID, secret, normalizeMFACode(code)); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.EnableTOTP(account.ID, hashes); err != nil {
+		return nil, err
+	}
+	log.Printf("Enabled two-factor authentication for %s\n", userID)
+	return &models.RecoveryCodes{Codes: codes}, nil
+}
+
+// DisableTOTP removes a user's second factor after checking a current TOTP or recovery code
+func (s *MFAService) DisableTOTP(userID, code string) error {
+	account, err := s.requireTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if err := verifySecondFactor(account, code); err != nil {
+		return err
+	}
+	if err := database.DeleteTOTP(account.ID); err != nil {
+		return err
+	}
+	log.Printf("Disabled two-factor authentication for %s\n", userID)
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a current TOTP or recovery code
+func (s *MFAService) RegenerateRecoveryCodes(userID, code string) (*models.RecoveryCodes, error) {
+	account, err := s.requireTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySecondFactor(account, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := database.ReplaceRecoveryCodes(account.ID, hashes); err != nil {
+		return nil, err
+	}
+	return &models.RecoveryCodes{Codes: codes}, nil
+}
+
+// requireTOTP returns the account of a user who has TOTP enabled
+func (s *MFAService) requireTOTP(userID string) (*models.Account, error) {
+	account, err := loadAccount(userID)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := database.IsTOTPEnabled(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, fmt.Errorf("%w: two-factor authentication is not enabled", ErrInvalidRequest)
+	}
+	return account, nil
+}
+
+// createChallenge stores a login whose password was accepted and returns the challenge token
+// that completes it together with the second factor
+func (s *MFAService) createChallenge(challenge *models.MFAChallenge) (*models.LoginResponse, error) {
+	id, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	signature, expiresAt := utils.SignValue(id, time.Now().Add(mfaChallengeTTL))
+	if err := database.CreateMFAChallenge(hashMFAValue(id), challenge, time.Unix(expiresAt, 0)); err != nil {
+		return nil, err
+	}
+
+	return &models.LoginResponse{
+		MFARequired:        true,
+		ChallengeToken:     id + "." + strconv.FormatInt(expiresAt, 10) + "." + signature,
+		ChallengeExpiresAt: time.Unix(expiresAt, 0).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// CompleteLogin exchanges a challenge token and a TOTP or recovery code for the login's tokens.
+// Wrong codes count as failed logins of the user, and no code is checked while logins are refused.
+func (s *MFAService) CompleteLogin(challengeToken, code string) (*models.LoginResponse, error) {
+	parts := strings.Split(challengeToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidMFAChallenge
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !utils.VerifySignedValue(parts[0], expiresAt, parts[2]) {
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	challengeHash := hashMFAValue(parts[0])
+	challenge, err := database.AttemptMFAChallenge(challengeHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidMFAChallenge
+	} else if err != nil {
+		return nil, err
+	}
+	if challenge.Attempts > maxMFAChallengeAttempts {
+		if _, err := database.DeleteMFAChallenge(challengeHash); err != nil {
+			log.Printf("%v\n", err)
+		}
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	account, err := database.GetUserByID(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	users := NewUserService()
+	attempt := &models.LoginAttempt{
+		Username:  strings.ToLower(challenge.Username),
+		UserID:    challenge.UserID,
+		IPAddress: challenge.IPAddress,
+		DeviceID:  challenge.Device.DeviceID,
+	}
+	failures, err := users.claimLoginAttempt(attempt.Username)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySecondFactor(account, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			users.recordLoginFailure(attempt, failures)
+		}
+		return nil, err
+	}
+
+	// Only one request may complete a challenge
+	deleted, err := database.DeleteMFAChallenge(challengeHash)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return users.completeLogin(account, &challenge.Device, attempt, true)
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	// EventAnnouncement carries a broadcast to every connected user
+	EventAnnouncement = "announcement"
+
+	maxAnnouncementLength = 4000
+)
+
+// ModerationService provides the operations reserved to moderators, admins and services
+type ModerationService struct{}
+
+// NewModerationService creates a new instance of ModerationService
+func NewModerationService() *ModerationService {
+	return &ModerationService{}
+}
+
+// DeleteMessage removes any message, whoever sent it, cleans up after it like the expiry of a
+// message does, and tells the members of its conversation to drop it. Callers must hold the
+// moderate scope.
+func (s *ModerationService) DeleteMessage(moderatorID, messageID string) (*models.Message, error) {
+	msg, blobs, err := database.DeleteMessage(messageID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	releaseBlobs(blobs)
+
+	publishConversationUpdate(msg.ConversationID, EventMessageDeleted, msg)
+	log.Printf("%s deleted message %s of %s\n", moderatorID, msg.ID, msg.SenderID)
+	if err := database.RecordModerationAction(moderatorID, "delete_message", msg.ID); err != nil {
+		log.Printf("%v\n", err)
+	}
+	return msg, nil
+}
+
+// Broadcast sends an announcement to every connected user and returns how many received it.
+// Callers must hold the broadcast scope.
+func (s *ModerationService) Broadcast(senderID, content string) (int, error) {
+	content = strings.TrimSpace(content)
+	if content == "" || len(content) > maxAnnouncementLength {
+		return 0, fmt.Errorf("%w: an announcement needs 1 to %d characters", ErrInvalidRequest, maxAnnouncementLength)
+	}
+
+	data, err := json.Marshal(&models.Event{Type: EventAnnouncement, Payload: &models.Announcement{
+		From:      senderID,
+		Content:   content,
+		Timestamp: time.Now().UTC().Format(models.TimestampFormat),
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	recipients := 0
+	connections.ForEach(func(connection *connections.Connection) {
+		if err := connection.Send(models.PriorityHigh, data, nil); err == nil {
+			recipients++
+		}
+	})
+	log.Printf("%s broadcast an announcement to %d users\n", senderID, recipients)
+	if err := database.RecordModerationAction(senderID, "broadcast", content); err != nil {
+		log.Printf("%v\n", err)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/oidc"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oidcLoginTTL is how long a user has to sign in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	// oidcProviders are the configured OpenID Connect providers by name
+	oidcProviders = map[string]*oidc.Provider{}
+	// oidcResultURL is the page of the app a browser is sent to once a sign in at a provider
+	// completed, with the outcome in the fragment
+	oidcResultURL string
+)
+
+// InitializeOIDC registers the OpenID Connect providers named in OIDC_PROVIDERS, a comma separated
+// list. Each provider NAME is configured with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET and optionally OIDC_<NAME>_REDIRECT_URL, OIDC_<NAME>_SCOPES and
+// OIDC_<NAME>_TRUST_EMAIL. The redirect URL defaults to the callback under APP_BASE_URL, so the
+// mailer must be initialized first. Browsers return to OIDC_RESULT_URL, by default the root of
+// APP_BASE_URL.
+func InitializeOIDC() {
+	oidcResultURL = os.Getenv("OIDC_RESULT_URL")
+	if oidcResultURL == "" {
+		oidcResultURL = appBaseURL + "/"
+	}
+	if parsed, err := url.Parse(oidcResultURL); err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+		log.Fatalf("OIDC_RESULT_URL must be an absolute URL without a fragment, got %q", oidcResultURL)
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+			TrustEmail:   os.Getenv(prefix+"TRUST_EMAIL") == "true",
+		}
+		if config.Issuer == "" || config.ClientID == "" {
+			log.Fatalf("OIDC provider %s needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+		if config.RedirectURL == "" {
+			config.RedirectURL = appBaseURL + "/oidc/callback"
+		}
+		oidcProviders[name] = oidc.NewProvider(config)
+		log.Printf("Registered OIDC provider %s at %s\n", name, config.Issuer)
+	}
+}
+
+// OIDCService signs users in through OpenID Connect providers
+type OIDCService struct{}
+
+// NewOIDCService creates a new instance of OIDCService
+func NewOIDCService() *OIDCService {
+	return &OIDCService{}
+}
+
+// hashOIDCState returns the stored form of a state parameter
+func hashOIDCState(state string) string {
+	digest := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(digest[:])
+}
+
+// Providers returns the names of the configured providers
+func (s *OIDCService) Providers() []string {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResultURL returns the page of the app a browser is sent to once a sign in at a provider completed
+func (s *OIDCService) ResultURL() string {
+	return oidcResultURL
+}
+
+// BeginLogin starts a login at a provider and returns the URL to send the user to, and the state
+// parameter the browser has to return with
+func (s *OIDCService) BeginLogin(ctx context.Context, providerName, deviceID string) (string, string, error) {
+	provider, ok := oidcProviders[strings.ToLower(providerName)]
+	if !ok {
+		return "", "", fmt.Errorf("%w: unknown provider %q", ErrInvalidRequest, providerName)
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.GenerateVerifier()
+		if err != nil {
+			return "", "", err
+		}
+		values[i] = value
+	}
+	state, codeVerifier, nonce := values[0], values[1], values[2]
+
+	loginState := &models.OIDCLoginState{Provider: provider.Name, CodeVerifier: codeVerifier, Nonce: nonce, DeviceID: deviceID}
+	if err := database.CreateOIDCState(hashOIDCState(state), loginState, time.Now().Add(oidcLoginTTL)); err != nil {
+		return "", "", err
+	}
+	redirectURL, err := provider.AuthCodeURL(ctx, state, nonce, codeVerifier)
+	return redirectURL, state, err
+}
+
+// CompleteLogin redeems the authorization code the provider returned with and issues our own
+// tokens for the linked user. A provider account is linked on first use to the user with the
+// same email address if the provider verified that address. Unless the user verified it as
+// well, the response carries a link token instead, which ConfirmLink redeems with the user's
+// password.
+func (s *OIDCService) CompleteLogin(ctx context.Context, state, code, ipAddress string) (*models.LoginResponse, error) {
+	loginState, err := database.ConsumeOIDCState(hashOIDCState(state))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: invalid or expired login state", ErrInvalidRequest)
+	} else if err != nil {
+		return nil, err
+	}
+	provider, ok := oidcProviders[loginState.Provider]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown provider %q", ErrInvalidRequest, loginState.Provider)
+	}
+
+	claims, err := provider.Exchange(ctx, code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %v\n", provider.Name, err)
+		return nil, fmt.Errorf("%w: sign in with %s failed", ErrForbidden, provider.Name)
+	}
+
+	userID, err := database.GetIdentityUser(provider.Name, claims.Subject)
+	if err == sql.ErrNoRows {
+		return s.linkByEmail(provider.Name, claims, loginState.DeviceID, ipAddress)
+	} else if err != nil {
+		return nil, err
+	}
+	return s.login(userID, loginState.DeviceID, ipAddress)
+}
+
+// ConfirmLink links the provider account of a link token to its user once the user's password
+// is confirmed, and logs the user in. A link token is used up by the first attempt.
+func (s *OIDCService) ConfirmLink(request *models.OIDCLinkRequest, ipAddress string) (*models.LoginResponse, error) {
+	link, err := database.ConsumeOIDCPendingLink(hashOIDCState(request.LinkToken))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: invalid or expired link token", ErrInvalidRequest)
+	} else if err != nil {
+		return nil, err
+	}
+	account, err := database.GetUserByID(link.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	users := NewUserService()
+	attempt := &models.LoginAttempt{
+		Username:  strings.ToLower(account.Username),
+		UserID:    account.ID,
+		IPAddress: ipAddress,
+		DeviceID:  link.DeviceID,
+	}
+	failures, err := users.claimLoginAttempt(attempt.Username)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := database.GetPasswordHash(account.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("could not load credentials: %v", err)
+	}
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(request.Password)) != nil {
+		users.recordLoginFailure(attempt, failures)
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := s.link(link); err != nil {
+		return nil, err
+	}
+	return s.login(account.ID, link.DeviceID, ipAddress)
+}
+
+// linkByEmail links a provider account to the user with the address the provider verified and
+// logs the user in. If the user has not verified the address, the account could have been
+// registered with someone else's, and a link token is returned instead.
+func (s *OIDCService) linkByEmail(providerName string, claims *oidc.Claims, deviceID, ipAddress string) (*models.LoginResponse, error) {
+	notLinked := fmt.Errorf("%w: no account is linked to this %s account", ErrForbidden, providerName)
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, notLinked
+	}
+	userID, _, err := database.GetUserByEmail(claims.Email)
+	if err == sql.ErrNoRows {
+		return nil, notLinked
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load user: %v", err)
+	}
+
+	link := &models.OIDCPendingLink{
+		Provider: providerName,
+		Subject:  claims.Subject,
+		UserID:   userID,
+		Email:    claims.Email,
+		DeviceID: deviceID,
+	}
+	verified, err := database.IsEmailVerified(userID, claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		linkToken, err := oidc.GenerateVerifier()
+		if err != nil {
+			return nil, err
+		}
+		if err := database.CreateOIDCPendingLink(hashOIDCState(linkToken), link, time.Now().Add(oidcLoginTTL)); err != nil {
+			return nil, err
+		}
+		return &models.LoginResponse{LinkRequired: true, LinkToken: linkToken}, nil
+	}
+
+	if err := s.link(link); err != nil {
+		return nil, err
+	}
+	return s.login(userID, deviceID, ipAddress)
+}
+
+// link links a provider account to a user whose address the provider and the user both vouched for
+func (s *OIDCService) link(link *models.OIDCPendingLink) error {
+	if err := database.LinkIdentity(link.Provider, link.Subject, link.UserID, link.Email); err != nil {
+		return err
+	}
+	// The password holder signed in to the provider with the address, no verification email is needed anymore
+	if err := database.MarkEmailVerified(link.UserID, link.Email); err != nil {
+		log.Printf("%v\n", err)
+	}
+	log.Printf("Linked %s account %s to user %d\n", link.Provider, link.Subject, link.UserID)
+	return nil
+}
+
+// login issues the tokens of a user who signed in at a provider, or an MFA challenge if the user
+// has a second factor
+func (s *OIDCService) login(userID int, deviceID, ipAddress string) (*models.LoginResponse, error) {
+	account, err := database.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	device := &models.Device{DeviceID: deviceID}
+	mfaEnabled, err := database.IsTOTPEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled {
+		return NewMFAService().createChallenge(&models.MFAChallenge{
+			UserID:    account.ID,
+			Username:  account.Username,
+			Email:     account.Email,
+			IPAddress: ipAddress,
+			Device:    *device,
+		})
+	}
+
+	attempt := &models.LoginAttempt{
+		Username:  strings.ToLower(account.Username),
+		UserID:    userID,
+		IPAddress: ipAddress,
+		DeviceID:  device.DeviceID,
+	}
+	return NewUserService().completeLogin(account, device, attempt, false)
+}
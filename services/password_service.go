@@ -0,0 +1,203 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/mailer"
+	"websocket-server/ratelimit"
+	"websocket-server/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passwordResetTTL is how long a password reset link stays valid
+	passwordResetTTL = time.Hour
+
+	minPasswordLength = 8
+	// maxPasswordLength is the most bcrypt hashes, longer passwords are rejected instead of truncated
+	maxPasswordLength = 72
+)
+
+// Rate limits of password reset emails, per address and per client
+var (
+	PolicyPasswordResetEmail = ratelimit.Per("password_reset_email", 3, time.Hour)
+	PolicyPasswordResetIP    = ratelimit.Per("password_reset_ip", 10, time.Hour)
+)
+
+// ErrTokenRevoked is returned for access tokens issued before the user's credentials were revoked
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// PasswordService provides password changes and resets
+type PasswordService struct{}
+
+// NewPasswordService creates a new instance of PasswordService
+func NewPasswordService() *PasswordService {
+	return &PasswordService{}
+}
+
+// hashResetID returns the stored form of a password reset token's ID
+func hashResetID(id string) string {
+	digest := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(digest[:])
+}
+
+// validatePassword checks a new password against the password rules
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("%w: password must be at least %d characters", ErrInvalidRequest, minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("%w: password must be at most %d bytes", ErrInvalidRequest, maxPasswordLength)
+	}
+	return nil
+}
+
+// ForgotPassword emails a single-use password reset link to the account with an email address.
+// Unknown addresses succeed silently so that the response does not reveal accounts.
+func (s *PasswordService) ForgotPassword(email string) error {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return fmt.Errorf("%w: email is required", ErrInvalidRequest)
+	}
+	if err := CheckRateLimit(PolicyPasswordResetEmail, strings.ToLower(email)); err != nil {
+		return err
+	}
+
+	userID, _, err := database.GetUserByEmail(email)
+	if err == sql.ErrNoRows {
+		log.Printf("Password reset requested for unknown address\n")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load user: %v", err)
+	}
+
+	id, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
+	signature, expiresAt := utils.SignValue(id, time.Now().Add(passwordResetTTL))
+	if err := database.CreatePasswordReset(userID, hashResetID(id), time.Unix(expiresAt, 0)); err != nil {
+		return err
+	}
+
+	token := id + "." + strconv.FormatInt(expiresAt, 10) + "." + signature
+	link := appBaseURL + "/password/reset?token=" + url.QueryEscape(token)
+	return emailMailer.Send(&mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Open the link below within an hour to choose a new password.\n\n" + link +
+			"\n\nIf you did not ask to reset your password, you can ignore this email.\n",
+	})
+}
+
+// ResetPassword sets a new password with a password reset token and signs the user out everywhere
+func (s *PasswordService) ResetPassword(token, newPassword string) error {
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+
+	invalid := fmt.Errorf("%w: invalid or expired password reset token", ErrInvalidRequest)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !utils.VerifySignedValue(parts[0], expiresAt, parts[2]) {
+		return invalid
+	}
+
+	userID, err := database.ConsumePasswordReset(hashResetID(parts[0]))
+	if err == sql.ErrNoRows {
+		return invalid
+	} else if err != nil {
+		return err
+	}
+
+	account, err := database.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.setPassword(account.ID, newPassword); err != nil {
+		return err
+	}
+
+	// Whoever reset the password proved control of the address, earlier failures no longer count
+	if err := database.ResetLoginFailures(strings.ToLower(account.Username)); err != nil {
+		log.Printf("%v\n", err)
+	}
+	log.Printf("Reset password of %s\n", account.UserID)
+	return nil
+}
+
+// ChangePassword replaces the password of a signed in user who knows the current one and signs
+// them out everywhere. A wrong current password fails with ErrInvalidCredentials.
+func (s *PasswordService) ChangePassword(userID, currentPassword, newPassword string) error {
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+	account, err := loadAccount(userID)
+	if err != nil {
+		return err
+	}
+	// A stolen access token must not allow guessing the current password
+	if err := CheckRateLimit(PolicyLoginUsername, strings.ToLower(account.Username)); err != nil {
+		return err
+	}
+
+	passwordHash, err := database.GetPasswordHash(account.ID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidCredentials
+	} else if err != nil {
+		return fmt.Errorf("could not load credentials: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(currentPassword)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	if err := s.setPassword(account.ID, newPassword); err != nil {
+		return err
+	}
+	log.Printf("Changed password of %s\n", userID)
+	return nil
+}
+
+// setPassword stores a new password, revokes the user's tokens and closes their live connection
+func (s *PasswordService) setPassword(userID int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	uid, err := database.UpdatePassword(userID, string(hashedPassword))
+	if err != nil {
+		return err
+	}
+
+	connections.CloseConnections(uid, "", connections.CloseCredentialsRevoked, "password changed")
+	return nil
+}
+
+// CheckTokenRevoked rejects access tokens issued before the user's credentials were revoked, or
+// before the device they were issued on was signed out. Issue times have a resolution of seconds
+// and revocation times are truncated to it, so a token issued within the second of the revocation,
+// such as by the login that follows a password reset, is accepted.
+func CheckTokenRevoked(claims *utils.Claims) error {
+	revokedBefore, err := database.GetCredentialsRevokedBefore(claims.UserID(), claims.DeviceID)
+	if err != nil {
+		return err
+	}
+	if !revokedBefore.IsZero() && (claims.IssuedAt == nil || claims.IssuedAt.Before(revokedBefore)) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
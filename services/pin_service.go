@@ -0,0 +1,168 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	// EventMessagePinned and EventMessageUnpinned are pushed to conversation members
+	EventMessagePinned   = "message_pinned"
+	EventMessageUnpinned = "message_unpinned"
+
+	defaultStarPageSize = 50
+	maxStarPageSize     = 200
+)
+
+// channelRoleRanks orders channel roles from least to most privileged
+var channelRoleRanks = map[string]int{
+	"member":    1,
+	"moderator": 2,
+	"admin":     3,
+}
+
+// PinService provides pinning and starring functionalities
+type PinService struct{}
+
+// NewPinService creates a new instance of PinService
+func NewPinService() *PinService {
+	return &PinService{}
+}
+
+// pinPolicy returns whether the user may change pins in a conversation and the conversation's pin limit
+func pinPolicy(userID, conversationID string) (bool, int, error) {
+	channelID, ok := strings.CutPrefix(conversationID, channelConversationPrefix)
+	if !ok {
+		// Both participants of a direct conversation may pin
+		return true, database.DefaultPinLimit, nil
+	}
+
+	requiredRole, limit, err := database.GetChannelPinPolicy(channelID)
+	if err != nil {
+		return false, 0, err
+	}
+	role, err := database.GetChannelRole(channelID, userID)
+	if err != nil {
+		return false, 0, err
+	}
+	return role != "" && channelRoleRanks[role] >= channelRoleRanks[requiredRole], limit, nil
+}
+
+// Pin pins a message in its conversation
+func (s *PinService) Pin(userID, messageID string) (*models.Message, error) {
+	msg, err := loadVisibleMessage(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, limit, err := pinPolicy(userID, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+
+	pinnedAt, err := database.PinMessage(msg.ConversationID, msg.ID, userID, limit)
+	if err == sql.ErrNoRows {
+		pinned, err := database.IsPinned(msg.ConversationID, msg.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !pinned {
+			return nil, fmt.Errorf("%w: conversation already has %d pinned messages", ErrInvalidRequest, limit)
+		}
+		// Pinning an already pinned message is a no-op
+		msg.Pinned = true
+		return msg, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	presentAttachments(msg)
+	msg.Pinned = true
+	msg.PinTimestamp = pinnedAt
+	publishConversationUpdate(msg.ConversationID, EventMessagePinned, msg)
+	return msg, nil
+}
+
+// Unpin removes a message from its conversation's pins
+func (s *PinService) Unpin(userID, messageID string) error {
+	msg, err := loadVisibleMessage(userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	allowed, _, err := pinPolicy(userID, msg.ConversationID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+
+	removed, err := database.UnpinMessage(msg.ConversationID, msg.ID)
+	if err != nil {
+		return err
+	}
+	if removed {
+		msg.Pinned = false
+		publishConversationUpdate(msg.ConversationID, EventMessageUnpinned, msg)
+	}
+	return nil
+}
+
+// ListPins returns the pinned messages of a conversation the user belongs to
+func (s *PinService) ListPins(userID, conversationID string) ([]*models.Message, error) {
+	allowed, err := CanAccessConversation(userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+	pins, err := database.ListPinnedMessages(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	presentAttachments(pins...)
+	return pins, nil
+}
+
+// Star stars a message for the user only
+func (s *PinService) Star(userID, messageID string) error {
+	msg, err := loadVisibleMessage(userID, messageID)
+	if err != nil {
+		return err
+	}
+	return database.StarMessage(userID, msg.ID)
+}
+
+// Unstar removes the user's star from a message
+func (s *PinService) Unstar(userID, messageID string) error {
+	return database.UnstarMessage(userID, messageID)
+}
+
+// ListStarred returns a page of the messages the user starred and the cursor of the next page
+func (s *PinService) ListStarred(userID, cursor string, limit int) ([]*models.Message, string, error) {
+	if limit <= 0 {
+		limit = defaultStarPageSize
+	} else if limit > maxStarPageSize {
+		limit = maxStarPageSize
+	}
+
+	starred, err := database.ListStarredMessages(userID, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	presentAttachments(starred...)
+	nextCursor := ""
+	if len(starred) == limit {
+		nextCursor = starred[len(starred)-1].ID
+	}
+	return starred, nextCursor, nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/models"
+	"websocket-server/ratelimit"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// EventThrottled tells a WebSocket client that a frame was dropped by a rate limit
+const EventThrottled = "throttled"
+
+// Rate limit policies
+var (
+	PolicyMessages       = ratelimit.Policy{Name: "messages", Rate: 5, Burst: 20}
+	PolicyConnectionUser = ratelimit.Per("connect_user", 10, time.Minute)
+	PolicyConnectionIP   = ratelimit.Per("connect_ip", 30, time.Minute)
+	PolicyLoginUsername  = ratelimit.Per("login_username", 5, time.Minute)
+	PolicyLoginIP        = ratelimit.Per("login_ip", 20, time.Minute)
+	PolicyRegisterIP     = ratelimit.Per("register_ip", 5, time.Hour)
+)
+
+// ErrRateLimited is matched by every RateLimitError
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitError reports which policy rejected a request and when to retry
+type RateLimitError struct {
+	Policy     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: %s, retry after %s", ErrRateLimited, e.Policy, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Is makes errors.Is(err, ErrRateLimited) hold for rate limit errors
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+
+// InitializeRateLimiter keeps rate limit buckets in Redis when RATE_LIMIT_REDIS_URL is set, so
+// that limits are shared by all replicas. Otherwise every replica limits on its own.
+func InitializeRateLimiter() {
+	url := os.Getenv("RATE_LIMIT_REDIS_URL")
+	if url == "" {
+		log.Println("Rate limiting with in-memory buckets")
+		return
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_REDIS_URL: %v", err)
+	}
+	rateLimitStore = ratelimit.NewRedisStore(redis.NewClient(options), "ratelimit:")
+	log.Printf("Rate limiting with Redis buckets at %s\n", options.Addr)
+}
+
+// CheckRateLimit takes a token from the bucket of key under policy and returns a *RateLimitError
+// when none is left. Requests are allowed when the bucket store is unavailable.
+func CheckRateLimit(policy ratelimit.Policy, key string) error {
+	result, err := rateLimitStore.Take(key, policy, time.Now())
+	if err != nil {
+		log.Printf("Rate limiting unavailable, allowing request: %v\n", err)
+		return nil
+	}
+	if !result.Allowed {
+		return &RateLimitError{Policy: policy.Name, RetryAfter: result.RetryAfter}
+	}
+	return nil
+}
+
+// NotifyThrottled sends a throttle frame to a WebSocket client whose frame was dropped
+func NotifyThrottled(connection *connections.Connection, err error) {
+	var limited *RateLimitError
+	if !errors.As(err, &limited) {
+		return
+	}
+	SendConnectionEvent(connection, models.PriorityUrgent, EventThrottled, &models.Throttle{
+		Policy:       limited.Policy,
+		RetryAfterMS: limited.RetryAfter.Milliseconds(),
+	})
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/utils"
+)
+
+// Client frame types besides chat messages, FrameReauth and FrameTelemetry
+const (
+	FrameBroadcast     = "broadcast"
+	FrameDeleteMessage = "delete_message"
+
+	// EventFrameRejected reports a client frame that was not allowed or failed
+	EventFrameRejected = "frame_rejected"
+)
+
+// frameScopes is the scope each client frame type requires. Frames without a type are chat messages.
+var frameScopes = map[string]string{
+	"":                 utils.ScopeMessages,
+	FrameReauth:        "",
+	FrameTelemetry:     "", // Every connection may report on its own device
+	FrameBroadcast:     utils.ScopeBroadcast,
+	FrameDeleteMessage: utils.ScopeModerate,
+}
+
+// FrameScope returns the scope a client frame type requires and whether the type is known
+func FrameScope(frameType string) (string, bool) {
+	scope, ok := frameScopes[frameType]
+	return scope, ok
+}
+
+// NotifyFrameRejected tells a WebSocket client why one of its frames was not processed
+func NotifyFrameRejected(connection *connections.Connection, frameType string, err error) {
+	SendConnectionEvent(connection, models.PriorityNormal, EventFrameRejected,
+		&models.FrameRejection{FrameType: frameType, Error: err.Error()})
+}
+
+// RoleService manages the roles of users
+type RoleService struct{}
+
+// NewRoleService creates a new instance of RoleService
+func NewRoleService() *RoleService {
+	return &RoleService{}
+}
+
+// ListRoles returns every role a user holds, including the implicit user role
+func (s *RoleService) ListRoles(userID string) ([]string, error) {
+	account, err := s.lookupUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := database.ListUserRoles(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{utils.RoleUser}, roles...), nil
+}
+
+// GrantRole grants a role to a user. It applies to tokens issued from their next login on, and
+// only to logins that passed a second factor for the roles that require one.
+func (s *RoleService) GrantRole(adminID, userID, role string) error {
+	account, err := s.checkRoleChange(userID, role)
+	if err != nil {
+		return err
+	}
+	if err := database.GrantRole(account.ID, role, adminID); err != nil {
+		return err
+	}
+	s.recordChange(adminID, "grant_role", userID, role)
+	return nil
+}
+
+// RevokeRole takes a role away from a user. Their tokens are revoked and their connection
+// closed, so that the role cannot be used until it expires.
+func (s *RoleService) RevokeRole(adminID, userID, role string) error {
+	account, err := s.checkRoleChange(userID, role)
+	if err != nil {
+		return err
+	}
+	if userID == adminID && role == utils.RoleAdmin {
+		return fmt.Errorf("%w: admins cannot revoke their own admin role", ErrInvalidRequest)
+	}
+
+	revoked, err := database.RevokeRole(account.ID, role)
+	if err != nil || !revoked {
+		return err
+	}
+	if _, err := database.RevokeAccessTokens(account.ID); err != nil {
+		return err
+	}
+	connections.CloseConnections(userID, "", connections.CloseCredentialsRevoked, "roles changed")
+	s.recordChange(adminID, "revoke_role", userID, role)
+	return nil
+}
+
+// checkRoleChange validates a role change and returns the account it applies to
+func (s *RoleService) checkRoleChange(userID, role string) (*models.Account, error) {
+	if !utils.IsValidRole(role) || role == utils.RoleUser {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidRequest, role)
+	}
+	return s.lookupUser(userID)
+}
+
+// lookupUser resolves the user a role operation applies to
+func (s *RoleService) lookupUser(userID string) (*models.Account, error) {
+	account, err := loadAccount(userID)
+	if err == ErrForbidden {
+		return nil, fmt.Errorf("%w: unknown user %q", ErrInvalidRequest, userID)
+	}
+	return account, err
+}
+
+// recordChange writes a role change to the moderation log
+func (s *RoleService) recordChange(adminID, action, userID, role string) {
+	log.Printf("%s: %s %s %s\n", adminID, action, role, userID)
+	if err := database.RecordModerationAction(adminID, action, userID+":"+role); err != nil {
+		log.Printf("%v\n", err)
+	}
+}
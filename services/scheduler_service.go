@@ -0,0 +1,179 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	// EventScheduledMessageFailed is pushed to the sender when a scheduled message cannot be sent
+	EventScheduledMessageFailed = "scheduled_message_failed"
+
+	maxPendingScheduled = 100
+	maxScheduleAhead    = 365 * 24 * time.Hour
+	maxScheduleAttempts = 5
+	schedulerBatchSize  = 100
+	minScheduleLeadTime = 5 * time.Second
+	// scheduleSendTimeout is how long a message may stay claimed for sending before the send is
+	// considered interrupted
+	scheduleSendTimeout = 10 * time.Minute
+)
+
+// SchedulerService provides scheduled message functionalities
+type SchedulerService struct{}
+
+// NewSchedulerService creates a new instance of SchedulerService
+func NewSchedulerService() *SchedulerService {
+	return &SchedulerService{}
+}
+
+// validateSchedule checks the message and due time of a schedule request
+func validateSchedule(request *models.ScheduleRequest) (time.Time, error) {
+	if request.Message.RecipientID == "" {
+		return time.Time{}, fmt.Errorf("%w: missing recipient ID", ErrInvalidRequest)
+	}
+	sendAt, err := time.Parse(time.RFC3339, request.SendAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: send_at must be an RFC 3339 timestamp", ErrInvalidRequest)
+	}
+	now := time.Now()
+	if sendAt.Before(now.Add(minScheduleLeadTime)) || sendAt.After(now.Add(maxScheduleAhead)) {
+		return time.Time{}, fmt.Errorf("%w: send_at must be between %s and %s from now", ErrInvalidRequest, minScheduleLeadTime, maxScheduleAhead)
+	}
+	return sendAt, nil
+}
+
+// Schedule stores a message to be sent by the server at the requested time
+func (s *SchedulerService) Schedule(userID string, request *models.ScheduleRequest) (*models.ScheduledMessage, error) {
+	sendAt, err := validateSchedule(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRecipient(&request.Message); err != nil {
+		return nil, err
+	}
+	if err := CheckRateLimit(PolicyMessages, userID); err != nil {
+		return nil, err
+	}
+
+	pending, err := database.CountPendingScheduledMessages(userID)
+	if err != nil {
+		return nil, err
+	}
+	if pending >= maxPendingScheduled {
+		return nil, fmt.Errorf("%w: at most %d messages can be scheduled", ErrInvalidRequest, maxPendingScheduled)
+	}
+
+	request.Message.SenderID = userID
+	scheduled := &models.ScheduledMessage{
+		SenderID: userID,
+		Message:  request.Message,
+		SendAt:   sendAt.UTC().Format(time.RFC3339),
+	}
+	if err := database.CreateScheduledMessage(scheduled); err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// List returns the user's scheduled messages that have not been sent or cancelled
+func (s *SchedulerService) List(userID string) ([]*models.ScheduledMessage, error) {
+	return database.ListScheduledMessages(userID)
+}
+
+// Edit replaces the content and due time of a scheduled message before it is due
+func (s *SchedulerService) Edit(userID string, request *models.ScheduleRequest) (*models.ScheduledMessage, error) {
+	sendAt, err := validateSchedule(request)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Message.SenderID = userID
+	scheduled := &models.ScheduledMessage{
+		ID:       request.ScheduleID,
+		SenderID: userID,
+		Message:  request.Message,
+		SendAt:   sendAt.UTC().Format(time.RFC3339),
+	}
+	err = database.UpdateScheduledMessage(scheduled)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: scheduled message is unknown, already sent or cancelled", ErrInvalidRequest)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not edit scheduled message: %v", err)
+	}
+	return scheduled, nil
+}
+
+// Cancel cancels a scheduled message before it is due
+func (s *SchedulerService) Cancel(userID, scheduleID string) error {
+	cancelled, err := database.CancelScheduledMessage(scheduleID, userID)
+	if err != nil {
+		return err
+	}
+	if !cancelled {
+		return fmt.Errorf("%w: scheduled message is unknown, already sent or cancelled", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// StartMessageScheduler periodically sends due scheduled messages through HandleMessage
+func StartMessageScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sendDueMessages()
+		}
+	}()
+	log.Printf("Started message scheduler running every %s\n", interval)
+}
+
+// sendDueMessages sends due scheduled messages in batches until none are left
+func sendDueMessages() {
+	interrupted, err := database.FailInterruptedScheduledMessages(scheduleSendTimeout, "interrupted while sending, the message may not have been delivered")
+	if err != nil {
+		log.Printf("Failed to check interrupted scheduled messages: %v\n", err)
+	}
+	for _, scheduled := range interrupted {
+		SendEvent(scheduled.SenderID, EventScheduledMessageFailed, scheduled)
+	}
+
+	for {
+		processed, err := database.ProcessDueScheduledMessages(schedulerBatchSize, sendScheduledMessage)
+		if err != nil {
+			log.Printf("Failed to send scheduled messages: %v\n", err)
+			return
+		}
+		if processed < schedulerBatchSize {
+			return
+		}
+	}
+}
+
+// sendScheduledMessage routes a due message like any other message from its sender and returns
+// the status to record. Invalid messages fail immediately, other errors are retried.
+func sendScheduledMessage(scheduled *models.ScheduledMessage) (string, string) {
+	payload, err := json.Marshal(scheduled.Message)
+	if err == nil {
+		err = HandleMessage(scheduled.SenderID, payload)
+	}
+	if err == nil {
+		return database.ScheduleStatusSent, ""
+	}
+
+	log.Printf("Failed to send scheduled message %s: %v\n", scheduled.ID, err)
+	if !errors.Is(err, ErrInvalidRequest) && scheduled.Attempts+1 < maxScheduleAttempts {
+		return database.ScheduleStatusPending, err.Error()
+	}
+
+	scheduled.Status = database.ScheduleStatusFailed
+	scheduled.LastError = err.Error()
+	SendEvent(scheduled.SenderID, EventScheduledMessageFailed, scheduled)
+	return database.ScheduleStatusFailed, err.Error()
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+// SearchService provides message search functionalities
+type SearchService struct{}
+
+// NewSearchService creates a new instance of SearchService
+func NewSearchService() *SearchService {
+	return &SearchService{}
+}
+
+// Search returns the messages matching the query that the caller is allowed to read,
+// best matches first, and the offset of the next page (0 when there is none)
+func (s *SearchService) Search(query *models.SearchQuery) ([]*models.SearchResult, int, error) {
+	query.Text = strings.TrimSpace(query.Text)
+	if query.Text == "" {
+		return nil, 0, fmt.Errorf("%w: a search text is required", ErrInvalidRequest)
+	}
+	for _, bound := range []string{query.From, query.To} {
+		if bound == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, bound); err != nil {
+			return nil, 0, fmt.Errorf("%w: dates must be RFC 3339 timestamps", ErrInvalidRequest)
+		}
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultSearchPageSize
+	} else if query.Limit > maxSearchPageSize {
+		query.Limit = maxSearchPageSize
+	}
+
+	if query.ConversationID != "" {
+		allowed, err := CanAccessConversation(query.UserID, query.ConversationID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !allowed {
+			return nil, 0, ErrForbidden
+		}
+	}
+
+	results, err := database.SearchMessages(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, result := range results {
+		presentAttachments(result.Message)
+	}
+
+	nextOffset := 0
+	if len(results) == query.Limit {
+		nextOffset = query.Offset + query.Limit
+	}
+	return results, nextOffset, nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/models"
+	"websocket-server/utils"
+)
+
+const (
+	// FrameReauth is the type of the client frame carrying a fresh token for an open connection
+	FrameReauth = "reauth"
+
+	// EventTokenExpiring asks the client to re-authenticate before its connection is closed
+	EventTokenExpiring = "token_expiring"
+	// EventReauthenticated confirms a re-authentication with the new expiry
+	EventReauthenticated = "reauthenticated"
+	// EventReauthFailed reports a rejected re-authentication, the previous expiry still applies
+	EventReauthFailed = "reauth_failed"
+)
+
+// WatchTokenExpiry closes a connection once its token expires unless the client re-authenticates first
+func WatchTokenExpiry(connection *connections.Connection, expiresAt time.Time) {
+	connection.SetExpiry(expiresAt, func() {
+		SendConnectionEvent(connection, models.PriorityUrgent, EventTokenExpiring,
+			&models.TokenExpiry{ExpiresAt: expiresAt.UTC().Format(time.RFC3339)})
+	})
+}
+
+// Reauthenticate extends an open connection with a fresh token of the same user and device and
+// returns the token's claims, whose scopes apply to the connection from now on
+func Reauthenticate(connection *connections.Connection, token string) (*utils.Claims, error) {
+	claims, err := AuthenticateToken(token)
+	if err == nil && claims.UserID() != connection.UserID {
+		err = errors.New("token belongs to another user")
+	} else if err == nil && !IsAPIKey(token) && claims.DeviceID != connection.DeviceID {
+		// Each API key is a device of its own, so only tokens of users are held to the same device
+		err = errors.New("token belongs to another device")
+	}
+	if err != nil {
+		SendConnectionEvent(connection, models.PriorityUrgent, EventReauthFailed,
+			&models.TokenExpiry{ExpiresAt: connection.ExpiresAt().UTC().Format(time.RFC3339), Error: err.Error()})
+		return nil, err
+	}
+
+	expiresAt := claims.ExpiresAt.Time
+	WatchTokenExpiry(connection, expiresAt)
+	SendConnectionEvent(connection, models.PriorityUrgent, EventReauthenticated,
+		&models.TokenExpiry{ExpiresAt: expiresAt.UTC().Format(time.RFC3339)})
+	log.Printf("User %s re-authenticated until %s\n", connection.UserID, expiresAt.UTC().Format(time.RFC3339))
+	return claims, nil
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+	"websocket-server/connections"
+	"websocket-server/database"
+	"websocket-server/models"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// EventMessageSent confirms a stored message to its sender with its sequence number and timestamp
+	EventMessageSent = "message_sent"
+	// EventSyncRequired lists what a reconnecting client is too far behind on to catch up by replay
+	EventSyncRequired = "sync_required"
+	// EventSyncComplete ends a replay, live delivery follows
+	EventSyncComplete = "sync_complete"
+
+	// syncRetention is how long conversation updates are kept for replay
+	syncRetention = 7 * 24 * time.Hour
+	// maxReplayFrames bounds a replay, clients further behind must do a full sync
+	maxReplayFrames = 1000
+	// maxResumeConversations bounds the conversations a client may resume at once
+	maxResumeConversations = 500
+)
+
+// messagePayloadEvents are the updates whose payload is a message, their attachment URLs are
+// signed again when they are replayed
+var messagePayloadEvents = map[string]bool{
+	EventMessagePinned:   true,
+	EventMessageUnpinned: true,
+	EventMediaReady:      true,
+}
+
+// replayFrame is a message or conversation update waiting to be replayed
+type replayFrame struct {
+	conversationID string
+	seq            int64
+	timestamp      string
+	frame          interface{}
+}
+
+// ResumeSession replays what a reconnecting client missed directly on its connection, ahead of
+// any queued live frames, and ends with a sync_complete event. Replayed messages are marked
+// delivered, so the backlog delivered afterwards only holds the ones that were not replayed.
+// Frames that were also queued live are sent twice; clients drop duplicates by conversation and
+// sequence number.
+func ResumeSession(userID string, connection *connections.Connection, request *models.ResumeRequest) {
+	status := &models.SyncStatus{Cursor: time.Now().UTC().Format(models.TimestampFormat)}
+
+	var frames []*replayFrame
+	var err error
+	if request.Cursor != "" {
+		frames, err = replaySince(userID, request.Cursor, status)
+	} else {
+		frames, err = replaySeqs(userID, request.Seqs, status)
+	}
+	if err != nil {
+		log.Printf("Failed to replay for %s: %v\n", userID, err)
+		status.FullSync = true
+		frames = nil
+	}
+
+	sort.SliceStable(frames, func(i, j int) bool {
+		if frames[i].timestamp != frames[j].timestamp {
+			return frames[i].timestamp < frames[j].timestamp
+		}
+		if frames[i].conversationID != frames[j].conversationID {
+			return frames[i].conversationID < frames[j].conversationID
+		}
+		return frames[i].seq < frames[j].seq
+	})
+
+	for _, frame := range frames {
+		if err := writeFrame(connection, frame.frame); err != nil {
+			log.Printf("Failed to replay to %s: %v\n", userID, err)
+			return
+		}
+		if msg, ok := frame.frame.(*models.Message); ok && msg.SenderID != userID {
+			if err := database.MarkMessageDelivered(msg.ID, userID); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}
+	}
+	status.Replayed = len(frames)
+
+	if status.FullSync || len(status.Conversations) > 0 {
+		if err := writeFrame(connection, &models.Event{Type: EventSyncRequired, Payload: status}); err != nil {
+			log.Printf("Failed to replay to %s: %v\n", userID, err)
+			return
+		}
+	}
+	if err := writeFrame(connection, &models.Event{Type: EventSyncComplete, Payload: status}); err != nil {
+		log.Printf("Failed to replay to %s: %v\n", userID, err)
+	}
+	log.Printf("Replayed %d frames to %s\n", status.Replayed, userID)
+}
+
+// replaySeqs collects the frames following the last sequence number seen in each conversation.
+// Conversations that cannot be replayed completely are added to the status instead.
+func replaySeqs(userID string, seqs map[string]int64, status *models.SyncStatus) ([]*replayFrame, error) {
+	if len(seqs) > maxResumeConversations {
+		status.FullSync = true
+		return nil, nil
+	}
+
+	var frames []*replayFrame
+	for conversationID, afterSeq := range seqs {
+		allowed, err := CanAccessConversation(userID, conversationID)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			continue
+		}
+
+		prunedSeq, err := database.GetPrunedSeq(conversationID)
+		if err != nil {
+			return nil, err
+		}
+		if afterSeq < prunedSeq {
+			status.Conversations = append(status.Conversations, conversationID)
+			continue
+		}
+
+		remaining := maxReplayFrames - len(frames)
+		messages, err := database.ListConversationMessages(conversationID, afterSeq, remaining+1)
+		if err != nil {
+			return nil, err
+		}
+		updates, err := database.ListConversationUpdates(conversationID, afterSeq, remaining+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages)+len(updates) > remaining {
+			status.Conversations = append(status.Conversations, conversationID)
+			continue
+		}
+		frames = append(frames, collectReplayFrames(messages, updates)...)
+	}
+	sort.Strings(status.Conversations)
+	return frames, nil
+}
+
+// replaySince collects the frames stored at or after a global sync cursor
+func replaySince(userID, cursor string, status *models.SyncStatus) ([]*replayFrame, error) {
+	since, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil || time.Since(since) > syncRetention {
+		status.FullSync = true
+		return nil, nil
+	}
+
+	messages, err := database.ListUserMessagesSince(userID, since, maxReplayFrames+1)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := database.ListUserUpdatesSince(userID, since, maxReplayFrames+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages)+len(updates) > maxReplayFrames {
+		status.FullSync = true
+		return nil, nil
+	}
+	return collectReplayFrames(messages, updates), nil
+}
+
+// collectReplayFrames prepares messages and updates for replay
+func collectReplayFrames(messages []*models.Message, updates []*models.Event) []*replayFrame {
+	presentAttachments(messages...)
+	frames := make([]*replayFrame, 0, len(messages)+len(updates))
+	for _, msg := range messages {
+		frames = append(frames, &replayFrame{msg.ConversationID, msg.Seq, msg.Timestamp, msg})
+	}
+	presentUpdates(updates)
+	for _, update := range updates {
+		frames = append(frames, &replayFrame{update.ConversationID, update.Seq, update.Timestamp, update})
+	}
+	return frames
+}
+
+// presentUpdates decodes the message payloads of stored updates and signs their attachment URLs again
+func presentUpdates(updates []*models.Event) {
+	for _, update := range updates {
+		if !messagePayloadEvents[update.Type] {
+			continue
+		}
+		var msg models.Message
+		if raw, ok := update.Payload.(json.RawMessage); ok && json.Unmarshal(raw, &msg) == nil {
+			presentAttachments(&msg)
+			update.Payload = &msg
+		}
+	}
+}
+
+// writeFrame encodes a frame and writes it directly to a connection
+func writeFrame(connection *connections.Connection, frame interface{}) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return connection.WriteMessage(websocket.TextMessage, data)
+}
+
+// StartSyncLogPruner periodically deletes conversation updates older than the sync retention
+func StartSyncLogPruner(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			deleted, err := database.PruneConversationUpdates(time.Now().Add(-syncRetention))
+			if err != nil {
+				log.Printf("Failed to prune conversation updates: %v\n", err)
+			} else if deleted > 0 {
+				log.Printf("Pruned %d conversation updates\n", deleted)
+			}
+		}
+	}()
+	log.Printf("Started sync log pruner running every %s\n", interval)
+}
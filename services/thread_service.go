@@ -0,0 +1,138 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"websocket-server/database"
+	"websocket-server/models"
+)
+
+const (
+	// EventThreadReply is pushed to thread participants when a reply is posted
+	EventThreadReply = "thread_reply"
+
+	defaultThreadPageSize = 50
+	maxThreadPageSize     = 200
+)
+
+// ThreadService provides threaded reply functionalities
+type ThreadService struct{}
+
+// NewThreadService creates a new instance of ThreadService
+func NewThreadService() *ThreadService {
+	return &ThreadService{}
+}
+
+// PrepareReply resolves the thread a reply belongs to before it is saved. Replying to a
+// message starts a thread rooted at it; replying to a reply extends the existing thread.
+// Only members of the parent's conversation may reply.
+func (s *ThreadService) PrepareReply(msg *models.Message) error {
+	parent, err := database.GetMessage(msg.ReplyToID)
+	if err == sql.ErrNoRows {
+		return ErrMessageNotFound
+	} else if err != nil {
+		return fmt.Errorf("could not load parent message: %v", err)
+	}
+
+	if parent.ConversationID != msg.ConversationID {
+		return fmt.Errorf("%w: reply must be sent in the same conversation as the parent message", ErrInvalidRequest)
+	}
+	allowed, err := CanAccessConversation(msg.SenderID, parent.ConversationID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+
+	msg.ThreadID = parent.ThreadID
+	if msg.ThreadID == "" {
+		msg.ThreadID = parent.ID
+	}
+	return nil
+}
+
+// RecordReply updates the thread summary for a saved reply and notifies the thread participants
+// who can still access the conversation
+func (s *ThreadService) RecordReply(msg *models.Message) error {
+	count, lastReplyAt, err := database.IncrementThreadReplies(msg.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	participants, err := database.ListThreadParticipants(msg.ThreadID)
+	if err != nil {
+		return err
+	}
+
+	summary := models.ThreadSummary{
+		ThreadID:    msg.ThreadID,
+		ReplyCount:  count,
+		LastReplyAt: lastReplyAt,
+		Reply:       msg,
+	}
+	for _, participant := range participants {
+		if participant == msg.SenderID {
+			continue
+		}
+		// Participants who lost access to the conversation, such as by leaving the channel, are skipped
+		allowed, err := CanAccessConversation(participant, msg.ConversationID)
+		if err != nil {
+			log.Printf("%v\n", err)
+			continue
+		}
+		if allowed {
+			SendEvent(participant, EventThreadReply, summary)
+		}
+	}
+	log.Printf("Thread %s has %d replies\n", msg.ThreadID, count)
+	return nil
+}
+
+// GetReplies returns a page of a thread's replies visible to the given user
+func (s *ThreadService) GetReplies(userID, threadID, cursor string, limit int) (*models.ThreadPage, error) {
+	root, err := database.GetMessage(threadID)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load thread: %v", err)
+	}
+	if root.ThreadID != "" {
+		// The caller passed a reply, page the thread it belongs to
+		return s.GetReplies(userID, root.ThreadID, cursor, limit)
+	}
+
+	allowed, err := CanAccessConversation(userID, root.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+
+	if cursor != "" {
+		if _, err := strconv.ParseInt(cursor, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor %q", ErrInvalidRequest, cursor)
+		}
+	}
+	if limit <= 0 {
+		limit = defaultThreadPageSize
+	} else if limit > maxThreadPageSize {
+		limit = maxThreadPageSize
+	}
+
+	replies, err := database.ListThreadReplies(root.ID, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	presentAttachments(root)
+	presentAttachments(replies...)
+	page := &models.ThreadPage{Root: root, Replies: replies}
+	if len(replies) == limit {
+		page.NextCursor = replies[len(replies)-1].ID
+	}
+	return page, nil
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+	"websocket-server/database"
+	"websocket-server/models"
+	"websocket-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// connectionTicketTTL is how long a connection ticket can be redeemed
+const connectionTicketTTL = 30 * time.Second
+
+// ErrInvalidTicket is returned for unknown, expired or already used connection tickets
+var ErrInvalidTicket = errors.New("invalid connection ticket")
+
+// TicketService exchanges access tokens for single-use WebSocket connection tickets, so that
+// browsers never have to put a long-lived token in a URL
+type TicketService struct{}
+
+// NewTicketService creates a new instance of TicketService
+func NewTicketService() *TicketService {
+	return &TicketService{}
+}
+
+// hashTicket returns the stored form of a ticket
+func hashTicket(ticket string) string {
+	digest := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(digest[:])
+}
+
+// IssueTicket creates a connection ticket for the holder of a token. Connections opened with it
+// expire together with the token and get the token's scopes.
+func (s *TicketService) IssueTicket(claims *utils.Claims) (*models.ConnectionTicket, error) {
+	ticket, err := utils.GenerateRandomString(43)
+	if err != nil {
+		return nil, err
+	}
+	tokenExpiresAt := claims.ExpiresAt.Time
+	expiresAt := time.Now().Add(connectionTicketTTL)
+	if tokenExpiresAt.Before(expiresAt) {
+		expiresAt = tokenExpiresAt
+	}
+	var tokenIssuedAt time.Time
+	if claims.IssuedAt != nil {
+		tokenIssuedAt = claims.IssuedAt.Time
+	}
+	if err := database.CreateConnectionTicket(
+		hashTicket(ticket), claims.UserID(), claims.DeviceID, claims.ID, expiresAt, tokenIssuedAt, tokenExpiresAt, claims.Scopes,
+	); err != nil {
+		return nil, err
+	}
+	return &models.ConnectionTicket{Ticket: ticket, ExpiresAt: expiresAt.UTC().Format(time.RFC3339)}, nil
+}
+
+// RedeemTicket consumes a connection ticket and returns the user, device, expiry and scopes of the
+// token it was issued for. Tickets whose token was revoked after they were issued are rejected like
+// the token itself would be.
+func (s *TicketService) RedeemTicket(ticket string) (*utils.Claims, error) {
+	userID, deviceID, tokenID, tokenIssuedAt, tokenExpiresAt, scopes, err := database.ConsumeConnectionTicket(hashTicket(ticket))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidTicket
+	} else if err != nil {
+		return nil, err
+	}
+	claims := &utils.Claims{
+		DeviceID: deviceID,
+		Scopes:   scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   userID,
+			ExpiresAt: jwt.NewNumericDate(tokenExpiresAt),
+		},
+	}
+	if !tokenIssuedAt.IsZero() {
+		claims.IssuedAt = jwt.NewNumericDate(tokenIssuedAt)
+	}
+
+	if tokenID != "" {
+		key, _, err := database.GetAPIKey(tokenID)
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidAPIKey
+		} else if err != nil {
+			return nil, err
+		}
+		if key.RevokedAt != "" {
+			return nil, ErrInvalidAPIKey
+		}
+	}
+	if err := CheckTokenRevoked(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -2,9 +2,10 @@ package services
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
 	"time"
 	"websocket-server/database"
 	"websocket-server/models"
@@ -13,6 +14,29 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// EventNewLogin tells a user about a login from a device or address they never used before
+	EventNewLogin = "new_login"
+
+	// loginDelayAfter consecutive failures, each further attempt has to wait twice as long
+	loginDelayAfter = 3
+	maxLoginDelay   = time.Minute
+	// loginLockoutAfter consecutive failures, the username is locked for loginLockoutDuration
+	loginLockoutAfter    = 10
+	loginLockoutDuration = 15 * time.Minute
+	// loginFailureWindow without a failure and earlier failures no longer count
+	loginFailureWindow = 15 * time.Minute
+
+	loginHistorySize = 50
+
+	maxUsernameLength = 64
+	// maxUserLookup is how many user IDs and usernames one lookup may translate
+	maxUserLookup = 100
+)
+
+// dummyPasswordHash is compared against for unknown usernames
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
 // UserService provides user-related functionalities
 type UserService struct{}
 
@@ -21,12 +45,12 @@ func NewUserService() *UserService {
 	return &UserService{}
 }
 
-// RegisterUser saves a new user to the database.
-func (s *UserService) RegisterUser(user *models.User, device *models.Device) (string, string, error) {
+// RegisterUser saves a new user to the database and returns the tokens of their first login.
+func (s *UserService) RegisterUser(user *models.User, device *models.Device, ipAddress string) (*models.LoginResponse, error) {
 	// Convert password to hash
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	// Save user to the database
@@ -35,28 +59,31 @@ func (s *UserService) RegisterUser(user *models.User, device *models.Device) (st
 		user.Username, user.FirstName, user.LastName, user.Email, user.DateOfBirth, user.AddressLine1, user.AddressLine2, user.City, user.State, user.Country, user.ZipCode, user.PhoneCountryCode, user.PhoneNumber,
 	)
 	if err != nil {
-		return "", "", fmt.Errorf("could not save user: %v", err)
+		return nil, fmt.Errorf("could not save user: %v", err)
 	}
 
 	// Retrieve the user ID and save user_auth
 	var userID int
-	err = database.PostgresDB.QueryRow("SELECT user_id FROM data.users WHERE email=$1", user.Email).Scan(&userID)
+	var uid string
+	err = database.PostgresDB.QueryRow("SELECT user_id, uid FROM data.users WHERE email=$1", user.Email).Scan(&userID, &uid)
 	if err != nil {
-		return "", "", fmt.Errorf("could not retrieve user ID: %v", err)
+		return nil, fmt.Errorf("could not retrieve user ID: %v", err)
 	}
 
 	// Save device to the database
-	s.SaveDevice(userID, device)
+	if err := s.SaveDevice(userID, device, ipAddress); err != nil {
+		log.Printf("%v\n", err)
+	}
 
 	// Generate auth token
-	accessToken, err := utils.GenerateToken(user.Username, device.DeviceID, user.Email)
+	accessToken, err := utils.GenerateToken(uid, user.Username, device.DeviceID, user.Email, nil)
 	if err != nil {
-		return "", "", fmt.Errorf("could not generate token: %v", err)
+		return nil, fmt.Errorf("could not generate token: %v", err)
 	}
 
 	refreshToken, err := utils.GenerateRefreshToken()
 	if err != nil {
-		return "", "", fmt.Errorf("could not generate access token: %v", err)
+		return nil, fmt.Errorf("could not generate access token: %v", err)
 	}
 
 	// Save user_auth to the database
@@ -65,85 +92,210 @@ func (s *UserService) RegisterUser(user *models.User, device *models.Device) (st
 		userID, string(hashedPassword), accessToken, refreshToken,
 	)
 	if err != nil {
-		return "", "", fmt.Errorf("could not save user authentication: %v", err)
+		return nil, fmt.Errorf("could not save user authentication: %v", err)
 	}
-	return accessToken, refreshToken, nil
+	if err := s.StoreRefreshToken(userID, device.DeviceID, refreshToken); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	// The account works right away, the unverified account policy applies until the address is confirmed
+	if err := NewVerificationService().SendVerification(userID, user.Email); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v\n", userID, err)
+	}
+	return &models.LoginResponse{UserID: uid, DeviceID: device.DeviceID, AccessToken: accessToken, RefreshToken: refreshToken}, nil
 }
 
-// GetToken retrieves the token for a user from the database - Login User
-func (s *UserService) AuthenticateUser(credentials *models.Credentials, device *models.Device) (string, string, error) {
-	var user_id int
-	var password_hash, email string
-	query := "SELECT a.auth_id, password_hash, u.email FROM data.user_auth a join data.users u on a.user_id = u.user_id WHERE u.username=$1"
-	err := database.PostgresDB.QueryRow(query, credentials.Username).Scan(&user_id, &password_hash, &email)
+// GetToken retrieves the token for a user from the database - Login User. Unknown usernames and
+// wrong passwords fail alike with ErrInvalidCredentials; repeated failures delay and then lock
+// further attempts on the username with a *RateLimitError. Users with a second factor get an MFA
+// challenge instead of tokens, which CompleteMFALogin exchanges for them.
+func (s *UserService) AuthenticateUser(credentials *models.Credentials, device *models.Device, ipAddress string) (*models.LoginResponse, error) {
+	attempt := &models.LoginAttempt{
+		Username:  strings.ToLower(credentials.Username),
+		IPAddress: ipAddress,
+		DeviceID:  device.DeviceID,
+	}
+	failures, err := s.claimLoginAttempt(attempt.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	var account models.Account
+	var password_hash string
+	query := "SELECT u.user_id, u.uid, u.username, u.email, password_hash FROM data.user_auth a join data.users u on a.user_id = u.user_id WHERE u.username=$1"
+	err = database.PostgresDB.QueryRow(query, credentials.Username).Scan(&account.ID, &account.UserID, &account.Username, &account.Email, &password_hash)
 	if err == sql.ErrNoRows {
-		return "", "", errors.New("user not found")
+		// Spend the same time as for a wrong password so that response times do not reveal accounts
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(credentials.Password))
+		s.recordLoginFailure(attempt, failures)
+		return nil, ErrInvalidCredentials
 	} else if err != nil {
-		return "", "", fmt.Errorf("error for %s: %v", credentials.Username, err)
+		return nil, fmt.Errorf("could not load credentials: %v", err)
 	}
 
 	// Compare the stored password hash with the provided password
 	err = bcrypt.CompareHashAndPassword([]byte(password_hash), []byte(credentials.Password))
 	if err != nil {
-		return "", "", errors.New("invalid Credentials")
+		attempt.UserID = account.ID
+		s.recordLoginFailure(attempt, failures)
+		return nil, ErrInvalidCredentials
 	}
 
-	accessToken, err := utils.GenerateToken(credentials.Username, device.DeviceID, email)
+	mfaEnabled, err := database.IsTOTPEnabled(account.ID)
 	if err != nil {
-		return "", "", fmt.Errorf("could not generate access token: %v", err)
+		return nil, err
+	}
+	if mfaEnabled {
+		return NewMFAService().createChallenge(&models.MFAChallenge{
+			UserID:    account.ID,
+			Username:  account.Username,
+			Email:     account.Email,
+			IPAddress: ipAddress,
+			Device:    *device,
+		})
 	}
 
-	// Save the device
-	s.SaveDevice(user_id, device)
+	attempt.UserID = account.ID
+	return s.completeLogin(&account, device, attempt, false)
+}
+
+// completeLogin issues the tokens of a login whose factors were all accepted. Unless the login
+// passed a second factor, the token leaves out the roles that require one.
+func (s *UserService) completeLogin(account *models.Account, device *models.Device, attempt *models.LoginAttempt, secondFactor bool) (*models.LoginResponse, error) {
+	roles, err := database.ListUserRoles(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	withheld := !secondFactor && slices.ContainsFunc(roles, utils.RequiresSecondFactor)
+	if withheld {
+		roles = slices.DeleteFunc(roles, utils.RequiresSecondFactor)
+		log.Printf("Withheld the privileged roles of %s, who logged in without a second factor\n", account.UserID)
+	}
+
+	// Save the device first, devices without an ID are given one for the token
+	if err := s.SaveDevice(account.ID, device, attempt.IPAddress); err != nil {
+		log.Printf("%v\n", err)
+	}
+	attempt.DeviceID = device.DeviceID
+
+	accessToken, err := utils.GenerateToken(account.UserID, account.Username, device.DeviceID, account.Email, roles)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate access token: %v", err)
+	}
 
 	refreshToken, err := utils.GenerateRefreshToken()
 	if err != nil {
-		return "", "", fmt.Errorf("could not generate access token: %v", err)
+		return nil, fmt.Errorf("could not generate access token: %v", err)
 	}
 
 	// Store refresh token in DB
-	err = s.StoreRefreshToken(user_id, refreshToken)
+	err = s.StoreRefreshToken(account.ID, device.DeviceID, refreshToken)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	return accessToken, refreshToken, nil
+	s.recordLoginSuccess(account.UserID, attempt)
+	return &models.LoginResponse{
+		UserID:              account.UserID,
+		DeviceID:            device.DeviceID,
+		AccessToken:         accessToken,
+		RefreshToken:        refreshToken,
+		MFAEnrollmentNeeded: withheld,
+	}, nil
 }
 
-// StoreRefreshToken saves a refresh token in the database
-func (s *UserService) StoreRefreshToken(userID int, refreshToken string) error {
-	query := `INSERT INTO data.refresh_tokens (user_id, token, expires_at) VALUES ($1, $2, $3)`
-	_, err := database.PostgresDB.Exec(query, userID, refreshToken, time.Now().Add(30*24*time.Hour)) // 30 days
-	return err
+// claimLoginAttempt counts a login attempt on a username and returns the failures including it,
+// or a *RateLimitError if logins for the username are refused. Attempts beyond the lockout that
+// were started before it took effect lock the username as well.
+func (s *UserService) claimLoginAttempt(username string) (int, error) {
+	failures, blockedUntil, err := database.ClaimLoginAttempt(username, loginFailureWindow)
+	if err != nil {
+		return 0, err
+	}
+	if failures > loginLockoutAfter {
+		blockedUntil = time.Now().Add(loginLockoutDuration)
+		if err := database.BlockLogin(username, blockedUntil); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	if wait := time.Until(blockedUntil); wait > 0 {
+		return 0, &RateLimitError{Policy: "login_lockout", RetryAfter: wait}
+	}
+	return failures, nil
 }
 
-// SaveDevice saves a new device to the database.
-func (s *UserService) SaveDevice(user_id int, device *models.Device) (string, error) {
-	_, err := database.PostgresDB.Exec(
-		`INSERT INTO data.devices (
-			user_id, name, type, manufacturer, model, serial_number, firmware, hardware_version, 
-			software_version, operating_system, processor, memory, storage_capacity, screen_size, 
-			resolution, camera, sensors, ports, dimensions, weight, color, material, power_source, 
-			battery_level, signal_strength, connectivity_type, ip_address, mac_address, network_provider, 
-			plan_type, subscription_end, status, last_seen, location, owner, created_at, updated_at, 
-			usage_time, notes
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, 
-			$21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39
-		)`,
-		user_id, device.Name, device.Type, device.Manufacturer, device.Model, device.SerialNumber,
-		device.Firmware, device.HardwareVersion, device.SoftwareVersion, device.OperatingSystem,
-		device.Processor, device.Memory, device.StorageCapacity, device.ScreenSize, device.Resolution,
-		device.Camera, device.Sensors, device.Ports, device.Dimensions, device.Weight, device.Color,
-		device.Material, device.PowerSource, device.BatteryLevel, device.SignalStrength,
-		device.ConnectivityType, device.IPAddress, device.MACAddress, device.NetworkProvider,
-		device.PlanType, device.SubscriptionEnd, device.Status, device.LastSeen, device.Location,
-		device.Owner, device.CreatedAt, device.UpdatedAt, device.UsageTime, device.Notes,
-	)
+// recordLoginFailure stores a failed attempt and, after repeated failures, refuses further attempts
+// on the username for a growing delay and finally for the lockout duration. failures is the count
+// returned when the attempt was claimed.
+func (s *UserService) recordLoginFailure(attempt *models.LoginAttempt, failures int) {
+	if err := database.RecordLoginAttempt(attempt); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	var block time.Duration
+	if failures >= loginLockoutAfter {
+		block = loginLockoutDuration
+		log.Printf("Locked out logins for %s after %d failures\n", attempt.Username, failures)
+	} else if failures >= loginDelayAfter {
+		block = min(time.Second<<(failures-loginDelayAfter), maxLoginDelay)
+	}
+	if block > 0 {
+		if err := database.BlockLogin(attempt.Username, time.Now().Add(block)); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+}
+
+// recordLoginSuccess clears the failures of a username, stores the attempt and tells the user
+// about logins from a device or address they never used before
+func (s *UserService) recordLoginSuccess(userID string, attempt *models.LoginAttempt) {
+	attempt.Succeeded = true
+	if err := database.ResetLoginFailures(attempt.Username); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	hasHistory, knownDevice, knownIP, err := database.GetLoginHistory(attempt.UserID, attempt.DeviceID, attempt.IPAddress)
 	if err != nil {
-		return "", fmt.Errorf("could not save device: %v", err)
+		log.Printf("%v\n", err)
+	} else if hasHistory {
+		attempt.NewDevice = attempt.DeviceID != "" && !knownDevice
+		attempt.NewIP = !knownIP
+	}
+
+	if err := database.RecordLoginAttempt(attempt); err != nil {
+		log.Printf("%v\n", err)
+	}
+	if attempt.NewDevice || attempt.NewIP {
+		log.Printf("Login of %s from a new device or address %s\n", userID, attempt.IPAddress)
+		SendEventWithPriority(userID, models.PriorityHigh, EventNewLogin, attempt)
+	}
+}
+
+// LoginHistory returns the latest login attempts on a user's account
+func (s *UserService) LoginHistory(userID string) ([]*models.LoginAttempt, error) {
+	account, err := loadAccount(userID)
+	if err != nil {
+		return nil, err
+	}
+	return database.ListLoginAttempts(account.ID, loginHistorySize)
+}
+
+// StoreRefreshToken saves a refresh token in the database, bound to the device it was issued on
+func (s *UserService) StoreRefreshToken(userID int, deviceID, refreshToken string) error {
+	return database.StoreRefreshToken(userID, deviceID, refreshToken, time.Now().Add(30*24*time.Hour)) // 30 days
+}
+
+// SaveDevice records a login from a device, updating the device's row if the user signed in from
+// it before. Devices without an ID are given one, which the client should send on its next login.
+func (s *UserService) SaveDevice(userID int, device *models.Device, ipAddress string) error {
+	if device.DeviceID == "" {
+		deviceID, err := utils.GenerateRandomString(22)
+		if err != nil {
+			return err
+		}
+		device.DeviceID = deviceID
 	}
-	return "Device saved successfully", nil
+	return database.UpsertDevice(userID, device, ipAddress)
 }
 
 // UserExists checks if a user with the given email already exists in the database.
@@ -157,3 +309,48 @@ func (s *UserService) UserExists(email string) bool {
 	}
 	return exists
 }
+
+// FindUser returns the account with a username
+func (s *UserService) FindUser(username string) (*models.Account, error) {
+	account, err := database.GetAccountByName(username)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: unknown user %q", ErrInvalidRequest, username)
+	}
+	return account, err
+}
+
+// LookupUsers translates between user IDs and usernames. Unknown IDs and names are left out of
+// the result.
+func (s *UserService) LookupUsers(userIDs, usernames []string) ([]*models.UserProfile, error) {
+	if len(userIDs)+len(usernames) == 0 {
+		return nil, fmt.Errorf("%w: user_id or username is required", ErrInvalidRequest)
+	}
+	if len(userIDs)+len(usernames) > maxUserLookup {
+		return nil, fmt.Errorf("%w: at most %d users can be looked up at once", ErrInvalidRequest, maxUserLookup)
+	}
+	return database.LookupUsers(userIDs, usernames)
+}
+
+// RenameUser changes the username of a user. Tokens, connections and messages refer to the user
+// ID and are not affected.
+func (s *UserService) RenameUser(userID, username string) (*models.UserProfile, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > maxUsernameLength {
+		return nil, fmt.Errorf("%w: usernames have 1 to %d characters", ErrInvalidRequest, maxUsernameLength)
+	}
+	if IsBotName(username) {
+		return nil, fmt.Errorf("%w: usernames ending in _bot are reserved", ErrInvalidRequest)
+	}
+	if IsUserIDName(username) {
+		return nil, fmt.Errorf("%w: usernames shaped like user IDs are reserved", ErrInvalidRequest)
+	}
+	renamed, err := database.RenameUser(userID, username)
+	if err != nil {
+		return nil, err
+	}
+	if !renamed {
+		return nil, fmt.Errorf("%w: the username %q is taken", ErrInvalidRequest, username)
+	}
+	log.Printf("User %s is now called %s\n", userID, username)
+	return &models.UserProfile{UserID: userID, Username: username}, nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"websocket-server/database"
+	"websocket-server/mailer"
+	"websocket-server/models"
+	"websocket-server/ratelimit"
+	"websocket-server/utils"
+)
+
+// Policies for accounts whose email address is not verified yet, set with UNVERIFIED_ACCOUNT_POLICY
+const (
+	UnverifiedPolicyOff         = "off"          // No restrictions
+	UnverifiedPolicyNoStrangers = "no_strangers" // Direct messages only to users who messaged them first
+	UnverifiedPolicyReadOnly    = "read_only"    // No messages at all
+)
+
+// verificationTokenTTL is how long an email verification link stays valid
+const verificationTokenTTL = 24 * time.Hour
+
+// PolicyVerificationEmail limits how often a user can have the verification email sent again
+var PolicyVerificationEmail = ratelimit.Per("verification_email", 3, time.Hour)
+
+var (
+	emailMailer      mailer.Mailer
+	unverifiedPolicy = UnverifiedPolicyNoStrangers
+	// appBaseURL is the absolute URL of the app, without a trailing slash, that links in emails and
+	// OIDC redirects point to
+	appBaseURL string
+)
+
+// InitializeMailer sets up the mailer from the environment and reads the app's base URL and the
+// unverified account policy.
+func InitializeMailer() {
+	m, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+	emailMailer = m
+
+	appBaseURL = strings.TrimRight(os.Getenv("APP_BASE_URL"), "/")
+	if parsed, err := url.Parse(appBaseURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		log.Fatalf("APP_BASE_URL must be an absolute http or https URL, got %q", appBaseURL)
+	}
+
+	switch policy := os.Getenv("UNVERIFIED_ACCOUNT_POLICY"); policy {
+	case "":
+	case UnverifiedPolicyOff, UnverifiedPolicyNoStrangers, UnverifiedPolicyReadOnly:
+		unverifiedPolicy = policy
+	default:
+		log.Fatalf("Invalid UNVERIFIED_ACCOUNT_POLICY %q", policy)
+	}
+	log.Printf("Mailer initialized, unverified accounts are %s\n", unverifiedPolicy)
+}
+
+// VerificationService provides email address verification
+type VerificationService struct{}
+
+// NewVerificationService creates a new instance of VerificationService
+func NewVerificationService() *VerificationService {
+	return &VerificationService{}
+}
+
+// hashVerificationID returns the stored form of a verification token's ID
+func hashVerificationID(id string) string {
+	digest := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(digest[:])
+}
+
+// SendVerification issues a one-time verification token for a user's email address and mails
+// the verification link to it.
+func (s *VerificationService) SendVerification(userID int, email string) error {
+	id, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
+	signature, expiresAt := utils.SignValue(id, time.Now().Add(verificationTokenTTL))
+	if err := database.CreateEmailVerification(userID, email, hashVerificationID(id), time.Unix(expiresAt, 0)); err != nil {
+		return err
+	}
+
+	// The token is signed so that forged tokens are rejected without a database lookup
+	token := id + "." + strconv.FormatInt(expiresAt, 10) + "." + signature
+	link := appBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return emailMailer.Send(&mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Please confirm your email address by opening the link below within 24 hours.\n\n" + link +
+			"\n\nIf you did not create an account, you can ignore this email.\n",
+	})
+}
+
+// Resend sends a new verification email to a user whose address is not verified yet
+func (s *VerificationService) Resend(userID string) error {
+	id, email, err := database.GetPendingVerification(userID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: email address is already verified", ErrInvalidRequest)
+	} else if err != nil {
+		return fmt.Errorf("could not load verification status: %v", err)
+	}
+	if err := CheckRateLimit(PolicyVerificationEmail, userID); err != nil {
+		return err
+	}
+	return s.SendVerification(id, email)
+}
+
+// Verify redeems a verification token and marks the address it was issued for verified
+func (s *VerificationService) Verify(token string) error {
+	invalid := fmt.Errorf("%w: invalid or expired verification token", ErrInvalidRequest)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !utils.VerifySignedValue(parts[0], expiresAt, parts[2]) {
+		return invalid
+	}
+
+	userID, err := database.ConsumeEmailVerification(hashVerificationID(parts[0]))
+	if err == sql.ErrNoRows {
+		return invalid
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Verified email address of user %d\n", userID)
+	return nil
+}
+
+// checkSenderVerified applies the unverified account policy to an outgoing message
+func checkSenderVerified(msg *models.Message) error {
+	if unverifiedPolicy == UnverifiedPolicyOff {
+		return nil
+	}
+	unverified, err := database.IsEmailUnverified(msg.SenderID)
+	if err != nil || !unverified {
+		return err
+	}
+
+	// Channels the sender belongs to and users who messaged the sender first are not strangers
+	if unverifiedPolicy == UnverifiedPolicyNoStrangers {
+		if msg.ChannelID != "" {
+			return nil
+		}
+		known, err := database.HasReceivedMessageFrom(msg.SenderID, msg.RecipientID)
+		if err != nil || known {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: verify your email address to send this message", ErrForbidden)
+}
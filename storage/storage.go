@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when a blob does not exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore is implemented by every attachment storage backend
+type BlobStore interface {
+	// Put stores the content under key, replacing any existing blob
+	Put(key string, content io.Reader) (int64, error)
+	// Open returns a reader for the blob stored under key
+	Open(key string) (io.ReadCloser, error)
+	// Exists reports whether a blob is stored under key
+	Exists(key string) (bool, error)
+	// Delete removes the blob stored under key
+	Delete(key string) error
+}
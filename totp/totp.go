@@ -0,0 +1,99 @@
+// Package totp implements time-based one-time passwords (RFC 6238) with the parameters
+// authenticator apps use by default: HMAC-SHA1, 6 digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of a code
+	Digits = 6
+	// Period is how long a code is valid, in seconds
+	Period = 30
+
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded as authenticator apps expect it
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// URI returns the otpauth URI of a secret, which authenticator apps read from a QR code
+func URI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(Period))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// codeModulus keeps the last Digits decimal digits of a truncated HMAC
+var codeModulus = func() uint32 {
+	modulus := uint32(1)
+	for range Digits {
+		modulus *= 10
+	}
+	return modulus
+}()
+
+// Step returns the time step a point in time falls into
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of a secret for a time step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %v", err)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation as in RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%codeModulus), nil
+}
+
+// Validate checks a code against the steps around now, allowing skew steps of clock drift either
+// way, and returns the step that matched
+func Validate(secret, code string, now time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for offset := -int64(skew); offset <= int64(skew); offset++ {
+		expected, err := Code(secret, current+offset)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return current + offset, true
+		}
+	}
+	return 0, false
+}
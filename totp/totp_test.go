@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", test.unix, err)
+		}
+		if code != test.code {
+			t.Errorf("Code at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+	tests := []struct {
+		name   string
+		offset int64
+		skew   int
+		ok     bool
+	}{
+		{"current step", 0, 1, true},
+		{"previous step within skew", -1, 1, true},
+		{"next step within skew", 1, 1, true},
+		{"two steps behind", -2, 1, false},
+		{"two steps ahead", 2, 1, false},
+		{"previous step without skew", -1, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, current+test.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step, ok := Validate(rfcSecret, code, now, test.skew)
+			if ok != test.ok {
+				t.Fatalf("Validate = %v, want %v", ok, test.ok)
+			}
+			// The matched step is what replays are detected by, it must be the code's own
+			if ok && step != current+test.offset {
+				t.Errorf("Validate matched step %d, want %d", step, current+test.offset)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for _, code := range []string{"", "00592", "0059240", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "005924", now, 1); ok {
+		t.Error("Validate accepted a code for an invalid secret")
+	}
+}
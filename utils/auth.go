@@ -5,39 +5,50 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 var jwtSecret = []byte("c4e726b73a7b4c91b7e781c6a18e8d2e97fb3f769d47dced8e8d8131a8b4f4a6") // Replace with env variable in production
-var tokenExpirationTime = jwt.NewNumericDate(time.Now().Add(24 * time.Hour))               // Token expiration time
+var tokenLifetime = 24 * time.Hour                                                         // Lifetime of access tokens
 
-// Claims represents the JWT claims
+// Claims represents the JWT claims. The subject is the stable user ID, the username and email
+// address are informational and may have changed since the token was issued.
 type Claims struct {
-	UserName string `json:"username"`
-	DeviceID string `json:"device_id"`
-	Email    string `json:"email"`
+	UserName string   `json:"username"`
+	DeviceID string   `json:"device_id"`
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"` // Derived from the roles when the token is issued
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a new access token
-func GenerateToken(username, device_id, email string) (string, error) {
+// GenerateToken creates a new access token for a user holding roles in addition to RoleUser
+func GenerateToken(userID, username, device_id, email string, roles []string) (string, error) {
+	if !slices.Contains(roles, RoleUser) {
+		roles = append([]string{RoleUser}, roles...)
+	}
 	claims := &Claims{
 		UserName: username,
 		DeviceID: device_id,
 		Email:    email,
+		Roles:    roles,
+		Scopes:   ScopesForRoles(roles),
 		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: tokenExpirationTime, // Token expires in 24 hours
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenLifetime)),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
 
-// ValidateToken validates a JWT and extracts the user ID if valid
-func ValidateToken(tokenString string) (string, error) {
+// ParseToken validates a JWT and returns its claims. Tokens without an expiry are rejected, and so
+// are tokens without a subject, which were issued before stable user IDs existed.
+func ParseToken(tokenString string) (*Claims, error) {
 	// Parse the token
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		// Ensure the token method is HMAC
@@ -45,24 +56,38 @@ func ValidateToken(tokenString string) (string, error) {
 			return nil, errors.New("unexpected signing method")
 		}
 		return jwtSecret, nil
-	})
-	if err != nil {
-		return "", errors.New("invalid token")
+	}, jwt.WithExpirationRequired())
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, errors.New("token has expired")
+	} else if err != nil {
+		return nil, errors.New("invalid token")
 	}
 
 	// Extract claims
 	claims, ok := token.Claims.(*Claims)
 	if !ok || !token.Valid {
-		return "", errors.New("invalid token claims")
+		return nil, errors.New("invalid token claims")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject, sign in again")
 	}
+	return claims, nil
+}
 
-	// Check token expiration
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		return "", errors.New("token has expired")
+// UserID returns the stable ID of the user the token was issued to
+func (c *Claims) UserID() string {
+	return c.Subject
+}
+
+// ValidateToken validates a JWT and extracts the user ID if valid
+func ValidateToken(tokenString string) (string, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return "", err
 	}
 
 	// Return the user ID from the claims
-	return claims.UserName, nil
+	return claims.UserID(), nil
 }
 
 // GenerateRefreshToken creates a new refresh token
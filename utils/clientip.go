@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustForwardedFor enables X-Forwarded-For when the server runs behind a reverse proxy.
+// It must stay off otherwise, as clients could pick their own address.
+var trustForwardedFor = os.Getenv("TRUST_FORWARDED_FOR") == "true"
+
+// ClientIP returns the address of the client that sent a request
+func ClientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The proxy appends the address it saw, the last entry is the one it vouches for
+			entries := strings.Split(forwarded, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Reasons a WebSocket upgrade is rejected by CheckOrigin, counted in UpgradeRejections
+const (
+	rejectOriginNotAllowed = "origin_not_allowed"
+	rejectOriginMissing    = "origin_missing"
+	rejectOriginInvalid    = "origin_invalid"
+)
+
+// UpgradeRejections counts rejected WebSocket upgrades by reason, published on /debug/vars
+var UpgradeRejections = expvar.NewMap("websocket_upgrade_rejections")
+
+// allowedOrigins holds the WS_ALLOWED_ORIGINS entries, comma separated origins such as
+// "https://app.example.com" or "https://*.example.com" for any subdomain. "*" allows every
+// origin. When unset, only same-origin upgrades are allowed. Entries that are not an origin, such
+// as URLs with a path, would never match and stop the server instead.
+var allowedOrigins = parseOriginPatterns(os.Getenv("WS_ALLOWED_ORIGINS"))
+
+// allowMissingOrigin decides whether clients that send no Origin header are accepted. Browsers
+// always send one, native clients usually do not. Set WS_MISSING_ORIGIN=deny to reject them.
+var allowMissingOrigin = !strings.EqualFold(os.Getenv("WS_MISSING_ORIGIN"), "deny")
+
+// originPattern is an allowed origin, host may start with "*." to match any subdomain
+type originPattern struct {
+	scheme string
+	host   string
+}
+
+// parseOriginPatterns parses a comma separated list of allowed origins and stops the server if
+// one of them is invalid
+func parseOriginPatterns(value string) []originPattern {
+	var patterns []originPattern
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, err := parseOriginPattern(entry)
+		if err != nil {
+			log.Fatalf("Invalid allowed origin %q in WS_ALLOWED_ORIGINS: %v", entry, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// parseOriginPattern parses an allowed origin, dropping a trailing slash
+func parseOriginPattern(entry string) (originPattern, error) {
+	if entry == "*" {
+		return originPattern{scheme: "*", host: "*"}, nil
+	}
+	// Origins have no path, a trailing slash is tolerated
+	scheme, host, ok := strings.Cut(entry, "://")
+	host, path, _ := strings.Cut(host, "/")
+	if !ok || host == "" || path != "" || strings.ContainsAny(host, "?#@") {
+		return originPattern{}, errors.New("expected scheme://host[:port]")
+	}
+	return originPattern{scheme: strings.ToLower(scheme), host: strings.ToLower(host)}, nil
+}
+
+// matches reports whether an origin's scheme and host (with port, if any) match the pattern
+func (p originPattern) matches(scheme, host string) bool {
+	if p.scheme == "*" {
+		return true
+	}
+	if p.scheme != scheme {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+		// "*.example.com" matches subdomains but not example.com itself
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return p.host == host
+}
+
+// CheckOrigin is the CheckOrigin function of every WebSocket upgrader. It protects against
+// cross-site WebSocket hijacking by accepting only allowlisted origins.
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if !allowMissingOrigin {
+			rejectUpgrade(r, rejectOriginMissing)
+		}
+		return allowMissingOrigin
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		rejectUpgrade(r, rejectOriginInvalid)
+		return false
+	}
+	scheme, host := strings.ToLower(parsed.Scheme), strings.ToLower(parsed.Host)
+
+	if len(allowedOrigins) == 0 {
+		if host == strings.ToLower(r.Host) {
+			return true
+		}
+	}
+	for _, pattern := range allowedOrigins {
+		if pattern.matches(scheme, host) {
+			return true
+		}
+	}
+	rejectUpgrade(r, rejectOriginNotAllowed)
+	return false
+}
+
+// rejectUpgrade logs and counts a rejected upgrade
+func rejectUpgrade(r *http.Request, reason string) {
+	UpgradeRejections.Add(reason, 1)
+	log.Printf("Rejected WebSocket upgrade from %s (origin %q): %s\n", r.RemoteAddr, r.Header.Get("Origin"), reason)
+}
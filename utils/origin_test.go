@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseOriginPattern(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    originPattern
+		invalid bool
+	}{
+		{entry: "https://app.example.com", want: originPattern{"https", "app.example.com"}},
+		{entry: "https://app.example.com/", want: originPattern{"https", "app.example.com"}},
+		{entry: "HTTPS://App.Example.com:8443", want: originPattern{"https", "app.example.com:8443"}},
+		{entry: "https://*.example.com", want: originPattern{"https", "*.example.com"}},
+		{entry: "*", want: originPattern{"*", "*"}},
+		{entry: "https://app.example.com/chat", invalid: true},
+		{entry: "https://app.example.com//", invalid: true},
+		{entry: "https://app.example.com?x=1", invalid: true},
+		{entry: "https://user@app.example.com", invalid: true},
+		{entry: "app.example.com", invalid: true},
+		{entry: "https://", invalid: true},
+	}
+	for _, test := range tests {
+		pattern, err := parseOriginPattern(test.entry)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseOriginPattern(%q) = %+v, want an error", test.entry, pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseOriginPattern(%q): %v", test.entry, err)
+		} else if pattern != test.want {
+			t.Errorf("parseOriginPattern(%q) = %+v, want %+v", test.entry, pattern, test.want)
+		}
+	}
+}
+
+func TestOriginPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		scheme  string
+		host    string
+		want    bool
+	}{
+		{"https://app.example.com", "https", "app.example.com", true},
+		{"https://app.example.com", "http", "app.example.com", false},
+		{"https://app.example.com", "https", "app.example.com:8443", false},
+		{"https://app.example.com:8443", "https", "app.example.com:8443", true},
+		{"https://*.example.com", "https", "app.example.com", true},
+		{"https://*.example.com", "https", "a.b.example.com", true},
+		{"https://*.example.com", "https", "example.com", false},
+		{"https://*.example.com", "https", "evilexample.com", false},
+		{"https://*.example.com", "https", "app.example.com.evil.com", false},
+		{"https://example.com", "https", "app.example.com", false},
+		{"*", "http", "anything.test", true},
+	}
+	for _, test := range tests {
+		pattern, err := parseOriginPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("parseOriginPattern(%q): %v", test.pattern, err)
+		}
+		if got := pattern.matches(test.scheme, test.host); got != test.want {
+			t.Errorf("%q matches %s://%s = %v, want %v", test.pattern, test.scheme, test.host, got, test.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	defer func(patterns []originPattern, allowMissing bool) {
+		allowedOrigins, allowMissingOrigin = patterns, allowMissing
+	}(allowedOrigins, allowMissingOrigin)
+
+	tests := []struct {
+		name         string
+		allowed      string
+		allowMissing bool
+		origin       string
+		want         bool
+	}{
+		{"same origin without allowlist", "", true, "https://chat.example.com", true},
+		{"cross origin without allowlist", "", true, "https://evil.test", false},
+		{"allowlisted origin", "https://app.example.com/", true, "https://app.example.com", true},
+		{"allowlisted subdomain", "https://*.example.com", true, "https://web.example.com", true},
+		{"apex of a subdomain pattern", "https://*.example.com", true, "https://example.com", false},
+		{"missing origin allowed", "https://app.example.com", true, "", true},
+		{"missing origin denied", "https://app.example.com", false, "", false},
+		{"unparsable origin", "*", true, "null", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowedOrigins, allowMissingOrigin = parseOriginPatterns(test.allowed), test.allowMissing
+			r := httptest.NewRequest("GET", "https://chat.example.com/ws", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if got := CheckOrigin(r); got != test.want {
+				t.Errorf("CheckOrigin = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
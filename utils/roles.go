@@ -0,0 +1,73 @@
+package utils
+
+import "slices"
+
+// Roles a user can hold. Every user holds RoleUser, the others are granted in data.user_roles.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+	RoleService   = "service" // Internal services and bots
+)
+
+// Scopes of access tokens, each role grants a fixed set of them
+const (
+	ScopeMessages  = "messages"    // Send and read messages
+	ScopeModerate  = "moderate"    // Delete other users' messages
+	ScopeBroadcast = "broadcast"   // Send announcements to every connected user
+	ScopeUserAdmin = "users:admin" // Grant and revoke roles
+)
+
+// roleScopes lists the scopes each role grants
+var roleScopes = map[string][]string{
+	RoleUser:      {ScopeMessages},
+	RoleModerator: {ScopeMessages, ScopeModerate},
+	RoleAdmin:     {ScopeMessages, ScopeModerate, ScopeBroadcast, ScopeUserAdmin},
+	RoleService:   {ScopeMessages, ScopeBroadcast},
+}
+
+// secondFactorRoles are the roles a login only carries when it passed a second factor
+var secondFactorRoles = []string{RoleModerator, RoleAdmin}
+
+// IsValidRole reports whether a role exists
+func IsValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// ScopesForRoles returns the scopes granted by a set of roles, in a stable order
+func ScopesForRoles(roles []string) []string {
+	var scopes []string
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	slices.Sort(scopes)
+	return scopes
+}
+
+// RequiresSecondFactor reports whether a role is only granted to logins that passed a second factor
+func RequiresSecondFactor(role string) bool {
+	return slices.Contains(secondFactorRoles, role)
+}
+
+// HasRole reports whether the token was issued to a holder of a role
+func (c *Claims) HasRole(role string) bool {
+	return role == RoleUser || slices.Contains(c.Roles, role)
+}
+
+// HasScope reports whether the token grants a scope. Tokens issued before roles existed carry
+// neither and grant the scopes of RoleUser.
+func (c *Claims) HasScope(scope string) bool {
+	if scope == "" {
+		return true
+	}
+	scopes := c.Scopes
+	if len(scopes) == 0 && len(c.Roles) == 0 {
+		scopes = roleScopes[RoleUser]
+	}
+	return slices.Contains(scopes, scope)
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+// ErrSecretEncryptionDisabled is returned when secrets are to be stored without
+// SECRET_ENCRYPTION_KEY being set
+var ErrSecretEncryptionDisabled = errors.New("SECRET_ENCRYPTION_KEY is not set")
+
+// secretEncryptionKey encrypts secrets stored in the database, such as TOTP seeds. It is derived
+// from SECRET_ENCRYPTION_KEY and is unset when the variable is.
+var secretEncryptionKey *[32]byte
+
+// legacySecretEncryptionKey is derived from the JWT secret, which sealed secrets before
+// SECRET_ENCRYPTION_KEY was required. It only opens secrets stored back then.
+var legacySecretEncryptionKey = sha256.Sum256(jwtSecret)
+
+func init() {
+	if value := os.Getenv("SECRET_ENCRYPTION_KEY"); value != "" {
+		key := sha256.Sum256([]byte(value))
+		secretEncryptionKey = &key
+	}
+}
+
+// SecretEncryptionEnabled reports whether secrets can be stored, that is whether
+// SECRET_ENCRYPTION_KEY is set
+func SecretEncryptionEnabled() bool {
+	return secretEncryptionKey != nil
+}
+
+// EncryptSecret seals a secret with AES-GCM for storage. It fails with
+// ErrSecretEncryptionDisabled unless SECRET_ENCRYPTION_KEY is set.
+func EncryptSecret(plaintext string) (string, error) {
+	if secretEncryptionKey == nil {
+		return "", ErrSecretEncryptionDisabled
+	}
+	gcm, err := secretCipher(secretEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret opens a secret sealed by EncryptSecret, or by the legacy key derived from the
+// JWT secret
+func DecryptSecret(ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []*[32]byte{secretEncryptionKey, &legacySecretEncryptionKey} {
+		if key == nil {
+			continue
+		}
+		gcm, err := secretCipher(key)
+		if err != nil {
+			return "", err
+		}
+		if len(sealed) < gcm.NonceSize() {
+			return "", errors.New("invalid encrypted secret")
+		}
+		plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", errors.New("invalid encrypted secret")
+}
+
+// secretCipher returns the AES-GCM cipher of an encryption key
+func secretCipher(key *[32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}